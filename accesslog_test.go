@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorderCapturesStatusAndBytes(t *testing.T) {
+	sr := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	http.Error(sr, "not found", http.StatusNotFound)
+
+	if sr.status != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", sr.status)
+	}
+	if sr.bytes != int64(len("not found\n")) {
+		t.Fatalf("expected %d bytes, got %d", len("not found\n"), sr.bytes)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"time"
+)
+
+// adminRoute describes an endpoint registered through handleAdmin, used for the /admin index
+type adminRoute struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+}
+
+var adminRoutes []adminRoute
+
+// handleAdmin registers an admin-only handler on mux and records it in the /admin index
+func handleAdmin(mux *http.ServeMux, path string, methods []string, description string, handler http.HandlerFunc) {
+	adminRoutes = append(adminRoutes, adminRoute{Path: path, Methods: methods, Description: description})
+	mux.HandleFunc(path, requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}))
+}
+
+// registerAdminRoutes sets up the admin surface on the relay router
+func registerAdminRoutes(mux *http.ServeMux) {
+	if config.AdminIndex {
+		handleAdmin(mux, "/admin", []string{"GET"}, "list available admin endpoints", handleAdminIndex)
+	}
+	handleAdmin(mux, "/admin/refresh", []string{"POST"}, "re-fetch the team's nostr.json now", handleAdminRefresh)
+	handleAdmin(mux, "/admin/status", []string{"GET"}, "membership, storage and blob usage at a glance", handleAdminStatus)
+	handleAdmin(mux, "/export", []string{"GET"}, "stream every event as newline-delimited JSON (?kind=&since=&gzip=true)", handleExport)
+	if config.BlossomEnabled {
+		handleAdmin(mux, "/stats/storage", []string{"GET"}, "blob count, bytes, largest blobs and size histogram", handleStorageStats)
+		handleAdmin(mux, "/admin/blobs", []string{"GET", "DELETE"}, "list a member's blobs (?pubkey=), or DELETE to remove them all", handleAdminBlobs)
+	}
+	if config.PprofEnabled {
+		handleAdmin(mux, "/debug/pprof/", []string{"GET", "POST"}, "runtime profiles: heap, goroutine, profile, trace, ...", handlePprof)
+	}
+}
+
+// handlePprof serves net/http/pprof under /debug/pprof/. We don't import it for its side
+// effect, which would register the handlers on http.DefaultServeMux without any auth.
+func handlePprof(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+func handleAdminIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminRoutes)
+}
+
+// handleAdminRefresh re-fetches membership synchronously and reports how many members are loaded
+func handleAdminRefresh(w http.ResponseWriter, r *http.Request) {
+	result := struct {
+		Members int    `json:"members"`
+		Error   string `json:"error,omitempty"`
+	}{}
+
+	status := http.StatusOK
+	if err := fetchNostrData(config.TeamDomain); err != nil {
+		result.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	result.Members = len(teamData().Names)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+type adminPubkeyKey struct{}
+
+// adminAuths remembers the NIP-98 events admin requests have been made with
+var adminAuths = newSeenAuthEvents(maxSeenAuthEvents)
+
+// requireAdmin only lets through requests carrying a valid NIP-98 auth event signed by an
+// admin pubkey, which handlers can get back with adminPubkey. Each auth event is good for
+// one request, so one captured on its way to a destructive endpoint can't be sent again.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey, err := readHTTPAuth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !isAdmin(pubkey) {
+			http.Error(w, "not an admin", http.StatusForbidden)
+			return
+		}
+		// readHTTPAuth refuses the event once it is httpAuthMaxAge old, so that's as long as
+		// it needs remembering; only admins' events are, so outsiders can't fill the store
+		evt := authorizationEvent(r)
+		if err := adminAuths.use(evt.ID, 1, evt.CreatedAt.Time().Add(httpAuthMaxAge)); err != nil {
+			writeAuthUseError(w, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), adminPubkeyKey{}, pubkey)))
+	}
+}
+
+// adminPubkey is the admin a request made it through requireAdmin as, for logging who did what
+func adminPubkey(r *http.Request) string {
+	pubkey, _ := r.Context().Value(adminPubkeyKey{}).(string)
+	return pubkey
+}
+
+func isAdmin(pubkey string) bool {
+	if len(config.AdminPubkeys) == 0 {
+		return pubkey == config.RelayPubkey
+	}
+	return slices.Contains(config.AdminPubkeys, pubkey)
+}
+
+// handleAdminStatus reports membership and storage state without having to go through the logs
+func handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Members             int        `json:"members"`
+		LastRefresh         *time.Time `json:"last_refresh"`
+		MembershipFromCache bool       `json:"membership_from_cache"`
+		MembershipAge       *int64     `json:"membership_age_seconds"`
+		MembershipStale     bool       `json:"membership_stale"`
+		WOTPubkeys          int        `json:"wot_pubkeys"`
+		DBEngine            string     `json:"db_engine"`
+		BlossomEnabled      bool       `json:"blossom_enabled"`
+		Blobs               int        `json:"blobs"`
+		BlobBytes           int64      `json:"blob_bytes"`
+		InvalidSignatures   int64      `json:"invalid_signatures"`
+		EventFloodsClosed   int64      `json:"event_floods_closed"`
+		KindRateLimited     int64      `json:"kind_rate_limited"`
+		Connections         int64      `json:"connections"`
+		ConnectionsRefused  int64      `json:"connections_refused"`
+	}{
+		Members:             len(teamData().Names),
+		MembershipFromCache: membershipFromCache.Load(),
+		WOTPubkeys:          wotSize(),
+		BlossomEnabled:      config.BlossomEnabled,
+		InvalidSignatures:   invalidSignatures.Load(),
+		EventFloodsClosed:   eventFloodsClosed.Load(),
+		KindRateLimited:     kindRateLimited.Load(),
+		Connections:         openConnections.Load(),
+		ConnectionsRefused:  connectionsRefused.Load(),
+	}
+	if fetched := lastMembershipFetch.Load(); fetched > 0 {
+		at := time.Unix(fetched, 0).UTC()
+		status.LastRefresh = &at
+	}
+	if age, loaded := membershipAge(); loaded {
+		seconds := int64(age.Seconds())
+		status.MembershipAge = &seconds
+		_, status.MembershipStale = membershipStale()
+	}
+	if config.DBEngine != nil {
+		status.DBEngine = *config.DBEngine
+	}
+	if config.BlossomEnabled {
+		blobs, size, err := blobUsage()
+		if err != nil {
+			log.Printf("Status: Failed to count blobs in %s: %v", *config.BlossomPath, err)
+			http.Error(w, "failed to count blobs", http.StatusInternalServerError)
+			return
+		}
+		status.Blobs, status.BlobBytes = blobs, size
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestAdminIndexListsRoutes(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	config = Config{AdminPubkeys: []string{pk}, AdminIndex: true}
+	adminRoutes = nil
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+	handleAdmin(mux, "/admin/example", []string{"POST"}, "example", func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/admin", nil), sk))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var routes []adminRoute
+	if err := json.NewDecoder(rec.Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]bool{}
+	for _, route := range routes {
+		paths[route.Path] = true
+	}
+	if !paths["/admin"] || !paths["/admin/example"] {
+		t.Fatalf("expected /admin and /admin/example in listing, got %v", routes)
+	}
+}
+
+func TestAdminRefreshReloadsMembership(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"names":{"alice":"` + pk + `","bob":"` + strings.Repeat("b", 64) + `"}}`))
+	}))
+	defer ts.Close()
+
+	fs = afero.NewMemMapFs()
+	membershipClient = ts.Client()
+	setTeamData(NostrData{})
+	config = Config{AdminPubkeys: []string{pk}, TeamDomain: strings.TrimPrefix(ts.URL, "https://"), MembershipCache: "nostr-cache.json"}
+	adminRoutes = nil
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("POST", "/admin/refresh", nil), sk))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var result struct {
+		Members int    `json:"members"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Members != 2 || result.Error != "" {
+		t.Fatalf("expected 2 members and no error, got %+v", result)
+	}
+}
+
+func TestAdminStatusReportsMembershipAndBlobs(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	newTestBlossom(t)
+	engine := "lmdb"
+	config.DBEngine = &engine
+	config.AdminPubkeys = []string{pk}
+	config.MembershipCache = "nostr-cache.json"
+	config.BlossomShardDepth = 1
+	adminRoutes = nil
+
+	// the team domain is down, so members come from the cache
+	afero.WriteFile(fs, config.MembershipCache, []byte(`{"names":{"alice":"`+pk+`"}}`), 0644)
+	setTeamData(NostrData{})
+	t.Cleanup(func() { setTeamData(NostrData{}); membershipFromCache.Store(false) })
+	loadCachedNostrData()
+
+	for i, content := range []string{"one", "three"} {
+		hash := strings.Repeat(string(rune('a'+i)), 64)
+		afero.WriteFile(fs, blobPath(hash), []byte(content), 0644)
+	}
+	afero.WriteFile(fs, partialUploadPath(strings.Repeat("c", 64)), []byte("partial"), 0644)
+
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/status", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/admin/status", nil), sk))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var status struct {
+		Members             int     `json:"members"`
+		LastRefresh         *string `json:"last_refresh"`
+		MembershipFromCache bool    `json:"membership_from_cache"`
+		DBEngine            string  `json:"db_engine"`
+		BlossomEnabled      bool    `json:"blossom_enabled"`
+		Blobs               int     `json:"blobs"`
+		BlobBytes           int64   `json:"blob_bytes"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Members != 1 || !status.MembershipFromCache || status.DBEngine != "lmdb" || !status.BlossomEnabled {
+		t.Fatalf("unexpected membership status %+v", status)
+	}
+	if status.Blobs != 2 || status.BlobBytes != 8 {
+		t.Fatalf("expected 2 blobs of 8 bytes, got %d blobs of %d bytes", status.Blobs, status.BlobBytes)
+	}
+}
+
+func TestPprofIsAdminOnlyAndOffByDefault(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	config = Config{AdminPubkeys: []string{pk}}
+	adminRoutes = nil
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/debug/pprof/goroutine", nil), sk))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected pprof to be off by default, got %d", rec.Code)
+	}
+
+	config.PprofEnabled = true
+	adminRoutes = nil
+	mux = http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without auth, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil), sk))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine profile") {
+		t.Fatalf("expected a goroutine profile, got %d: %.200s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStorageStatsBreaksDownBlobs(t *testing.T) {
+	newTestBlossom(t)
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	config.AdminPubkeys = []string{pk}
+	config.StorageStatsTop = 2
+	config.StorageStatsCache = time.Hour
+	storageStatsCache.stats = nil
+	t.Cleanup(func() { storageStatsCache.stats = nil })
+	adminRoutes = nil
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	for i, size := range []int{10, 2000, 3000, 2 << 20} {
+		hash := strings.Repeat(string(rune('a'+i)), 64)
+		if err := afero.WriteFile(fs, *config.BlossomPath+hash, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetches := 0
+	fetch := func() storageStats {
+		// each admin auth event is good for one request, and two made in the same second match
+		fetches++
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/stats/storage", nil), sk, nostr.Tag{"nonce", strconv.Itoa(fetches)}))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var stats storageStats
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := fetch()
+	if stats.Blobs != 4 || stats.Bytes != 10+2000+3000+2<<20 {
+		t.Fatalf("expected 4 blobs totalling %d bytes, got %+v", 10+2000+3000+2<<20, stats)
+	}
+	if len(stats.Largest) != 2 || stats.Largest[0].SHA256 != strings.Repeat("d", 64) || stats.Largest[1].Size != 3000 {
+		t.Fatalf("expected the two largest blobs, biggest first, got %+v", stats.Largest)
+	}
+	counts := []int{}
+	for _, bucket := range stats.Histogram {
+		counts = append(counts, bucket.Blobs)
+	}
+	if !slices.Equal(counts, []int{1, 2, 0, 1, 0, 0, 0}) || stats.Histogram[len(stats.Histogram)-1].MaxBytes != nil {
+		t.Fatalf("unexpected histogram %+v", stats.Histogram)
+	}
+
+	afero.WriteFile(fs, *config.BlossomPath+strings.Repeat("e", 64), []byte("new"), 0644)
+	if cached := fetch(); cached.Blobs != 4 {
+		t.Fatalf("expected the cached walk within STORAGE_STATS_CACHE, got %d blobs", cached.Blobs)
+	}
+	config.StorageStatsCache = 0
+	if fresh := fetch(); fresh.Blobs != 5 {
+		t.Fatalf("expected a new walk once the cache expired, got %d blobs", fresh.Blobs)
+	}
+}
+
+func TestAdminBlobsListsAndRemovesAMembersBlobs(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	config.AdminPubkeys = []string{pk}
+	adminRoutes = nil
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	leaving, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	staying, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	own, shared, other := strings.Repeat("aa", 32), strings.Repeat("bb", 32), strings.Repeat("cc", 32)
+	for _, blob := range []struct{ sha256, owner string }{{own, leaving}, {shared, leaving}, {shared, staying}, {other, staying}} {
+		if err := afero.WriteFile(fs, blobPath(blob.sha256), []byte("blob "+blob.sha256[:2]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bd := blossom.BlobDescriptor{SHA256: blob.sha256, Size: 7, Type: "text/plain", Uploaded: nostr.Now()}
+		if err := blobIndex.Keep(ctx, bd, blob.owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/admin/blobs?pubkey=nope", nil), sk))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid pubkey, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/admin/blobs?pubkey="+leaving, nil), sk))
+	var listed struct {
+		Count int                      `json:"count"`
+		Bytes int64                    `json:"bytes"`
+		Blobs []blossom.BlobDescriptor `json:"blobs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || listed.Count != 2 || listed.Bytes != 14 || len(listed.Blobs) != 2 {
+		t.Fatalf("expected the member's 2 blobs, got %d %+v", rec.Code, listed)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("DELETE", "/admin/blobs?pubkey="+leaving, nil), sk))
+	var removed struct {
+		Removed int `json:"removed"`
+		Deleted int `json:"deleted"`
+		Kept    int `json:"kept"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&removed); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || removed.Removed != 2 || removed.Deleted != 1 || removed.Kept != 1 {
+		t.Fatalf("expected 2 blobs removed, 1 deleted and the shared one kept, got %d %+v", rec.Code, removed)
+	}
+	if _, err := fs.Stat(blobPath(own)); err == nil {
+		t.Fatal("expected the member's own blob to be deleted from disk")
+	}
+	for _, sha256 := range []string{shared, other} {
+		if _, err := fs.Stat(blobPath(sha256)); err != nil {
+			t.Fatalf("expected %s to be kept for its other uploader: %v", sha256, err)
+		}
+	}
+	if blobIndex.Owns(shared, leaving) || !blobIndex.Owns(shared, staying) {
+		t.Fatal("expected only the departing member to be dropped from the shared blob")
+	}
+}
+
+func TestAdminAuthCannotBeReplayed(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	config = Config{AdminPubkeys: []string{pk}}
+	adminRoutes = nil
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+
+	captured := withHTTPAuth(t, httptest.NewRequest("GET", "/admin/status", nil), sk).Header.Get("Authorization")
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/admin/status", nil)
+		req.Header.Set("Authorization", captured)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Fatalf("request %d: expected %d, got %d: %s", i+1, want, rec.Code, rec.Body.String())
+		}
+	}
+
+	outsider := nostr.GeneratePrivateKey()
+	for range 2 {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("GET", "/admin/status", nil), outsider, nostr.Tag{"nonce", "1"}))
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("expected a non-admin to be refused as such, got %d", rec.Code)
+		}
+	}
+}
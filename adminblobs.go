@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// handleAdminBlobs serves /admin/blobs?pubkey=<hex>: GET lists the blobs the index has for
+// that uploader, with sizes and their own upload times, and DELETE removes every one of
+// them, e.g. when a member leaves. A blob someone else uploaded too only loses this
+// uploader, as with a delete by the owner.
+func handleAdminBlobs(w http.ResponseWriter, r *http.Request) {
+	pubkey := r.URL.Query().Get("pubkey")
+	if !nostr.IsValidPublicKey(pubkey) {
+		http.Error(w, "pubkey must be a hex public key", http.StatusBadRequest)
+		return
+	}
+	blobs, err := ownedBlobs(r, pubkey)
+	if err != nil {
+		log.Printf("Admin: Failed to list blobs for %s: %v", pubkey, err)
+		http.Error(w, "failed to list blobs", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleteOwnedBlobs(w, r, pubkey, blobs)
+		return
+	}
+
+	result := struct {
+		Pubkey string                   `json:"pubkey"`
+		Count  int                      `json:"count"`
+		Bytes  int64                    `json:"bytes"`
+		Blobs  []blossom.BlobDescriptor `json:"blobs"`
+	}{Pubkey: pubkey, Count: len(blobs), Blobs: blobs}
+	for _, blob := range blobs {
+		result.Bytes += int64(blob.Size)
+	}
+	log.Printf("Admin: %s listed %d blobs of %s", adminPubkey(r), len(blobs), pubkey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ownedBlobs collects the blobs pubkey has in the index, most recently uploaded first
+func ownedBlobs(r *http.Request, pubkey string) ([]blossom.BlobDescriptor, error) {
+	ch, err := blobIndex.List(r.Context(), pubkey)
+	if err != nil {
+		return nil, err
+	}
+	blobs := []blossom.BlobDescriptor{}
+	for bd := range ch {
+		blobs = append(blobs, bd)
+	}
+	return blobs, r.Context().Err()
+}
+
+// deleteOwnedBlobs drops pubkey from every one of blobs and deletes the files no one else
+// owns, reporting how many were dropped, deleted, kept for other owners and failed
+func deleteOwnedBlobs(w http.ResponseWriter, r *http.Request, pubkey string, blobs []blossom.BlobDescriptor) {
+	result := struct {
+		Pubkey  string `json:"pubkey"`
+		Removed int    `json:"removed"`
+		Deleted int    `json:"deleted"`
+		Kept    int    `json:"kept"`
+		Failed  int    `json:"failed"`
+		Bytes   int64  `json:"bytes_reclaimed"`
+	}{Pubkey: pubkey}
+	for _, blob := range blobs {
+		if err := blobIndex.Delete(r.Context(), blob.SHA256, pubkey); err != nil {
+			log.Printf("Admin: Failed to drop %s from %s's index: %v", blob.SHA256, pubkey, err)
+			result.Failed++
+			continue
+		}
+		result.Removed++
+		if blobIndex.RefCount(blob.SHA256) > 0 {
+			result.Kept++
+			continue
+		}
+		if err := deleteBlob(r.Context(), blob.SHA256); err != nil {
+			log.Printf("Admin: Failed to delete %s: %v", blob.SHA256, err)
+			result.Failed++
+			continue
+		}
+		result.Deleted++
+		result.Bytes += int64(blob.Size)
+	}
+	log.Printf("Admin: %s removed %d blobs of %s (%d deleted, %d kept for other uploaders, %d failed)",
+		adminPubkey(r), result.Removed, pubkey, result.Deleted, result.Kept, result.Failed)
+
+	status := http.StatusOK
+	if result.Failed > 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// bannedWords matches any term from the BANNED_WORDS file as a whole word, swapped whole on
+// reload; nil when no file is configured or it has no terms
+var bannedWords atomic.Pointer[regexp.Regexp]
+
+// parseBannedWords builds one case-insensitive pattern from a file with a word or phrase per
+// line; blank lines and lines starting with # are ignored. Terms only match between non-word
+// characters or the ends of the content, so "ass" doesn't catch "class". This is spelled out
+// rather than using \b, which only knows ASCII letters.
+func parseBannedWords(body []byte) (*regexp.Regexp, error) {
+	var terms []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		term := strings.TrimSpace(scanner.Text())
+		if term == "" || strings.HasPrefix(term, "#") {
+			continue
+		}
+		terms = append(terms, regexp.QuoteMeta(term))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(`(?i)(?:^|[^\pL\pN_])(?:` + strings.Join(terms, "|") + `)(?:$|[^\pL\pN_])`)
+}
+
+// loadBannedWords (re)reads the BANNED_WORDS file. A file that can't be read leaves the
+// previous terms in place.
+func loadBannedWords() error {
+	body, err := afero.ReadFile(fs, config.BannedWordsFile)
+	if err != nil {
+		return err
+	}
+	pattern, err := parseBannedWords(body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", config.BannedWordsFile, err)
+	}
+	bannedWords.Store(pattern)
+	log.Printf("Loaded banned words from %s", config.BannedWordsFile)
+	return nil
+}
+
+// rejectBannedWords refuses events of the BANNED_WORDS_KINDS whose content contains a banned
+// term. The message deliberately doesn't say which one.
+func rejectBannedWords(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	pattern := bannedWords.Load()
+	if pattern == nil || !slices.Contains(config.BannedWordsKinds, event.Kind) {
+		return false, ""
+	}
+	if pattern.MatchString(event.Content) {
+		return true, prefixBlocked + "content not allowed on this relay"
+	}
+	return false, ""
+}
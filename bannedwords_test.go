@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestBannedWords(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	config = Config{BannedWordsFile: "banned.txt", BannedWordsKinds: []int{nostr.KindTextNote}}
+	t.Cleanup(func() { bannedWords.Store(nil) })
+	ctx := context.Background()
+
+	afero.WriteFile(fs, config.BannedWordsFile, []byte("# spam\nass\ncheap followers\nc++\n"), 0644)
+	if err := loadBannedWords(); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, want := range map[string]bool{
+		"what an ASS":                       true,
+		"ass.":                              true,
+		"buy Cheap Followers today":         true,
+		"I write c++ all day":               true,
+		"first class passage in Scunthorpe": false,
+		"cheap followersx":                  false,
+		"straßenassel":                      false,
+	} {
+		evt := &nostr.Event{Kind: nostr.KindTextNote, Content: content}
+		if reject, _ := rejectBannedWords(ctx, evt); reject != want {
+			t.Errorf("%q: rejected = %v, want %v", content, reject, want)
+		}
+	}
+
+	if reject, _ := rejectBannedWords(ctx, &nostr.Event{Kind: nostr.KindProfileMetadata, Content: "ass"}); reject {
+		t.Error("banned words applied to a kind outside BANNED_WORDS_KINDS")
+	}
+
+	// reloading picks up edits
+	afero.WriteFile(fs, config.BannedWordsFile, []byte("spam\n"), 0644)
+	if err := loadBannedWords(); err != nil {
+		t.Fatal(err)
+	}
+	if reject, _ := rejectBannedWords(ctx, &nostr.Event{Kind: nostr.KindTextNote, Content: "ass"}); reject {
+		t.Error("a removed term is still banned after reload")
+	}
+}
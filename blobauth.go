@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The values BLOSSOM_UPLOAD_AUTH and BLOSSOM_DOWNLOAD_AUTH accept
+const (
+	blobAuthMember = "member"
+	blobAuthPublic = "public"
+)
+
+// defaultDownloadAuth keeps blob downloads as REQUIRE_AUTH_READ had them before
+// BLOSSOM_DOWNLOAD_AUTH existed: member-only with it on, public otherwise
+func defaultDownloadAuth() string {
+	if getEnvBool("REQUIRE_AUTH_READ") {
+		return blobAuthMember
+	}
+	return blobAuthPublic
+}
+
+// uploadsArePublic reports whether BLOSSOM_UPLOAD_AUTH lets any signed-in pubkey upload.
+// Anything but "public", the zero value included, keeps uploads to team members.
+func uploadsArePublic() bool {
+	return config.BlossomUploadAuth == blobAuthPublic
+}
+
+// requireUploadAuth authenticates an upload of hash, a mirror or a resumable upload, under
+// BLOSSOM_UPLOAD_AUTH: any valid upload authorization will do when uploads are public, and
+// only a team member's otherwise. On failure the error response has been written and ok is
+// false.
+func requireUploadAuth(w http.ResponseWriter, r *http.Request, hash string) (pubkey string, ok bool) {
+	if !uploadsArePublic() {
+		return requireTeamAuth(w, r, "upload", hash)
+	}
+	pubkey, code, err := requestAuthor(r, "upload", hash)
+	if err != nil {
+		writeAuthError(w, err.Error(), code)
+		return "", false
+	}
+	return pubkey, true
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// blobIndex is the live blob index, set up in main when blossom is enabled
+var blobIndex *localBlobIndex
+
+// The index lives next to the blobs: a snapshot, and a log of the changes made since it was
+// written. Neither name is a sha256, so walkBlobs never mistakes them for blobs.
+const (
+	blobIndexSnapshot = "index.json"
+	blobIndexLog      = "index.log"
+)
+
+// blobIndexCompactAfter is how many log entries accumulate before they are folded into a new
+// snapshot
+const blobIndexCompactAfter = 1000
+
+// blobEntry is what the index knows about one blob. Owners maps each uploader to when they
+// last uploaded it; the blob's reference count is the number of owners.
+type blobEntry struct {
+	Size    int                        `json:"size"`
+	Type    string                     `json:"type"`
+	Created nostr.Timestamp            `json:"created"`
+	Owners  map[string]nostr.Timestamp `json:"owners"`
+}
+
+// blobIndexChange is one line of the log
+type blobIndexChange struct {
+	Op       string          `json:"op"` // "keep" or "delete"
+	SHA256   string          `json:"sha256"`
+	Pubkey   string          `json:"pubkey"`
+	Size     int             `json:"size,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Uploaded nostr.Timestamp `json:"uploaded,omitempty"`
+}
+
+// localBlobIndex is the single record of which blobs are stored, their size and type, and
+// who uploaded them, independent of the event store. Every change is appended to the log
+// and synced before it takes effect in memory, so a crash loses at most the change that was
+// being written; on startup the snapshot is loaded and the log replayed over it. Replaying
+// is idempotent, so a crash while a new snapshot replaces the old one is harmless too.
+type localBlobIndex struct {
+	serviceURL string
+
+	mu      sync.Mutex
+	blobs   map[string]*blobEntry
+	log     afero.File
+	pending int
+}
+
+// newBlobIndex opens the index under BlossomPath. The first time, when there is neither a
+// snapshot nor a log, it is filled from the kind 24242 events khatru's event store index
+// used to keep, so existing blobs keep their owners and types.
+func newBlobIndex(ctx context.Context, serviceURL string) (*localBlobIndex, error) {
+	bi := &localBlobIndex{serviceURL: serviceURL, blobs: make(map[string]*blobEntry)}
+
+	snapshotPath, logPath := *config.BlossomPath+blobIndexSnapshot, *config.BlossomPath+blobIndexLog
+	snapshotExists, err := afero.Exists(fs, snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	logExists, err := afero.Exists(fs, logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshotExists {
+		raw, err := afero.ReadFile(fs, snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &bi.blobs); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", snapshotPath, err)
+		}
+	}
+	var complete int64
+	if logExists {
+		if complete, err = bi.replay(logPath); err != nil {
+			return nil, err
+		}
+	}
+
+	bi.log, err = fs.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := bi.log.Stat(); err == nil && info.Size() > complete {
+		// new entries must not be appended to the remains of a cut-off one
+		if err := bi.truncateLog(complete); err != nil {
+			return nil, err
+		}
+	}
+	if !snapshotExists && !logExists {
+		if err := bi.importEvents(ctx); err != nil {
+			return nil, fmt.Errorf("importing blob index events: %w", err)
+		}
+	}
+	log.Printf("Blob index: %d blobs referenced", len(bi.blobs))
+	return bi, nil
+}
+
+// replay applies every complete line of the log and returns how many bytes they take up. A
+// line cut short by a crash can only be the last one, and is dropped. One that doesn't parse
+// anywhere else is logged and skipped rather than keeping the relay from starting.
+func (bi *localBlobIndex) replay(logPath string) (complete int64, err error) {
+	file, err := fs.Open(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Blob index: dropping an incomplete last entry in %s", logPath)
+			}
+			return complete, nil
+		}
+		if err != nil {
+			return complete, err
+		}
+		complete += int64(len(line))
+		var change blobIndexChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			log.Printf("Blob index: skipping an unreadable entry in %s: %v", logPath, err)
+			continue
+		}
+		bi.apply(change)
+		bi.pending++
+	}
+}
+
+// importEvents records the owners found in the event store's kind 24242 index events
+func (bi *localBlobIndex) importEvents(ctx context.Context) error {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}})
+	if err != nil {
+		return err
+	}
+	var changes []blobIndexChange
+	for evt := range ch {
+		x := evt.Tags.GetFirst([]string{"x", ""})
+		if x == nil {
+			continue
+		}
+		change := blobIndexChange{Op: "keep", SHA256: (*x)[1], Pubkey: evt.PubKey, Uploaded: evt.CreatedAt}
+		if tag := evt.Tags.GetFirst([]string{"type", ""}); tag != nil {
+			change.Type = (*tag)[1]
+		}
+		if tag := evt.Tags.GetFirst([]string{"size", ""}); tag != nil {
+			change.Size, _ = strconv.Atoi((*tag)[1])
+		}
+		changes = append(changes, change)
+	}
+
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	for _, change := range changes {
+		bi.apply(change)
+	}
+	if len(changes) > 0 {
+		log.Printf("Blob index: imported %d owner entries from the event store", len(changes))
+	}
+	return bi.compact()
+}
+
+// apply makes a change to the in-memory index. Keeping a blob again just moves its owner's
+// upload time, and deleting what isn't there does nothing, so changes can be replayed.
+func (bi *localBlobIndex) apply(change blobIndexChange) {
+	entry := bi.blobs[change.SHA256]
+	switch change.Op {
+	case "keep":
+		if entry == nil {
+			entry = &blobEntry{Created: change.Uploaded, Owners: make(map[string]nostr.Timestamp)}
+			bi.blobs[change.SHA256] = entry
+		}
+		if change.Size > 0 {
+			entry.Size = change.Size
+		}
+		if change.Type != "" {
+			entry.Type = change.Type
+		}
+		if change.Uploaded < entry.Created {
+			entry.Created = change.Uploaded
+		}
+		entry.Owners[change.Pubkey] = change.Uploaded
+	case "delete":
+		if entry == nil {
+			return
+		}
+		delete(entry.Owners, change.Pubkey)
+		if len(entry.Owners) == 0 {
+			delete(bi.blobs, change.SHA256)
+		}
+	}
+}
+
+// record appends change to the log, syncs it, and only then applies it. A write or sync that
+// fails is cut off again, so the next change isn't appended to whatever part of it was
+// written.
+func (bi *localBlobIndex) record(change blobIndexChange) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	offset, err := bi.log.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = bi.log.Write(append(line, '\n'))
+	if err == nil {
+		err = bi.log.Sync()
+	}
+	if err != nil {
+		if truncErr := bi.truncateLog(offset); truncErr != nil {
+			log.Printf("Blob index: Failed to cut off a failed write to the log: %v", truncErr)
+		}
+		return err
+	}
+	bi.apply(change)
+
+	bi.pending++
+	if bi.pending >= blobIndexCompactAfter {
+		if err := bi.compact(); err != nil {
+			log.Printf("Blob index: Failed to write a new snapshot, keeping the log: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact writes the whole index to a new snapshot, moves it into place and empties the log.
+// A crash before the rename leaves the old snapshot and the full log; one after it, the new
+// snapshot and a log that replays to the same state.
+func (bi *localBlobIndex) compact() error {
+	raw, err := json.Marshal(bi.blobs)
+	if err != nil {
+		return err
+	}
+	file, err := afero.TempFile(fs, *config.BlossomPath, blobIndexSnapshot+".*"+tempBlobSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		fs.Remove(file.Name())
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fs.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		fs.Remove(file.Name())
+		return err
+	}
+	if err := fs.Rename(file.Name(), *config.BlossomPath+blobIndexSnapshot); err != nil {
+		fs.Remove(file.Name())
+		return err
+	}
+	if err := bi.truncateLog(0); err != nil {
+		return err
+	}
+	bi.pending = 0
+	return nil
+}
+
+// truncateLog cuts the log to size and moves the write offset there too, for filesystems
+// that write at the offset even in append mode
+func (bi *localBlobIndex) truncateLog(size int64) error {
+	if err := bi.log.Truncate(size); err != nil {
+		return err
+	}
+	_, err := bi.log.Seek(size, io.SeekStart)
+	return err
+}
+
+// uploadKeepKey carries an *uploadKeep in a PUT /upload request's context
+type uploadKeepKey struct{}
+
+// uploadKeep remembers the owner entry Keep added for an upload. khatru calls Keep before
+// StoreBlob, so when storing the blob fails storeBlob has to take the entry back, or /list
+// would show a blob that isn't there and RefCount count a reference to it.
+type uploadKeep struct {
+	sha256 string
+	pubkey string
+	added  bool
+}
+
+// withUploadKeep gives an upload's context somewhere for Keep to note what it added
+func withUploadKeep(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uploadKeepKey{}, &uploadKeep{})
+}
+
+// forgetFailedUpload drops the owner entry Keep added for an upload of sha256 that couldn't
+// be stored. An owner who already had the blob keeps it.
+func (bi *localBlobIndex) forgetFailedUpload(ctx context.Context, sha256 string) {
+	keep, _ := ctx.Value(uploadKeepKey{}).(*uploadKeep)
+	if keep == nil || !keep.added || keep.sha256 != sha256 {
+		return
+	}
+	if err := bi.Delete(ctx, sha256, keep.pubkey); err != nil {
+		log.Printf("Blob index: Failed to drop the entry for %s after storing it failed: %v", sha256, err)
+	}
+}
+
+// Keep records pubkey as an owner of the blob, along with its size and type
+func (bi *localBlobIndex) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if keep, _ := ctx.Value(uploadKeepKey{}).(*uploadKeep); keep != nil {
+		*keep = uploadKeep{sha256: blob.SHA256, pubkey: pubkey, added: !bi.owns(blob.SHA256, pubkey)}
+	}
+	return bi.record(blobIndexChange{Op: "keep", SHA256: blob.SHA256, Pubkey: pubkey, Size: blob.Size, Type: blob.Type, Uploaded: blob.Uploaded})
+}
+
+// Delete drops pubkey's ownership of the blob, and the blob's entry with its last owner
+func (bi *localBlobIndex) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if !bi.owns(sha256, pubkey) {
+		return nil
+	}
+	return bi.record(blobIndexChange{Op: "delete", SHA256: sha256, Pubkey: pubkey})
+}
+
+// Get returns the blob's descriptor, or nil when no one owns it
+func (bi *localBlobIndex) Get(ctx context.Context, sha256 string) (*blossom.BlobDescriptor, error) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	entry := bi.blobs[sha256]
+	if entry == nil {
+		return nil, nil
+	}
+	descriptor := bi.descriptor(sha256, entry)
+	return &descriptor, nil
+}
+
+// List returns the blobs pubkey owns, most recently uploaded first, each with pubkey's own
+// upload time
+func (bi *localBlobIndex) List(ctx context.Context, pubkey string) (chan blossom.BlobDescriptor, error) {
+	bi.mu.Lock()
+	var blobs []blossom.BlobDescriptor
+	for sha256, entry := range bi.blobs {
+		if uploaded, ok := entry.Owners[pubkey]; ok {
+			descriptor := bi.descriptor(sha256, entry)
+			descriptor.Owner, descriptor.Uploaded = pubkey, uploaded
+			blobs = append(blobs, descriptor)
+		}
+	}
+	bi.mu.Unlock()
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Uploaded > blobs[j].Uploaded })
+
+	ch := make(chan blossom.BlobDescriptor)
+	go func() {
+		defer close(ch)
+		for _, descriptor := range blobs {
+			select {
+			case ch <- descriptor:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// descriptor builds the descriptor for an entry; Uploaded is the most recent upload by anyone
+func (bi *localBlobIndex) descriptor(sha256 string, entry *blobEntry) blossom.BlobDescriptor {
+	descriptor := blossom.BlobDescriptor{
+		URL:    joinURL(bi.serviceURL, sha256+blobExtension(entry.Type)),
+		SHA256: sha256,
+		Size:   entry.Size,
+		Type:   entry.Type,
+	}
+	for _, uploaded := range entry.Owners {
+		descriptor.Uploaded = max(descriptor.Uploaded, uploaded)
+	}
+	return descriptor
+}
+
+// Owners lists who owns the blob and when it was last uploaded
+func (bi *localBlobIndex) Owners(sha256 string) (owners []string, uploaded nostr.Timestamp) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if entry := bi.blobs[sha256]; entry != nil {
+		for owner, at := range entry.Owners {
+			owners = append(owners, owner)
+			uploaded = max(uploaded, at)
+		}
+	}
+	return owners, uploaded
+}
+
+// Owns reports whether pubkey is one of the blob's owners
+func (bi *localBlobIndex) Owns(sha256 string, pubkey string) bool {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.owns(sha256, pubkey)
+}
+
+func (bi *localBlobIndex) owns(sha256 string, pubkey string) bool {
+	entry := bi.blobs[sha256]
+	if entry == nil {
+		return false
+	}
+	_, ok := entry.Owners[pubkey]
+	return ok
+}
+
+// Count reports how many distinct blobs have at least one owner. It is kept in memory, so it
+// costs nothing to ask.
+func (bi *localBlobIndex) Count() int {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return len(bi.blobs)
+}
+
+// RefCount reports how many owners still reference the blob
+func (bi *localBlobIndex) RefCount(sha256 string) int {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	if entry := bi.blobs[sha256]; entry != nil {
+		return len(entry.Owners)
+	}
+	return 0
+}
+
+// Close closes the log
+func (bi *localBlobIndex) Close() error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.log.Close()
+}
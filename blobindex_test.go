@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestSharedBlobSurvivesOneOwnerDeleting(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	hash := strings.Repeat("cd", 32)
+	alice, bob := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	alicePub, _ := nostr.GetPublicKey(alice)
+	bobPub, _ := nostr.GetPublicKey(bob)
+
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+
+	bd := blossom.BlobDescriptor{SHA256: hash, Type: "text/plain", Size: 5, Uploaded: nostr.Now()}
+	for _, pubkey := range []string{alicePub, bobPub, bobPub} {
+		if err := blobIndex.Keep(ctx, bd, pubkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if refs := blobIndex.RefCount(hash); refs != 2 {
+		t.Fatalf("expected 2 references, got %d", refs)
+	}
+
+	// counts are rebuilt from the index on startup
+	rebuilt, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := rebuilt.RefCount(hash); refs != 2 {
+		t.Fatalf("expected 2 references after rebuild, got %d", refs)
+	}
+
+	if err := blobIndex.Delete(ctx, hash, alicePub); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteBlob(ctx, hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(*config.BlossomPath + hash); err != nil {
+		t.Fatalf("blob removed while bob still references it: %v", err)
+	}
+
+	if err := blobIndex.Delete(ctx, hash, bobPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteBlob(ctx, hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(*config.BlossomPath + hash); err == nil {
+		t.Fatal("expected blob to be removed after the last owner deleted it")
+	}
+}
+
+func TestUploadsRefusedAtMaxBlobCount(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	config.MaxBlobCount = 2
+	pub, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	first, second := strings.Repeat("01", 32), strings.Repeat("02", 32)
+
+	// one blob is indexed before startup, so the count starts from the index
+	bd := blossom.BlobDescriptor{SHA256: first, Type: "text/plain", Size: 5, Uploaded: nostr.Now()}
+	if err := (&blossom.EventStoreBlobIndexWrapper{Store: db}).Keep(ctx, bd, pub); err != nil {
+		t.Fatal(err)
+	}
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+
+	if reject, msg, _ := rejectUploadBlobCount(ctx, nil, 5, "txt"); reject {
+		t.Fatalf("expected an upload under the limit to be accepted, got %q", msg)
+	}
+	bd.SHA256 = second
+	if err := blobIndex.Keep(ctx, bd, pub); err != nil {
+		t.Fatal(err)
+	}
+	reject, msg, code := rejectUploadBlobCount(ctx, nil, 5, "txt")
+	if !reject || code != 507 || !strings.Contains(msg, "blob count limit reached (2)") {
+		t.Fatalf("expected a 507 once 2 blobs are stored, got %v %d %q", reject, code, msg)
+	}
+
+	if err := blobIndex.Delete(ctx, second, pub); err != nil {
+		t.Fatal(err)
+	}
+	if reject, msg, _ := rejectUploadBlobCount(ctx, nil, 5, "txt"); reject {
+		t.Fatalf("expected uploads to be accepted again after a delete, got %q", msg)
+	}
+}
+
+func TestBlobIndexSurvivesRestartsAndTornWrites(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	pub, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := []string{strings.Repeat("1a", 32), strings.Repeat("2b", 32), strings.Repeat("3c", 32)}
+	for i, hash := range hashes {
+		bd := blossom.BlobDescriptor{SHA256: hash, Type: "image/png", Size: 10 + i, Uploaded: nostr.Timestamp(1000 + i)}
+		if err := index.Keep(ctx, bd, pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Delete(ctx, hashes[1], pub); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+
+	// a crash in the middle of writing the next entry
+	logFile, _ := fs.OpenFile(*config.BlossomPath+blobIndexLog, os.O_WRONLY|os.O_APPEND, 0644)
+	logFile.Write([]byte(`{"op":"keep","sha256":"4d`))
+	logFile.Close()
+
+	reopened, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Count() != 2 || reopened.RefCount(hashes[1]) != 0 {
+		t.Fatalf("expected the two kept blobs back, got %d", reopened.Count())
+	}
+	bd, err := reopened.Get(ctx, hashes[2])
+	if err != nil || bd == nil || bd.Size != 12 || bd.Type != "image/png" || bd.URL != *config.BlossomURL+"/"+hashes[2]+".png" {
+		t.Fatalf("expected the stored metadata back, got %+v (%v)", bd, err)
+	}
+
+	// compaction folds the log into the snapshot without changing what the index holds
+	for i := 0; i < blobIndexCompactAfter; i++ {
+		bd := blossom.BlobDescriptor{SHA256: hashes[0], Type: "image/png", Size: 10, Uploaded: nostr.Timestamp(2000 + i)}
+		if err := reopened.Keep(ctx, bd, pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := fs.Stat(*config.BlossomPath + blobIndexLog); err != nil || info.Size() > 1000 {
+		t.Fatalf("expected the log to have been compacted, got %v (%v)", info, err)
+	}
+	reopened.Close()
+
+	again, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := again.List(ctx, pub)
+	var listed []blossom.BlobDescriptor
+	for bd := range ch {
+		listed = append(listed, bd)
+	}
+	if len(listed) != 2 || listed[0].SHA256 != hashes[0] || listed[0].Uploaded != nostr.Timestamp(2000+blobIndexCompactAfter-1) {
+		t.Fatalf("expected both blobs listed, the re-uploaded one first, got %+v", listed)
+	}
+}
+
+func TestFailedUploadIsDroppedFromIndex(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+	alice, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bob, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	hash := strings.Repeat("5e", 32)
+	bd := blossom.BlobDescriptor{SHA256: hash, Type: "text/plain", Size: 5, Uploaded: nostr.Now()}
+
+	// khatru keeps the blob, then StoreBlob finds the body doesn't hash to it
+	upload := func(pubkey string) error {
+		ctx := withUploadKeep(ctx)
+		if err := blobIndex.Keep(ctx, bd, pubkey); err != nil {
+			t.Fatal(err)
+		}
+		return storeBlob(ctx, hash, []byte("hello"))
+	}
+	if err := upload(alice); !errors.Is(err, errHashMismatch) {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+	if refs := blobIndex.RefCount(hash); refs != 0 {
+		t.Fatalf("expected the failed upload not to be indexed, got %d references", refs)
+	}
+
+	// an owner who already had the blob keeps it
+	if err := blobIndex.Keep(ctx, bd, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload(bob); err == nil {
+		t.Fatal("expected the second upload to fail too")
+	}
+	if !blobIndex.Owns(hash, bob) {
+		t.Fatal("expected a failed re-upload to leave the existing owner alone")
+	}
+}
+
+// shortWriteFile writes half of what it is given, then fails
+type shortWriteFile struct {
+	afero.File
+}
+
+func (f shortWriteFile) Write(p []byte) (int, error) {
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+func TestBlobIndexRecoversFromFailedWrites(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	pub, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := func(hash string) error {
+		return index.Keep(ctx, blossom.BlobDescriptor{SHA256: hash, Type: "text/plain", Size: 5, Uploaded: nostr.Now()}, pub)
+	}
+
+	first, failed, last := strings.Repeat("6f", 32), strings.Repeat("7a", 32), strings.Repeat("8b", 32)
+	if err := keep(first); err != nil {
+		t.Fatal(err)
+	}
+	good := index.log
+	index.log = shortWriteFile{good}
+	if err := keep(failed); err == nil {
+		t.Fatal("expected the failed write to be reported")
+	}
+	index.log = good
+	if err := keep(last); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+
+	// an unreadable entry in the middle of the log, as left by something other than record
+	raw, _ := afero.ReadFile(fs, *config.BlossomPath+blobIndexLog)
+	lines := strings.SplitAfter(string(raw), "\n")
+	afero.WriteFile(fs, *config.BlossomPath+blobIndexLog, []byte(lines[0]+"{not json\n"+strings.Join(lines[1:], "")), 0644)
+
+	reopened, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatalf("expected the index to open despite the bad entry, got %v", err)
+	}
+	defer reopened.Close()
+	if !reopened.Owns(first, pub) || !reopened.Owns(last, pub) || reopened.Owns(failed, pub) {
+		t.Fatalf("expected the two recorded blobs and not the failed one, got %d blobs", reopened.Count())
+	}
+}
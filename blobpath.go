@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// blobPath is where the blob with sha256 is stored. With BLOSSOM_SHARD_DEPTH set the file sits
+// under that many levels of two-hex-character directories, e.g. ab/cd/abcd... for depth 2, so
+// no single directory ends up holding every blob.
+func blobPath(sha256 string) string {
+	var path strings.Builder
+	path.WriteString(*config.BlossomPath)
+	for level := 0; level < config.BlossomShardDepth && 2*level+2 <= len(sha256); level++ {
+		path.WriteString(sha256[2*level : 2*level+2])
+		path.WriteString("/")
+	}
+	path.WriteString(sha256)
+	return path.String()
+}
+
+// runMigrateBlobs moves every stored blob to where blobPath expects it under the current
+// BLOSSOM_SHARD_DEPTH: swarm migrate-blobs. It works from any previous depth, including the
+// original flat layout, and can be re-run safely.
+func runMigrateBlobs() {
+	if !config.BlossomEnabled {
+		log.Fatalf("migrate-blobs: blossom is not enabled")
+	}
+	moved, err := migrateBlobLayout()
+	if err != nil {
+		log.Fatalf("migrate-blobs: %v (moved %d blobs before failing)", err, moved)
+	}
+	log.Printf("migrate-blobs: moved %d blobs to shard depth %d", moved, config.BlossomShardDepth)
+}
+
+// migrateBlobLayout renames blobs found anywhere under BlossomPath to their blobPath, skipping
+// partial uploads and temp files. Directories emptied along the way are left in place.
+func migrateBlobLayout() (int, error) {
+	var misplaced []string
+	err := walkBlobs(func(path string, info os.FileInfo) {
+		if filepath.Clean(path) != filepath.Clean(blobPath(info.Name())) {
+			misplaced = append(misplaced, path)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, path := range misplaced {
+		target := blobPath(filepath.Base(path))
+		if err := fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return moved, err
+		}
+		if err := fs.Rename(path, target); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// walkBlobs calls fn for every stored blob file under BlossomPath, whatever shard directory it
+// is in. Partial uploads, cached /media transforms, temp files and anything not named by a
+// sha256 are skipped.
+func walkBlobs(fn func(path string, info os.FileInfo)) error {
+	partialDir := filepath.Clean(*config.BlossomPath + partialUploadDir)
+	derivedDir := filepath.Clean(*config.BlossomPath + derivedBlobDir)
+	return afero.Walk(fs, *config.BlossomPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if clean := filepath.Clean(path); clean == partialDir || clean == derivedDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isValidSha256(info.Name()) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// blobUsage counts the stored blobs and their total size
+func blobUsage() (blobs int, size int64, err error) {
+	err = walkBlobs(func(path string, info os.FileInfo) {
+		blobs++
+		size += info.Size()
+	})
+	return blobs, size, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestBlobPathSharding(t *testing.T) {
+	path := "blossom/"
+	config = Config{BlossomPath: &path}
+	hash := "abcdef" + strings.Repeat("0", 58)
+
+	if got := blobPath(hash); got != "blossom/"+hash {
+		t.Fatalf("expected the flat layout by default, got %s", got)
+	}
+	config.BlossomShardDepth = 2
+	if got := blobPath(hash); got != "blossom/ab/cd/"+hash {
+		t.Fatalf("expected two shard levels, got %s", got)
+	}
+}
+
+func TestShardedBlobsStoreAndLoad(t *testing.T) {
+	newTestBlossom(t)
+	config.BlossomShardDepth = 2
+	content := []byte("sharded")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	if _, err := verifyAndStore(context.Background(), hash, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+hash[:2]+"/"+hash[2:4]+"/"+hash); !exists {
+		t.Fatal("expected the blob under its shard directories")
+	}
+	reader, err := loadBlob(context.Background(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(reader); !bytes.Equal(got, content) {
+		t.Fatalf("expected to load the sharded blob, got %q", got)
+	}
+	if err := deleteBlob(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(fs, blobPath(hash)); exists {
+		t.Fatal("expected the sharded blob to be deleted")
+	}
+}
+
+func TestMigrateBlobLayoutMovesFlatBlobs(t *testing.T) {
+	newTestBlossom(t)
+	flat, partial := strings.Repeat("12", 32), strings.Repeat("34", 32)
+	afero.WriteFile(fs, *config.BlossomPath+flat, []byte("flat"), 0644)
+	afero.WriteFile(fs, *config.BlossomPath+partialUploadDir+partial, []byte("partial"), 0644)
+	afero.WriteFile(fs, *config.BlossomPath+"notes.txt", []byte("not a blob"), 0644)
+
+	config.BlossomShardDepth = 1
+	moved, err := migrateBlobLayout()
+	if err != nil || moved != 1 {
+		t.Fatalf("expected one blob to be moved, got %d (%v)", moved, err)
+	}
+	if got, _ := afero.ReadFile(fs, *config.BlossomPath+"12/"+flat); string(got) != "flat" {
+		t.Fatalf("expected the blob at its sharded path, got %q", got)
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+partialUploadDir+partial); !exists {
+		t.Fatal("expected partial uploads to be left alone")
+	}
+
+	// back to the flat layout
+	config.BlossomShardDepth = 0
+	if moved, err := migrateBlobLayout(); err != nil || moved != 1 {
+		t.Fatalf("expected the blob to move back, got %d (%v)", moved, err)
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+flat); !exists {
+		t.Fatal("expected the blob back in the flat layout")
+	}
+}
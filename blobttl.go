@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sweepExpiredBlobsEvery deletes blobs older than ttl on a fixed interval
+func sweepExpiredBlobsEvery(interval time.Duration, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepExpiredBlobs(context.Background(), ttl)
+	}
+}
+
+type storedBlob struct {
+	sha256  string
+	size    int64
+	modTime time.Time
+}
+
+// sweepExpiredBlobs deletes every blob last uploaded more than ttl ago, along with its index
+// entries, so uploading a blob again restarts its clock. The upload time comes from the index;
+// blobs that were never indexed go by their file's modification time. With
+// BLOSSOM_TTL_KEEP_REFERENCED on, blobs still referenced by an unexpired event are kept. It
+// returns how many blobs were deleted and the bytes reclaimed.
+func sweepExpiredBlobs(ctx context.Context, ttl time.Duration) (deleted int, reclaimed int64) {
+	// collect first, so nothing is removed from under the walk
+	var blobs []storedBlob
+	if err := walkBlobs(func(path string, info os.FileInfo) {
+		blobs = append(blobs, storedBlob{sha256: info.Name(), size: info.Size(), modTime: info.ModTime()})
+	}); err != nil {
+		log.Printf("Blob TTL sweep: Failed to walk %s: %v", *config.BlossomPath, err)
+		return 0, 0
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	for _, blob := range blobs {
+		// when it was last uploaded, or written for blobs the index doesn't know
+		owners, at := blobIndex.Owners(blob.sha256)
+		uploaded := at.Time()
+		if len(owners) == 0 {
+			uploaded = blob.modTime
+		}
+		if uploaded.After(cutoff) {
+			continue
+		}
+		if config.BlossomTTLKeepRefs {
+			referenced, err := blobReferenced(ctx, blob.sha256)
+			if err != nil {
+				log.Printf("Blob TTL sweep: Failed to check references to %s: %v", blob.sha256, err)
+				continue
+			}
+			if referenced {
+				continue
+			}
+		}
+
+		for _, owner := range owners {
+			if err := blobIndex.Delete(ctx, blob.sha256, owner); err != nil {
+				log.Printf("Blob TTL sweep: Failed to drop %s from %s's index: %v", blob.sha256, owner, err)
+			}
+		}
+		if err := deleteBlob(ctx, blob.sha256); err != nil {
+			log.Printf("Blob TTL sweep: Failed to delete %s: %v", blob.sha256, err)
+			continue
+		}
+		deleted++
+		reclaimed += blob.size
+	}
+	if deleted > 0 {
+		log.Printf("Blob TTL sweep: deleted %d blobs older than %s, reclaiming %d bytes", deleted, ttl, reclaimed)
+	}
+	return deleted, reclaimed
+}
+
+// blobReferenced reports whether an unexpired event, such as NIP-94 file metadata, names the
+// blob in an x tag
+func blobReferenced(ctx context.Context, sha256 string) (bool, error) {
+	ch, err := queryUnexpired(ctx, nostr.Filter{Tags: nostr.TagMap{"x": []string{sha256}}})
+	if err != nil {
+		return false, err
+	}
+	referenced := false
+	for evt := range ch {
+		if evt.Kind != 24242 {
+			referenced = true
+		}
+	}
+	return referenced, nil
+}
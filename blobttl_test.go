@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestSweepExpiredBlobs(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+
+	sk := nostr.GeneratePrivateKey()
+	owner, _ := nostr.GetPublicKey(sk)
+	old := nostr.Timestamp(time.Now().Add(-48 * time.Hour).Unix())
+	expired, fresh, referenced, unindexed := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64), strings.Repeat("d", 64)
+	for hash, uploaded := range map[string]nostr.Timestamp{expired: old, fresh: nostr.Now(), referenced: old} {
+		if err := blobIndex.Keep(ctx, blossom.BlobDescriptor{SHA256: hash, Type: "image/png", Size: 5, Uploaded: uploaded}, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hash := range []string{expired, fresh, referenced, unindexed} {
+		if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte("bytes"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Chtimes(*config.BlossomPath+unindexed, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+
+	metadata := signedEvent(t, sk, 1063, "a file")
+	metadata.Tags = nostr.Tags{{"x", referenced}}
+	metadata.Sign(sk)
+	if err := db.SaveEvent(ctx, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	config.BlossomTTLKeepRefs = true
+	deleted, reclaimed := sweepExpiredBlobs(ctx, 24*time.Hour)
+	if deleted != 2 || reclaimed != 10 {
+		t.Fatalf("expected the old indexed and old unindexed blobs deleted (10 bytes), got %d blobs, %d bytes", deleted, reclaimed)
+	}
+	for hash, want := range map[string]bool{expired: false, unindexed: false, fresh: true, referenced: true} {
+		if exists, _ := afero.Exists(fs, blobPath(hash)); exists != want {
+			t.Fatalf("blob %s: expected exists=%v", hash[:4], want)
+		}
+	}
+	if owners, _ := blobIndex.Owners(expired); len(owners) != 0 || blobIndex.RefCount(expired) != 0 {
+		t.Fatalf("expected the expired blob's index entries to be dropped, got %v", owners)
+	}
+
+	config.BlossomTTLKeepRefs = false
+	if deleted, _ := sweepExpiredBlobs(ctx, 24*time.Hour); deleted != 1 {
+		t.Fatalf("expected the referenced blob to go once references aren't exempt, got %d", deleted)
+	}
+}
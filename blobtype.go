@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/liamg/magic"
+)
+
+// blobTypeExtensions picks the usual extension where mime lists several, e.g. ".jpg" rather
+// than ".jfif", matching what khatru puts in upload URLs
+var blobTypeExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"video/mp4":  ".mp4",
+	"text/plain": ".txt",
+}
+
+// detectBlobType works out a blob's content type and extension from its first bytes. Magic
+// numbers win, as they do for khatru's own uploads; otherwise the type the client declared is
+// trusted, and only without one do we fall back to http.DetectContentType.
+func detectBlobType(head []byte, declared string) (contentType string, ext string) {
+	if ft, _ := magic.Lookup(head); ft != nil && ft.Extension != "" {
+		ext = "." + ft.Extension
+		contentType = ft.MIME
+		if contentType == "" {
+			contentType = mime.TypeByExtension(ext)
+		}
+		return contentType, ext
+	}
+
+	if declared == "" || declared == "application/octet-stream" {
+		declared = http.DetectContentType(head)
+	}
+	return declared, blobExtension(declared)
+}
+
+// detectStoredBlobType reads the start of a stored blob to detect its type
+func detectStoredBlobType(sha256 string, declared string) (contentType string, ext string, err error) {
+	file, err := openBlob(sha256)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	contentType, ext = detectBlobType(head[:n], declared)
+	return contentType, ext, nil
+}
+
+// blobExtension is the extension, with its dot, for contentType, or "" if it has none
+func blobExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := blobTypeExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDetectBlobType(t *testing.T) {
+	for _, tc := range []struct {
+		head     []byte
+		declared string
+		wantType string
+		wantExt  string
+	}{
+		// magic numbers beat a wrong declared type
+		{pngHeader, "image/jpeg", "image/png", ".png"},
+		{[]byte("plain words"), "image/jpeg", "image/jpeg", ".jpg"},
+		{[]byte("plain words"), "", "text/plain; charset=utf-8", ".txt"},
+		{[]byte("plain words"), "application/octet-stream", "text/plain; charset=utf-8", ".txt"},
+	} {
+		gotType, gotExt := detectBlobType(tc.head, tc.declared)
+		if gotType != tc.wantType || gotExt != tc.wantExt {
+			t.Errorf("detectBlobType(%q, %q) = %q, %q; want %q, %q", tc.head, tc.declared, gotType, gotExt, tc.wantType, tc.wantExt)
+		}
+	}
+}
+
+func TestGetBlobServesDetectedTypeWhateverTheExtension(t *testing.T) {
+	bl := newTestBlossom(t)
+	content := append(pngHeader, "rest of the image"...)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	if _, err := verifyAndStore(context.Background(), hash, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := indexMirroredBlob(context.Background(), bl, hash, int64(len(content)), "application/octet-stream", nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.Type != "image/png" || descriptor.URL != bl.ServiceURL+"/"+hash+".png" {
+		t.Fatalf("expected a png descriptor, got %+v", descriptor)
+	}
+
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+	for _, path := range []string{"/" + hash, "/" + hash + ".png", "/" + hash + ".jpg"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("GET %s: expected image/png, got %d %q", path, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// eventBlocklist is what BLOCKLIST_FILE holds: one entry per line, either a hex event id or
+// "regex:" followed by a pattern matched against event content. Blank lines and lines
+// starting with # are ignored.
+type eventBlocklist struct {
+	ids      map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// blocklist is the loaded BLOCKLIST_FILE, swapped whole on reload; nil when none is configured
+var blocklist atomic.Pointer[eventBlocklist]
+
+func parseBlocklist(body []byte) (*eventBlocklist, error) {
+	bl := &eventBlocklist{ids: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		switch {
+		case entry == "" || strings.HasPrefix(entry, "#"):
+		case strings.HasPrefix(entry, "regex:"):
+			pattern, err := regexp.Compile(strings.TrimPrefix(entry, "regex:"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			bl.patterns = append(bl.patterns, pattern)
+		case isValidSha256(entry):
+			bl.ids[strings.ToLower(entry)] = true
+		default:
+			return nil, fmt.Errorf("line %d: %q is neither an event id nor a regex: entry", line, entry)
+		}
+	}
+	return bl, scanner.Err()
+}
+
+// loadBlocklist (re)reads BLOCKLIST_FILE. A file that fails to parse leaves the previous
+// blocklist in place.
+func loadBlocklist() error {
+	body, err := afero.ReadFile(fs, config.BlocklistFile)
+	if err != nil {
+		return err
+	}
+	bl, err := parseBlocklist(body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", config.BlocklistFile, err)
+	}
+	blocklist.Store(bl)
+	log.Printf("Loaded blocklist %s: %d event ids, %d content patterns", config.BlocklistFile, len(bl.ids), len(bl.patterns))
+	return nil
+}
+
+// reloadOnHangup calls load whenever the process receives SIGHUP. what names the file being
+// reloaded in the log when load fails.
+func reloadOnHangup(what string, load func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := load(); err != nil {
+			log.Printf("Error reloading %s, keeping the previous one: %v", what, err)
+		}
+	}
+}
+
+func (bl *eventBlocklist) blocks(evt *nostr.Event) bool {
+	if bl.ids[evt.ID] {
+		return true
+	}
+	for _, pattern := range bl.patterns {
+		if pattern.MatchString(evt.Content) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBlocklisted refuses events listed in, or with content matched by, BLOCKLIST_FILE
+func rejectBlocklisted(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if bl := blocklist.Load(); bl != nil && bl.blocks(event) {
+		return true, prefixBlocked + "this event is not allowed on this relay"
+	}
+	return false, ""
+}
+
+// runPurgeBlocked deletes already stored events that the blocklist matches: swarm purge-blocked
+func runPurgeBlocked() {
+	if blocklist.Load() == nil {
+		log.Fatalf("purge-blocked: BLOCKLIST_FILE is not set")
+	}
+	deleted, err := purgeBlockedEvents(context.Background())
+	if err != nil {
+		log.Fatalf("purge-blocked: %v (deleted %d events before failing)", err, deleted)
+	}
+	log.Printf("purge-blocked: deleted %d events", deleted)
+}
+
+func purgeBlockedEvents(ctx context.Context) (int, error) {
+	bl := blocklist.Load()
+	return deleteEventsWhere(ctx, bl.blocks)
+}
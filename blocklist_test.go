@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestBlocklistRejectsAndPurges(t *testing.T) {
+	newTestDB(t)
+	fs = afero.NewMemMapFs()
+	config = Config{BlocklistFile: "blocklist.txt"}
+	t.Cleanup(func() { blocklist.Store(nil) })
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	listed := signedEvent(t, sk, nostr.KindTextNote, "an abusive note")
+	spam := signedEvent(t, sk, nostr.KindTextNote, "BUY CHEAP followers now")
+	fine := signedEvent(t, sk, nostr.KindTextNote, "good morning")
+	for _, evt := range []*nostr.Event{listed, spam, fine} {
+		if err := db.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	afero.WriteFile(fs, config.BlocklistFile, []byte("# abuse reports\n"+strings.ToUpper(listed.ID)+"\n\nregex:(?i)cheap followers\n"), 0644)
+	if err := loadBlocklist(); err != nil {
+		t.Fatal(err)
+	}
+	for _, evt := range []*nostr.Event{listed, spam} {
+		if reject, _ := rejectBlocklisted(ctx, evt); !reject {
+			t.Fatalf("expected %q to be rejected", evt.Content)
+		}
+	}
+	if reject, msg := rejectBlocklisted(ctx, fine); reject {
+		t.Fatalf("expected an unlisted event to pass, got %q", msg)
+	}
+
+	deleted, err := purgeBlockedEvents(ctx)
+	if err != nil || deleted != 2 {
+		t.Fatalf("expected both blocked events to be purged, got %d (%v)", deleted, err)
+	}
+	if n, _ := db.CountEvents(ctx, nostr.Filter{}); n != 1 {
+		t.Fatalf("expected only the unlisted event to remain, got %d", n)
+	}
+
+	// a broken file on reload keeps the previous blocklist
+	afero.WriteFile(fs, config.BlocklistFile, []byte("regex:([unclosed\n"), 0644)
+	if err := loadBlocklist(); err == nil {
+		t.Fatal("expected an invalid pattern to fail the reload")
+	}
+	if reject, _ := rejectBlocklisted(ctx, spam); !reject {
+		t.Fatal("expected the previous blocklist to stay in effect")
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// isValidSha256 reports whether s looks like a hex-encoded SHA256 hash (64 hex characters)
+func isValidSha256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, char := range s {
+		if !((char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// blobHashFromPath extracts the sha256 from a /<sha256>[.ext] request path
+func blobHashFromPath(path string) string {
+	hash := strings.TrimPrefix(strings.SplitN(path, ".", 2)[0], "/")
+	if !isValidSha256(hash) {
+		return ""
+	}
+	return strings.ToLower(hash)
+}
+
+// withBlobRoutes serves HEAD and GET /<sha256>[.ext] straight from the blob files, so
+// responses carry the real size and modtime and file handles are closed after serving.
+// Resumable uploads to /upload/<sha256> and the HEAD /upload check are handled here too;
+// everything else falls through to khatru's blossom routes.
+func withBlobRoutes(bl *blossom.BlossomServer, next http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if hash := uploadHashFromPath(r.URL.Path); hash != "" {
+			handleResumableUpload(bl, w, r, hash)
+			return
+		}
+		if hash := blobHashFromPath(r.URL.Path); hash != "" {
+			switch r.Method {
+			case http.MethodHead, http.MethodGet:
+				if !authorizeBlobRead(w, r, "get", hash) {
+					return
+				}
+			}
+			switch r.Method {
+			case http.MethodHead:
+				handleHasBlob(bl, w, r, hash)
+				return
+			case http.MethodGet:
+				handleGetBlob(bl, w, r, hash)
+				return
+			case http.MethodDelete:
+				handleDeleteBlob(bl, w, r, hash)
+				return
+			}
+		}
+		if r.URL.Path == "/upload" && r.Method == http.MethodHead {
+			handleUploadCheck(bl, w, r)
+			return
+		}
+		// khatru buffers the whole upload in memory before StoreBlob runs, so these checks
+		// have to happen before the request reaches it
+		if r.URL.Path == "/upload" && r.Method == http.MethodPut {
+			// only a signed authorization from someone allowed to upload gets an upload slot or
+			// is recorded as used, so nobody else can fill up the record of recent ones or hold
+			// every slot with slow bodies. Which blob it is for can only be checked once the
+			// body is in.
+			if _, ok := requireUploadAuth(w, r, ""); !ok {
+				return
+			}
+			if err := probeUploadAuth(r); err != nil {
+				writeAuthUseError(w, err)
+				return
+			}
+			if !checkBlobStorage() {
+				writeBlobError(w, errBlobStorageUnavailable.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			release, ok := acquireUploadSlot(w)
+			if !ok {
+				return
+			}
+			defer release()
+			if isMultipartUpload(r) {
+				if r = unwrapMultipartUpload(w, r); r == nil {
+					return
+				}
+			}
+			body, hash, ok := spoolUpload(w, r)
+			if !ok {
+				return
+			}
+			defer body.Close()
+			if _, ok := requireUploadAuth(w, r, hash); !ok {
+				return
+			}
+			if err := checkUploadAuth(r); err != nil {
+				writeAuthUseError(w, err)
+				return
+			}
+			r.Body = body
+			if config.ModerationURL != "" {
+				if r = moderateUpload(w, r, body, hash); r == nil {
+					return
+				}
+			}
+			r = r.WithContext(withUploadKeep(r.Context()))
+			uw := &uploadResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(uw, r)
+			uw.flush()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// writeBlobError answers a blob request that failed for anything but its authorization, with
+// the reason in X-Reason for Blossom clients; writeAuthError is for 401 and 403
+func writeBlobError(w http.ResponseWriter, reason string, code int) {
+	w.Header().Set("X-Reason", reason)
+	http.Error(w, reason, code)
+}
+
+// maxBlobSize is the largest blob we accept, whether uploaded directly or mirrored
+const maxBlobSize = 200 * 1024 * 1024
+
+// mirrorTimeout bounds how long a /mirror download may take end to end
+const mirrorTimeout = 10 * time.Minute
+
+var (
+	errHashMismatch     = errors.New("blob hash mismatch")
+	errBlobTooLarge     = fmt.Errorf("file size exceeds %dMB limit", maxBlobSize/1024/1024)
+	errBlobCountReached = errors.New("blob count limit reached")
+)
+
+// spoolUpload reads a PUT /upload body into a temp file in the blob directory while hashing
+// it, since khatru never checks the body against the authorization's x tags. The returned
+// body reads the file back from the start, and closing it removes the file. On failure the
+// error response has been written and ok is false.
+func spoolUpload(w http.ResponseWriter, r *http.Request) (body *spooledBody, hash string, ok bool) {
+	file, err := afero.TempFile(fs, *config.BlossomPath, "upload.*"+tempBlobSuffix)
+	if err != nil {
+		log.Printf("Upload: failed to spool body: %v", err)
+		writeBlobError(w, errBlobStorageUnavailable.Error(), http.StatusServiceUnavailable)
+		return nil, "", false
+	}
+	body = &spooledBody{File: file}
+	hasher := sha256.New()
+	body.size, err = io.Copy(io.MultiWriter(file, hasher), io.LimitReader(r.Body, maxBlobSize+1))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		writeBlobError(w, "failed to read upload body", http.StatusBadRequest)
+		return nil, "", false
+	}
+	if body.size > maxBlobSize {
+		body.Close()
+		writeBlobError(w, errBlobTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return nil, "", false
+	}
+	return body, hex.EncodeToString(hasher.Sum(nil)), true
+}
+
+// spooledBody is an upload body read back from its temp file, which Close removes
+type spooledBody struct {
+	afero.File
+	size   int64
+	closed sync.Once
+}
+
+func (b *spooledBody) Close() error {
+	var err error
+	b.closed.Do(func() {
+		err = b.File.Close()
+		fs.Remove(b.File.Name())
+	})
+	return err
+}
+
+// storeBlob is the blossom StoreBlob hook. khatru hashes uploads itself, but we still go
+// through verifyAndStore so uploads and /mirror share exactly the same checks. A blob that
+// isn't stored loses the owner entry khatru's Keep gave it.
+func storeBlob(ctx context.Context, sha256 string, body []byte) error {
+	_, err := verifyAndStore(ctx, sha256, bytes.NewReader(body))
+	if err != nil && blobIndex != nil {
+		blobIndex.forgetFailedUpload(ctx, sha256)
+	}
+	return err
+}
+
+// verifyAndStore streams reader into a temp file next to the blob while hashing it, and only
+// moves it to the canonical path if the content really hashes to sha256 and fits within
+// maxBlobSize, so a file at a blob's final path is always complete. It returns the number
+// of bytes stored.
+func verifyAndStore(ctx context.Context, sha256 string, reader io.Reader) (size int64, err error) {
+	ctx, span := startBlobSpan(ctx, "blob.store", sha256)
+	defer func() { endBlobSpan(span, size, err) }()
+
+	// Create context with timeout for large file operations
+	storeCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	file, err := afero.TempFile(fs, *config.BlossomPath, sha256+".*"+tempBlobSuffix)
+	if err != nil {
+		return 0, blobStorageFailure(sha256, *config.BlossomPath, err)
+	}
+	tmpPath := file.Name()
+
+	size, err = copyHashed(storeCtx, file, reader, sha256)
+	if errors.Is(err, errBlobWrite) {
+		err = blobStorageFailure(sha256, tmpPath, err)
+	}
+	if err == nil {
+		// Ensure data is written to disk
+		if syncErr := file.Sync(); syncErr != nil {
+			err = blobStorageFailure(sha256, tmpPath, syncErr)
+		}
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = blobStorageFailure(sha256, tmpPath, closeErr)
+	}
+	if err == nil {
+		err = moderateTempBlob(storeCtx, sha256, tmpPath)
+	}
+	if err == nil {
+		finalPath := blobPath(sha256)
+		commitErr := fs.MkdirAll(filepath.Dir(finalPath), 0755)
+		if commitErr == nil {
+			commitErr = commitBlob(tmpPath, finalPath)
+		}
+		if commitErr != nil {
+			err = blobStorageFailure(sha256, finalPath, commitErr)
+		}
+	}
+	if err != nil {
+		fs.Remove(tmpPath)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// moderateTempBlob runs a verified temp file through moderation before it is committed
+func moderateTempBlob(ctx context.Context, sha256 string, tmpPath string) error {
+	if config.ModerationURL == "" {
+		return nil
+	}
+	file, err := fs.Open(tmpPath)
+	if err != nil {
+		return blobStorageFailure(sha256, tmpPath, err)
+	}
+	defer file.Close()
+	return moderateBlob(ctx, sha256, file)
+}
+
+// indexMirroredBlob detects the type of a blob stored by /mirror and records pubkey as one of
+// its owners, the way khatru does for uploads, so it shows up in /list and is served with
+// the right Content-Type
+func indexMirroredBlob(ctx context.Context, bl *blossom.BlossomServer, sha256 string, size int64, declared string, pubkey string) (blossom.BlobDescriptor, error) {
+	contentType, ext, err := detectStoredBlobType(sha256, declared)
+	if err != nil {
+		log.Printf("Mirror: Failed to detect the type of %s: %v", sha256, err)
+	}
+	descriptor := blossom.BlobDescriptor{
+		URL:      publicBlobURL(sha256, ext),
+		SHA256:   sha256,
+		Size:     int(size),
+		Type:     contentType,
+		Uploaded: nostr.Now(),
+	}
+	if err := bl.Store.Keep(ctx, descriptor, pubkey); err != nil {
+		log.Printf("Mirror: Failed to index %s for %s: %v", sha256, pubkey, err)
+		return descriptor, err
+	}
+	return descriptor, nil
+}
+
+// deleteBlob is the blossom DeleteBlob hook. It only removes the file once no owner in the
+// blob index references it any more.
+func deleteBlob(ctx context.Context, sha256 string) error {
+	if blobIndex != nil {
+		if refs := blobIndex.RefCount(sha256); refs > 0 {
+			log.Printf("DeleteBlob: keeping %s, still referenced by %d owners", sha256, refs)
+			return nil
+		}
+	}
+	if err := deleteDerivedBlobs(sha256); err != nil {
+		log.Printf("DeleteBlob: Failed to remove transformed copies of %s: %v", sha256, err)
+	}
+	return fs.Remove(blobPath(sha256))
+}
+
+// tempBlobSuffix marks in-progress writes so leftovers from a crash can be cleaned up
+const tempBlobSuffix = ".tmp"
+
+// commitBlob moves a fully written temp file into place. Rename is atomic on the OS
+// filesystem; for afero backends that can't rename we fall back to copying, which is
+// not atomic but still never exposes a file that failed verification.
+func commitBlob(tmpPath string, finalPath string) error {
+	err := fs.Rename(tmpPath, finalPath)
+	if err == nil {
+		return nil
+	}
+	log.Printf("StoreBlob: Rename %s to %s failed, falling back to copy: %v", tmpPath, finalPath, err)
+
+	src, err := fs.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.Create(finalPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		fs.Remove(finalPath)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		fs.Remove(finalPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.Remove(tmpPath)
+}
+
+// cleanupTempBlobs removes temp files left behind by writes that were interrupted by a crash
+func cleanupTempBlobs() {
+	entries, err := afero.ReadDir(fs, *config.BlossomPath)
+	if err != nil {
+		log.Printf("Error reading blossom directory: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), tempBlobSuffix) {
+			if err := fs.Remove(*config.BlossomPath + entry.Name()); err != nil {
+				log.Printf("Error removing stale temp blob %s: %v", entry.Name(), err)
+			}
+		}
+	}
+}
+
+// copyHashed copies at most maxBlobSize bytes from src to dst and checks the sha256 of what was copied
+func copyHashed(ctx context.Context, dst io.Writer, src io.Reader, expected string) (int64, error) {
+	hasher := sha256.New()
+	reader := io.LimitReader(src, maxBlobSize+1)
+	buffer := make([]byte, 32*1024) // 32KB buffer for efficient copying
+
+	var size int64
+	for {
+		select {
+		case <-ctx.Done():
+			return size, ctx.Err()
+		default:
+		}
+
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			size += int64(n)
+			if size > maxBlobSize {
+				return size, errBlobTooLarge
+			}
+			hasher.Write(buffer[:n])
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				return size, fmt.Errorf("%w: %w", errBlobWrite, writeErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != strings.ToLower(expected) {
+		return size, errHashMismatch
+	}
+	return size, nil
+}
+
+// openBlob opens the stored file for a blob
+func openBlob(sha256 string) (afero.File, error) {
+	return fs.Open(blobPath(sha256))
+}
+
+func loadBlob(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+	_, span := startBlobSpan(ctx, "blob.load", sha256)
+	defer span.End()
+	filePath := blobPath(sha256)
+	log.Printf("LoadBlob: Attempting to open file at path: %s", filePath)
+	file, err := openBlob(sha256)
+	if err != nil {
+		log.Printf("LoadBlob: Failed to open file %s: %v", filePath, err)
+		return nil, err
+	}
+	log.Printf("LoadBlob: Successfully opened file %s", filePath)
+	return file, nil
+}
+
+// handleGetBlob serves a blob through http.ServeContent, which takes care of
+// Range requests (206 Partial Content) for seeking in audio and video
+func handleGetBlob(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string) {
+	_, span := startBlobSpan(r.Context(), "blob.load", hash)
+	defer span.End()
+
+	file, err := openBlob(hash)
+	if err != nil {
+		w.Header().Set("X-Reason", "file not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		w.Header().Set("X-Reason", "file not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	span.SetAttributes(attribute.Int64("blob.size", info.Size()))
+
+	// the type detected when the blob was stored wins over whatever extension the client
+	// put on the URL; only for blobs without one does ServeContent go by that extension,
+	// or sniff the content when there is none either
+	name := hash
+	if descriptor, err := bl.Store.Get(r.Context(), hash); err == nil && descriptor != nil && descriptor.Type != "" {
+		w.Header().Set("Content-Type", descriptor.Type)
+	} else if spl := strings.SplitN(r.URL.Path, ".", 2); len(spl) == 2 {
+		name += "." + spl[1]
+	}
+
+	setBlobCacheHeaders(w, hash)
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+func handleHasBlob(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string) {
+	info, err := fs.Stat(blobPath(hash))
+	if err != nil || info.IsDir() {
+		w.Header().Set("X-Reason", "file not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	contentType := "application/octet-stream"
+	if descriptor, err := bl.Store.Get(r.Context(), hash); err == nil && descriptor != nil && descriptor.Type != "" {
+		contentType = descriptor.Type
+	} else if err != nil {
+		log.Printf("HasBlob: Failed to look up descriptor for %s: %v", hash, err)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setBlobCacheHeaders(w, hash)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteBlob removes the caller's ownership of a blob, accepting Blossom or NIP-98 auth,
+// and deletes the file once nobody else references it. Unlike khatru's handler it refuses
+// callers that never uploaded the blob.
+func handleDeleteBlob(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string) {
+	// owners may delete their blobs even after leaving the team
+	pubkey, code, err := requestAuthor(r, "delete", hash)
+	if err != nil {
+		writeAuthError(w, err.Error(), code)
+		return
+	}
+
+	if !blobIndex.Owns(hash, pubkey) {
+		writeAuthError(w, "you don't own this blob", http.StatusForbidden)
+		return
+	}
+
+	if err := blobIndex.Delete(r.Context(), hash, pubkey); err != nil {
+		log.Printf("DeleteBlob: Failed to remove %s from the index for %s: %v", hash, pubkey, err)
+		writeBlobError(w, "delete of blob entry failed", http.StatusInternalServerError)
+		return
+	}
+	for _, del := range bl.DeleteBlob {
+		if err := del(r.Context(), hash); err != nil {
+			log.Printf("DeleteBlob: Failed to delete %s: %v", hash, err)
+			writeBlobError(w, "failed to delete blob", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// setBlobCacheHeaders marks blob responses as cacheable forever: blobs are content-addressed,
+// so the sha256 is a strong ETag and the bytes behind a URL never change. http.ServeContent
+// answers If-None-Match with 304 once the (quoted) ETag is set.
+func setBlobCacheHeaders(w http.ResponseWriter, hash string) {
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// readBlossomAuth parses and validates a Blossom "Authorization: Nostr <base64 event>" header
+// for the given action ("list", "get", ...). It returns nil, nil when no header is present.
+func readBlossomAuth(r *http.Request, action string) (*nostr.Event, error) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, "Nostr "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization encoding")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != 24242 || !evt.CheckID() {
+		return nil, fmt.Errorf("invalid authorization event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("invalid authorization signature")
+	}
+
+	expirationTag := evt.Tags.GetFirst([]string{"expiration", ""})
+	if expirationTag == nil {
+		return nil, fmt.Errorf("missing \"expiration\" tag")
+	}
+	expiration, _ := strconv.ParseInt((*expirationTag)[1], 10, 64)
+	if nostr.Timestamp(expiration) < nostr.Now() {
+		return nil, fmt.Errorf("authorization expired")
+	}
+
+	if evt.Tags.GetFirst([]string{"t", action}) == nil {
+		return nil, fmt.Errorf("authorization is not valid for %q", action)
+	}
+
+	return &evt, nil
+}
+
+// authorizeBlobRead enforces BLOSSOM_DOWNLOAD_AUTH on blob reads: unless downloads are public
+// the request must carry either a Blossom authorization for action or a NIP-98 HTTP auth
+// event, signed by a team member. On failure the error response has been written and false
+// is returned.
+func authorizeBlobRead(w http.ResponseWriter, r *http.Request, action string, hash string) bool {
+	if config.BlossomDownloadAuth != blobAuthMember {
+		return true
+	}
+	_, ok := requireTeamAuth(w, r, action, hash)
+	return ok
+}
+
+// handleList implements BUD-02 GET /list/<pubkey>, returning the blobs the index
+// has recorded for that uploader
+func handleList(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		pubkey := strings.TrimPrefix(r.URL.Path, "/list/")
+		if !nostr.IsValidPublicKey(pubkey) {
+			http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeBlobRead(w, r, "list", "") {
+			return
+		}
+
+		var since, until nostr.Timestamp
+		if v, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64); err == nil {
+			since = nostr.Timestamp(v)
+		}
+		if v, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64); err == nil {
+			until = nostr.Timestamp(v)
+		}
+
+		ch, err := bl.Store.List(r.Context(), pubkey)
+		if err != nil {
+			log.Printf("List: Failed to query blob index for %s: %v", pubkey, err)
+			http.Error(w, "Failed to list blobs", http.StatusInternalServerError)
+			return
+		}
+
+		blobs := []blossom.BlobDescriptor{}
+		for bd := range ch {
+			if (since != 0 && bd.Uploaded < since) || (until != 0 && bd.Uploaded > until) {
+				continue
+			}
+			blobs = append(blobs, bd)
+		}
+
+		log.Printf("Returning %d blobs for pubkey %s", len(blobs), pubkey)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blobs)
+	}
+}
+
+// rejectUploadNonMember only accepts uploads of up to maxBlobSize, and only from team members
+// unless BLOSSOM_UPLOAD_AUTH is public
+func rejectUploadNonMember(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	if size > maxBlobSize {
+		return true, prefixInvalid + errBlobTooLarge.Error(), 413
+	}
+
+	if uploadsArePublic() || isTeamMember(auth.PubKey) {
+		return false, ext, size
+	}
+
+	return true, prefixRestricted + "you are not part of the team", 403
+}
+
+// rejectUploadBlobCount refuses uploads once the index holds MAX_BLOB_COUNT blobs. The hook
+// does not see the hash, so re-uploading a blob that is already stored is refused as well;
+// concurrent uploads may overshoot the limit by up to MAX_CONCURRENT_UPLOADS.
+func rejectUploadBlobCount(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	if err := checkBlobCount(); err != nil {
+		return true, prefixBlocked + err.Error(), http.StatusInsufficientStorage
+	}
+	return false, "", 0
+}
+
+// checkBlobCount returns errBlobCountReached when MAX_BLOB_COUNT is set and already reached
+func checkBlobCount() error {
+	if config.MaxBlobCount <= 0 || blobIndex == nil {
+		return nil
+	}
+	if blobIndex.Count() >= config.MaxBlobCount {
+		return fmt.Errorf("%w (%d)", errBlobCountReached, config.MaxBlobCount)
+	}
+	return nil
+}
+
+// rejectUploadExtension enforces BLOSSOM_ALLOWED_EXTS / BLOSSOM_BLOCKED_EXTS. Extensions are
+// compared case-insensitively and without the leading dot; with neither set everything is
+// allowed. The relay's own key may upload any type.
+func rejectUploadExtension(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	if auth != nil && isRelayPubkey(auth.PubKey) {
+		return false, "", 0
+	}
+	ext = normalizeExt(ext)
+
+	for _, blocked := range config.BlossomBlockedExts {
+		if normalizeExt(blocked) == ext {
+			return true, fmt.Sprintf(prefixBlocked+"file type %q is not allowed", ext), http.StatusUnsupportedMediaType
+		}
+	}
+
+	if len(config.BlossomAllowedExts) > 0 {
+		for _, allowed := range config.BlossomAllowedExts {
+			if normalizeExt(allowed) == ext {
+				return false, "", 0
+			}
+		}
+		if ext == "" {
+			return true, prefixBlocked + "unrecognized file type is not allowed", http.StatusUnsupportedMediaType
+		}
+		return true, fmt.Sprintf(prefixBlocked+"file type %q is not allowed", ext), http.StatusUnsupportedMediaType
+	}
+
+	return false, "", 0
+}
+
+func normalizeExt(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// newTestBlossom sets up an in-memory blob store and returns a server with an index
+func newTestBlossom(t *testing.T) *blossom.BlossomServer {
+	t.Helper()
+	newTestDB(t)
+	fs = afero.NewMemMapFs()
+	blossomPath := "blossom/"
+	blossomURL := "http://localhost:3334"
+	config = Config{BlossomEnabled: true, BlossomPath: &blossomPath, BlossomURL: &blossomURL}
+	fs.MkdirAll(blossomPath, 0755)
+	return &blossom.BlossomServer{
+		ServiceURL: blossomURL,
+		Store:      blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: blossomURL},
+	}
+}
+
+func TestGetBlobRange(t *testing.T) {
+	bl := newTestBlossom(t)
+	hash := strings.Repeat("ab", 32)
+	content := "0123456789abcdefghij"
+	if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	req := httptest.NewRequest("GET", "/"+hash, nil)
+	req.Header.Set("Range", "bytes=5-9")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 5-9/20" {
+		t.Fatalf("unexpected Content-Range %q", got)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if string(body) != content[5:10] {
+		t.Fatalf("expected %q, got %q", content[5:10], body)
+	}
+}
+
+func TestGetBlobIfNoneMatch(t *testing.T) {
+	bl := newTestBlossom(t)
+	hash := strings.Repeat("cd", 32)
+	if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/"+hash, nil))
+	etag := rec.Header().Get("ETag")
+	if etag != `"`+hash+`"` {
+		t.Fatalf("expected ETag to be the quoted sha256, got %q", etag)
+	}
+
+	req := httptest.NewRequest("GET", "/"+hash, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", rec.Code)
+	}
+}
+
+func TestVerifyAndStoreRejectsHashMismatch(t *testing.T) {
+	newTestBlossom(t)
+	claimed := strings.Repeat("ef", 32)
+
+	_, err := verifyAndStore(context.Background(), claimed, strings.NewReader("not the claimed content"))
+	if !errors.Is(err, errHashMismatch) {
+		t.Fatalf("expected errHashMismatch, got %v", err)
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+claimed); exists {
+		t.Fatal("expected mismatched blob not to be kept")
+	}
+	if entries, _ := afero.ReadDir(fs, *config.BlossomPath); len(entries) != 0 {
+		t.Fatalf("expected no temp files to be left behind, found %d", len(entries))
+	}
+
+	content := "the real content"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	size, err := verifyAndStore(context.Background(), hash, strings.NewReader(content))
+	if err != nil || size != int64(len(content)) {
+		t.Fatalf("expected matching blob to be stored, got size %d err %v", size, err)
+	}
+}
+
+// withBlossomAuth signs a Blossom authorization event for action with sk and attaches it
+func withBlossomAuth(t *testing.T, req *http.Request, sk string, action string, tags ...nostr.Tag) *http.Request {
+	t.Helper()
+	evt := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"t", action}, {"expiration", strconv.FormatInt(int64(nostr.Now()+60), 10)}}, tags...),
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(evt)
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	return req
+}
+
+func TestGetBlobRequiresTeamAuthWhenReadAuthEnabled(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.BlossomDownloadAuth = blobAuthMember
+	member, outsider := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+
+	hash := strings.Repeat("ab", 32)
+	if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte("private"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"no auth", httptest.NewRequest("GET", "/"+hash, nil), http.StatusUnauthorized},
+		{"blossom member", withBlossomAuth(t, httptest.NewRequest("GET", "/"+hash, nil), member, "get"), http.StatusOK},
+		{"blossom other blob", withBlossomAuth(t, httptest.NewRequest("GET", "/"+hash, nil), member, "get", nostr.Tag{"x", strings.Repeat("cd", 32)}), http.StatusForbidden},
+		{"blossom wrong action", withBlossomAuth(t, httptest.NewRequest("GET", "/"+hash, nil), member, "upload"), http.StatusUnauthorized},
+		{"nip98 member", withHTTPAuth(t, httptest.NewRequest("HEAD", "/"+hash, nil), member), http.StatusOK},
+		{"nip98 outsider", withHTTPAuth(t, httptest.NewRequest("GET", "/"+hash, nil), outsider), http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tc.req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d (%s)", tc.name, tc.code, rec.Code, rec.Header().Get("X-Reason"))
+		}
+	}
+}
+
+func TestUploadAuthPolicy(t *testing.T) {
+	newTestBlossom(t)
+	member, outsider := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	outsiderPub, _ := nostr.GetPublicKey(outsider)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	ctx := context.Background()
+	hash := strings.Repeat("ab", 32)
+
+	for _, policy := range []string{blobAuthMember, blobAuthPublic} {
+		config.BlossomUploadAuth = policy
+		outsiderAllowed := policy == blobAuthPublic
+
+		if reject, _, _ := rejectUploadNonMember(ctx, &nostr.Event{PubKey: outsiderPub}, 1024, ".png"); reject == outsiderAllowed {
+			t.Errorf("%s: rejectUploadNonMember rejected an outsider: %v", policy, reject)
+		}
+		if reject, _, _ := rejectUploadNonMember(ctx, &nostr.Event{PubKey: outsiderPub}, maxBlobSize+1, ".png"); !reject {
+			t.Errorf("%s: rejectUploadNonMember accepted an oversized upload", policy)
+		}
+
+		for _, sk := range []string{member, outsider} {
+			rec := httptest.NewRecorder()
+			pubkey, ok := requireUploadAuth(rec, withBlossomAuth(t, httptest.NewRequest("PUT", "/mirror", nil), sk, "upload"), hash)
+			if want := sk == member || outsiderAllowed; ok != want {
+				t.Errorf("%s: requireUploadAuth gave %v, expected %v (%d)", policy, ok, want, rec.Code)
+			}
+			if ok && pubkey == "" {
+				t.Errorf("%s: requireUploadAuth returned no pubkey", policy)
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		if _, ok := requireUploadAuth(rec, httptest.NewRequest("PUT", "/mirror", nil), hash); ok || rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: unsigned upload got %v, %d", policy, ok, rec.Code)
+		}
+	}
+}
+
+func TestDeleteBlobWithHTTPAuthRequiresOwnership(t *testing.T) {
+	bl := newTestBlossom(t)
+	ctx := context.Background()
+	index, err := newBlobIndex(ctx, *config.BlossomURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobIndex = index
+	t.Cleanup(func() { blobIndex = nil })
+	bl.Store = blobIndex
+	bl.DeleteBlob = append(bl.DeleteBlob, deleteBlob)
+
+	owner, stranger := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	ownerPub, _ := nostr.GetPublicKey(owner)
+	hash := strings.Repeat("ef", 32)
+	if err := blobIndex.Keep(ctx, blossom.BlobDescriptor{SHA256: hash, Type: "text/plain", Size: 4, Uploaded: nostr.Now()}, ownerPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, *config.BlossomPath+hash, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("DELETE", "/"+hash, nil), stranger))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a non-owner, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withHTTPAuth(t, httptest.NewRequest("DELETE", "/"+hash, nil), owner))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the owner, got %d: %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+hash); exists {
+		t.Fatal("expected the blob to be removed")
+	}
+}
+
+func TestUploadDescriptorUsesPublicURL(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.BlossomPublicURL = "https://cdn.example.com"
+	config.BlossomUploadAuth = blobAuthPublic
+	hash := strings.Repeat("ab", 32)
+
+	// stands in for khatru's upload handler, which links to its ServiceURL
+	khatru := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blossom.BlobDescriptor{URL: bl.ServiceURL + "/" + hash + ".png", SHA256: hash})
+	})
+	rec := httptest.NewRecorder()
+	withBlobRoutes(bl, khatru).ServeHTTP(rec, withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", strings.NewReader("x")), nostr.GeneratePrivateKey(), "upload"))
+	var descriptor blossom.BlobDescriptor
+	if err := json.Unmarshal(rec.Body.Bytes(), &descriptor); err != nil {
+		t.Fatalf("decoding descriptor %q: %v", rec.Body.String(), err)
+	}
+	if want := "https://cdn.example.com/" + hash + ".png"; descriptor.URL != want {
+		t.Fatalf("expected url %q, got %q", want, descriptor.URL)
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Fatalf("expected Content-Length to match the rewritten body, got %q", rec.Header().Get("Content-Length"))
+	}
+
+	if got := publicBlobURL(hash, ""); got != "https://cdn.example.com/"+hash {
+		t.Fatalf("expected mirror and resumable descriptors to use the public url, got %q", got)
+	}
+	config.BlossomPublicURL = ""
+	if got := publicBlobURL(hash, ""); got != bl.ServiceURL+"/"+hash {
+		t.Fatalf("expected BLOSSOM_URL without a public url, got %q", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// checkConfigOnly is set by --check-config: LoadConfig prints what it resolved and main exits
+// once validation and the database connection have succeeded, without starting the server
+var checkConfigOnly bool
+
+// redactedConfigFields are the Config fields printConfig never shows the value of. A field
+// holding a secret belongs here as soon as it is added to Config.
+var redactedConfigFields = map[string]bool{
+	"PostgresPassword": true,
+}
+
+// secretQueryParams are query parameters that carry a credential in a configured URL, such as
+// a moderation service reached at https://scan.example/check?token=...
+var secretQueryParams = []string{"token", "access_token", "key", "api_key", "apikey", "secret", "password", "auth"}
+
+// printConfig writes every Config field, one per line, with secrets redacted: the fields in
+// redactedConfigFields, and credentials inside any URL
+func printConfig(w io.Writer, cfg Config) {
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		field := value.Field(i)
+
+		var shown string
+		switch {
+		case field.Kind() == reflect.Pointer && field.IsNil():
+			shown = "(unset)"
+		case redactedConfigFields[name]:
+			shown = "(redacted)"
+		case field.Kind() == reflect.Pointer:
+			shown = showConfigValue(field.Elem())
+		default:
+			shown = showConfigValue(field)
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, shown)
+	}
+}
+
+// showConfigValue formats a field's value, passing strings and lists of them through redactURL
+func showConfigValue(field reflect.Value) string {
+	switch v := field.Interface().(type) {
+	case string:
+		return redactURL(v)
+	case []string:
+		shown := make([]string, len(v))
+		for i, s := range v {
+			shown[i] = redactURL(s)
+		}
+		return fmt.Sprint(shown)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// redactURL masks the credentials in a URL: the password in its userinfo, or the whole of a
+// userinfo that is a bare token, and the value of any of secretQueryParams. Anything that
+// isn't a URL with a host comes back unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return value
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		} else {
+			u.User = url.User("xxxxx")
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			if slices.Contains(secretQueryParams, strings.ToLower(name)) {
+				query.Set(name, "xxxxx")
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// validateConfig reports every setting that would make the relay fail or misbehave later on
+func validateConfig(cfg Config) error {
+	var errs []error
+	if cfg.TeamDomain == "" {
+		errs = append(errs, errors.New("TEAM_DOMAIN is empty"))
+	}
+
+	engine := "postgres"
+	if cfg.DBEngine != nil {
+		engine = *cfg.DBEngine
+	}
+	switch engine {
+	case "lmdb", "badger":
+	case "postgres":
+		required := []struct {
+			key   string
+			value *string
+		}{
+			{"POSTGRES_USER", cfg.PostgresUser},
+			{"POSTGRES_PASSWORD", cfg.PostgresPassword},
+			{"POSTGRES_DB", cfg.PostgresDB},
+			{"POSTGRES_HOST", cfg.PostgresHost},
+			{"POSTGRES_PORT", cfg.PostgresPort},
+		}
+		for _, field := range required {
+			if field.value == nil {
+				errs = append(errs, fmt.Errorf("%s is required for the postgres engine", field.key))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("DB_ENGINE %q is not one of lmdb, badger, postgres", engine))
+	}
+
+	if cfg.BlossomEnabled {
+		if cfg.BlossomPath == nil {
+			errs = append(errs, errors.New("BLOSSOM_PATH is required when blossom is enabled"))
+		}
+		if cfg.BlossomURL == nil {
+			errs = append(errs, errors.New("BLOSSOM_URL is required when blossom is enabled"))
+		} else if err := validateBaseURL("BLOSSOM_URL", *cfg.BlossomURL); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.BlossomPublicURL != "" {
+			if err := validateBaseURL("BLOSSOM_PUBLIC_URL", cfg.BlossomPublicURL); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if cfg.BlossomShardDepth < 0 || cfg.BlossomShardDepth > 32 {
+			errs = append(errs, errors.New("BLOSSOM_SHARD_DEPTH must be between 0 and 32"))
+		}
+		if cfg.BlossomTTL < 0 || (cfg.BlossomTTL > 0 && cfg.BlossomTTLSweep <= 0) {
+			errs = append(errs, errors.New("BLOSSOM_TTL must not be negative, and needs a positive BLOSSOM_TTL_SWEEP_INTERVAL"))
+		}
+		for key, value := range map[string]string{"BLOSSOM_UPLOAD_AUTH": cfg.BlossomUploadAuth, "BLOSSOM_DOWNLOAD_AUTH": cfg.BlossomDownloadAuth} {
+			if value != blobAuthMember && value != blobAuthPublic {
+				errs = append(errs, fmt.Errorf("%s must be member or public, got %q", key, value))
+			}
+		}
+		if cfg.MaxBlobCount < 0 {
+			errs = append(errs, errors.New("MAX_BLOB_COUNT must not be negative"))
+		}
+		if cfg.UploadAuthMaxAge < 0 {
+			errs = append(errs, errors.New("UPLOAD_AUTH_MAX_AGE must not be negative"))
+		}
+		if cfg.MediaEnabled && cfg.MediaMaxDimension < 1 {
+			errs = append(errs, errors.New("MEDIA_MAX_DIMENSION must be at least 1"))
+		}
+		for _, format := range cfg.MediaFormats {
+			if cfg.MediaEnabled && !slices.Contains(mediaEncoders, format) {
+				errs = append(errs, fmt.Errorf("MEDIA_FORMATS: %q is not one of %s", format, strings.Join(mediaEncoders, ", ")))
+			}
+		}
+	}
+
+	certSet := cfg.TLSCertFile != nil && *cfg.TLSCertFile != ""
+	keySet := cfg.TLSKeyFile != nil && *cfg.TLSKeyFile != ""
+	if certSet != keySet {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+
+	if cfg.HTTP2Cleartext && (certSet || cfg.TLSAutocertDomain != nil) {
+		errs = append(errs, errors.New("HTTP2_CLEARTEXT only applies without TLS; h2 over TLS is governed by HTTP2_ENABLED"))
+	}
+	if cfg.HTTP2Cleartext && !cfg.HTTP2Enabled {
+		errs = append(errs, errors.New("HTTP2_CLEARTEXT needs HTTP2_ENABLED"))
+	}
+	if cfg.HTTP2Enabled && cfg.HTTP2MaxConcurrentStreams < 1 {
+		errs = append(errs, errors.New("HTTP2_MAX_CONCURRENT_STREAMS must be at least 1"))
+	}
+	if cfg.HTTP2Enabled && (cfg.HTTP2MaxUploadBuffer < 65535 || cfg.HTTP2MaxUploadBuffer > 1<<31-1) {
+		errs = append(errs, errors.New("HTTP2_MAX_UPLOAD_BUFFER must be between 65535 and 2147483647"))
+	}
+
+	if _, ok := rejectionLogLevels[cfg.RejectionLogLevel]; !ok && cfg.RejectionLogLevel != "off" {
+		errs = append(errs, fmt.Errorf("REJECTION_LOG_LEVEL must be info, warn, error or off, got %q", cfg.RejectionLogLevel))
+	}
+	if _, ok := membershipPolicies[cfg.MembershipPolicy]; !ok {
+		errs = append(errs, fmt.Errorf("MEMBERSHIP_POLICY must be author or mention, got %q", cfg.MembershipPolicy))
+	}
+	if cfg.RequireRelayHint && cfg.RelayURL == "" {
+		errs = append(errs, errors.New("RELAY_URL is required when REQUIRE_RELAY_HINT is on"))
+	}
+	if cfg.MembershipRefresh <= 0 {
+		errs = append(errs, errors.New("MEMBERSHIP_REFRESH_INTERVAL must be positive"))
+	}
+	if cfg.MembershipMaxStaleness < 0 || (cfg.MembershipStaleUnready && cfg.MembershipMaxStaleness == 0) {
+		errs = append(errs, errors.New("MEMBERSHIP_MAX_STALENESS must not be negative, and must be set for MEMBERSHIP_STALE_UNREADY"))
+	}
+	if cfg.WOTEnabled && (cfg.WOTDepth < 1 || cfg.WOTMaxPubkeys < 1) {
+		errs = append(errs, errors.New("WOT_DEPTH and WOT_MAX_PUBKEYS must be at least 1 when WOT_ENABLED is on"))
+	}
+	if cfg.MaxQueryTimeRange < 0 {
+		errs = append(errs, errors.New("MAX_QUERY_TIME_RANGE must not be negative"))
+	}
+	if cfg.MaxWSMessageBytes < 0 {
+		errs = append(errs, errors.New("MAX_WS_MESSAGE_BYTES must not be negative"))
+	}
+	for kind, retention := range cfg.KindRetention {
+		if retention <= 0 {
+			errs = append(errs, fmt.Errorf("%s%d must be a positive duration", retentionKindPrefix, kind))
+		}
+	}
+	if len(cfg.KindRetention) > 0 && cfg.RetentionSweep <= 0 {
+		errs = append(errs, errors.New("RETENTION_SWEEP_INTERVAL must be positive when a RETENTION_KIND_<kind> is set"))
+	}
+	if cfg.MaxConnections < 0 {
+		errs = append(errs, errors.New("MAX_CONNECTIONS must not be negative"))
+	}
+	if cfg.WSPingInterval <= 0 || cfg.WSPingInterval >= cfg.WSPongTimeout {
+		errs = append(errs, errors.New("WS_PING_INTERVAL must be positive and shorter than WS_PONG_TIMEOUT"))
+	}
+	if cfg.MinPowDifficulty < 0 || cfg.MinPowDifficulty > 256 {
+		errs = append(errs, errors.New("MIN_POW_DIFFICULTY must be between 0 and 256"))
+	}
+	if cfg.RateLimitDefault < 0 {
+		errs = append(errs, errors.New("RATE_LIMIT_DEFAULT must not be negative"))
+	}
+	for kind, rate := range cfg.KindRateLimits {
+		if rate < 0 || kind < 0 || kind > 65535 {
+			errs = append(errs, fmt.Errorf("%s%d must be a kind between 0 and 65535 with a rate that is not negative", kindRateLimitPrefix, kind))
+		}
+	}
+	if cfg.DBBatchSize < 1 {
+		errs = append(errs, errors.New("DB_BATCH_SIZE must be at least 1"))
+	}
+	if cfg.QueryCacheEnabled && (cfg.QueryCacheTTL <= 0 || cfg.QueryCacheEntries < 1) {
+		errs = append(errs, errors.New("QUERY_CACHE_TTL and QUERY_CACHE_MAX_ENTRIES must be positive when the query cache is enabled"))
+	}
+	if len(cfg.DownstreamRelays) > 0 && cfg.DownstreamQueueSize < 1 {
+		errs = append(errs, errors.New("DOWNSTREAM_QUEUE_SIZE must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
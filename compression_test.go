@@ -0,0 +1,115 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressionFlushesStreamedResponses(t *testing.T) {
+	config = Config{HTTPCompression: true, HTTPCompressionMinBytes: 1024}
+	line := `{"kind":1,"content":"hello"}` + "\n"
+	flushed := make(chan struct{})
+	handler := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, line)
+		http.NewResponseController(w).Flush()
+		<-flushed
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	defer close(flushed)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a flushed stream to be gzipped, got %v", resp.Header)
+	}
+	// the handler is still blocked, so the line can only arrive if the flush reached the client
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(line))
+	if _, err := io.ReadFull(zr, got); err != nil || string(got) != line {
+		t.Fatalf("expected the first line before the handler finished, got %q (%v)", got, err)
+	}
+}
+
+func TestCompressionHonorsTypeSizeAndAcceptEncoding(t *testing.T) {
+	config = Config{HTTPCompression: true, HTTPCompressionMinBytes: 1024}
+	large := strings.Repeat(`{"kind":1,"content":"hello"},`, 100)
+	handler := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := large
+		if r.URL.Path == "/small" {
+			body = `{"ok":true}`
+		}
+		if r.URL.Path == "/blob" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("ETag", `"abc"`)
+		io.WriteString(w, body)
+	}))
+	get := func(path, acceptEncoding string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/list", "br, gzip;q=0.8")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("ETag") != `W/"abc"` {
+		t.Fatalf("expected a gzipped response with a weak ETag, got %v", rec.Header())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != large {
+		t.Fatalf("gzipped body doesn't round-trip: %q", body)
+	}
+
+	rec = get("/list", "deflate, gzip;q=0")
+	if rec.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("expected deflate when gzip is refused, got %v", rec.Header())
+	}
+	zr2, err := zlib.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr2); string(body) != large {
+		t.Fatalf("deflated body doesn't round-trip: %q", body)
+	}
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"small response":     get("/small", "gzip"),
+		"image blob":         get("/blob", "gzip"),
+		"no accept-encoding": get("/list", ""),
+		"range request":      get("/list", "gzip", "Range", "bytes=0-9"),
+		"identity only":      get("/list", "identity"),
+	} {
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("%s: expected no compression, got %q", name, encoding)
+		}
+	}
+	if rec := get("/small", "gzip"); rec.Body.String() != `{"ok":true}` || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected the small response unchanged with Vary set, got %q %v", rec.Body.String(), rec.Header())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFileEnvTakesPrecedence(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "RELAY_NAME: From File\nTEAM_DOMAIN: file.example\nADMIN_PUBKEYS: [aa, bb]\nREQUIRE_PROFILE: true\n",
+		"config.toml": "RELAY_NAME = \"From File\"\nTEAM_DOMAIN = \"file.example\"\nADMIN_PUBKEYS = [\"aa\", \"bb\"]\nREQUIRE_PROFILE = true\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("RELAY_NAME", "From Env")
+			for _, key := range []string{"TEAM_DOMAIN", "ADMIN_PUBKEYS", "REQUIRE_PROFILE"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+
+			if err := loadConfigFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if got := os.Getenv("RELAY_NAME"); got != "From Env" {
+				t.Fatalf("expected env to win, got %q", got)
+			}
+			if got := os.Getenv("TEAM_DOMAIN"); got != "file.example" {
+				t.Fatalf("expected TEAM_DOMAIN from file, got %q", got)
+			}
+			if got := os.Getenv("ADMIN_PUBKEYS"); got != "aa,bb" {
+				t.Fatalf("expected list joined with commas, got %q", got)
+			}
+			if !getEnvBool("REQUIRE_PROFILE") {
+				t.Fatal("expected REQUIRE_PROFILE from file to be true")
+			}
+		})
+	}
+}
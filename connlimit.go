@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+)
+
+// openConnections is how many websockets are open right now, and connectionsRefused how
+// many were turned away at MAX_CONNECTIONS; both are reported by /admin/status
+var (
+	openConnections    atomic.Int64
+	connectionsRefused atomic.Int64
+)
+
+// withConnectionLimit caps how many websockets may be open at once at MAX_CONNECTIONS. Every
+// upgrade takes a slot before khatru sees it, and the slot is given back when the connection
+// is closed, which khatru does however the connection ends, or straight away if the upgrade
+// never happens. An upgrade over the limit is accepted only to be closed at once with 1013
+// (try again later), so clients see why rather than a failed handshake. The count is kept
+// with MAX_CONNECTIONS at 0 too, for /admin/status.
+func withConnectionLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if open := openConnections.Add(1); config.MaxConnections > 0 && open > int64(config.MaxConnections) {
+			openConnections.Add(-1)
+			refuseConnection(w, r)
+			return
+		}
+		cw := &countedWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if !cw.hijacked {
+			openConnections.Add(-1)
+		}
+	})
+}
+
+// refuseConnection completes the upgrade only to send a 1013 close frame
+func refuseConnection(w http.ResponseWriter, r *http.Request) {
+	connectionsRefused.Add(1)
+	log.Printf("Refusing websocket from %s: MAX_CONNECTIONS (%d) reached", khatru.GetIPFromRequest(r), config.MaxConnections)
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too many connections"), time.Now().Add(time.Second))
+}
+
+// countedWriter hands the websocket upgrade a countedConn, which gives the slot back on Close
+type countedWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (cw *countedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(cw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	cw.hijacked = true
+	return &countedConn{Conn: conn}, brw, nil
+}
+
+type countedConn struct {
+	net.Conn
+	release sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.release.Do(func() { openConnections.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestMaxConnections(t *testing.T) {
+	rl, _ := startTestRelay(t)
+	baseline := openConnections.Load()
+	config.MaxConnections = int(baseline) + 2
+	server := httptest.NewServer(withConnectionLimit(rl))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// waitFor polls openConnections, which khatru updates from its own goroutines
+	waitFor := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for openConnections.Load() != baseline+want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d open connections, got %d", want, openConnections.Load()-baseline)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	waitFor(2)
+
+	refusedBefore := connectionsRefused.Load()
+	third, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = third.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+		t.Fatalf("expected the connection over the limit to be closed with 1013, got %v", err)
+	}
+	third.Close()
+	if connectionsRefused.Load() != refusedBefore+1 {
+		t.Fatalf("expected one refused connection to be counted, got %d", connectionsRefused.Load()-refusedBefore)
+	}
+	waitFor(2)
+
+	// dropping the TCP connection without a close frame frees its slot all the same
+	first.NetConn().Close()
+	waitFor(1)
+
+	again, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := again.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"kinds":[1]}]`)); err != nil {
+		t.Fatal(err)
+	}
+	again.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := again.ReadMessage(); err != nil {
+		t.Fatalf("expected a freed slot to be usable, got %v", err)
+	}
+	again.Close()
+	waitFor(1)
+}
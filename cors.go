@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	corsAllowedMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Type, X-SHA-256, X-Content-Type, X-Content-Length, X-Request-ID"
+	corsExposedHeaders = "Content-Length, Content-Range, Content-Type, ETag, X-Reason, X-Request-ID, X-Blob-Sha256, X-Blob-Size"
+)
+
+// withCORS applies the CORS_ALLOWED_ORIGINS policy to every plain HTTP request. It has to
+// wrap the relay itself rather than relay.Router(): khatru runs its own allow-all CORS
+// middleware in front of the router, which answers preflights before they reach us.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || r.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := corsOriginAllowed(origin)
+		h := w.Header()
+		if allowed {
+			if len(config.CORSOrigins) == 0 || slices.Contains(config.CORSOrigins, "*") {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Origin")
+			if allowed {
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				h.Set("Access-Control-Max-Age", "86400")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// without an Origin khatru's middleware leaves the headers we set alone (it still adds Vary: Origin)
+		r = r.Clone(r.Context())
+		r.Header.Del("Origin")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func corsOriginAllowed(origin string) bool {
+	if len(config.CORSOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range config.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// batchSaver is implemented by backends that can store several events in one round trip.
+// It returns one error per event, in order, with eventstore.ErrDupEvent for duplicates.
+type batchSaver interface {
+	SaveEvents(ctx context.Context, events []*nostr.Event) []error
+}
+
+const insertEventSQL = `INSERT INTO event (
+	id, pubkey, created_at, kind, tags, content, sig)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (id) DO NOTHING`
+
+// SaveEvents inserts the events in order inside a single transaction. If any insert fails
+// the transaction is rolled back and the events are saved one by one instead, so every
+// event still gets its own accurate result.
+func (b postgresSearchBackend) SaveEvents(ctx context.Context, events []*nostr.Event) []error {
+	errs := make([]error, len(events))
+	saveEach := func() []error {
+		for i, evt := range events {
+			errs[i] = b.SaveEvent(ctx, evt)
+		}
+		return errs
+	}
+
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return saveEach()
+	}
+	for i, evt := range events {
+		tags, _ := json.Marshal(evt.Tags)
+		res, err := tx.ExecContext(ctx, insertEventSQL, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tags, evt.Content, evt.Sig)
+		if err != nil {
+			tx.Rollback()
+			return saveEach()
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			errs[i] = eventstore.ErrDupEvent
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+type batchRequest struct {
+	evt  *nostr.Event
+	done chan error
+}
+
+// batchWriter coalesces concurrent SaveEvent calls into batches of up to size events, waiting
+// at most interval for a batch to fill. A single goroutine writes the batches, so events are
+// stored in the order their SaveEvent calls arrived.
+type batchWriter struct {
+	saver    batchSaver
+	size     int
+	interval time.Duration
+	requests chan batchRequest
+}
+
+func newBatchWriter(saver batchSaver, size int, interval time.Duration) *batchWriter {
+	bw := &batchWriter{
+		saver:    saver,
+		size:     size,
+		interval: interval,
+		requests: make(chan batchRequest, size),
+	}
+	go bw.run()
+	return bw
+}
+
+// SaveEvent queues evt for the next batch and waits for its result
+func (bw *batchWriter) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	req := batchRequest{evt: evt, done: make(chan error, 1)}
+	select {
+	case bw.requests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		// the write still happens, the caller just stops waiting for it
+		return ctx.Err()
+	}
+}
+
+func (bw *batchWriter) run() {
+	for first := range bw.requests {
+		batch := []batchRequest{first}
+		timer := time.NewTimer(bw.interval)
+	fill:
+		for len(batch) < bw.size {
+			select {
+			case req := <-bw.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		events := make([]*nostr.Event, len(batch))
+		for i, req := range batch {
+			events[i] = req.evt
+		}
+		errs := bw.saver.SaveEvents(context.Background(), events)
+		for i, req := range batch {
+			req.done <- errs[i]
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// recordingSaver stores events in memory and records the size of every batch it receives
+type recordingSaver struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	batches []int
+}
+
+func (rs *recordingSaver) SaveEvents(ctx context.Context, events []*nostr.Event) []error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.batches = append(rs.batches, len(events))
+	errs := make([]error, len(events))
+	for i, evt := range events {
+		if rs.seen[evt.ID] {
+			errs[i] = eventstore.ErrDupEvent
+		}
+		rs.seen[evt.ID] = true
+	}
+	return errs
+}
+
+func TestBatchWriterCoalescesAndReportsPerEvent(t *testing.T) {
+	saver := &recordingSaver{seen: map[string]bool{}}
+	bw := newBatchWriter(saver, 10, 50*time.Millisecond)
+	sk := nostr.GeneratePrivateKey()
+	evt := signedEvent(t, sk, nostr.KindTextNote, "hello")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = bw.SaveEvent(context.Background(), evt)
+				return
+			}
+			errs[i] = bw.SaveEvent(context.Background(), signedEvent(t, sk, nostr.KindTextNote, "note"+string(rune('a'+i))))
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("event %d: unexpected error %v", i, err)
+		}
+	}
+	if err := bw.SaveEvent(context.Background(), evt); err != eventstore.ErrDupEvent {
+		t.Fatalf("expected ErrDupEvent for a duplicate, got %v", err)
+	}
+	if len(saver.batches) > 3 {
+		t.Fatalf("expected concurrent saves to be coalesced, got batches %v", saver.batches)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// postgresRetryAttempts is how often an operation is tried while postgres is unreachable
+	// before the client is told to come back later
+	postgresRetryAttempts = 5
+	postgresMinBackoff    = 100 * time.Millisecond
+	postgresMaxBackoff    = 2 * time.Second
+)
+
+// errDatabaseUnavailable is what clients get while postgres is down or restarting. khatru
+// sends it as the OK or CLOSED message, so it carries its own prefix.
+var errDatabaseUnavailable = errors.New("error: database temporarily unavailable, please retry")
+
+// isConnectionError reports whether err means the connection to postgres was lost or refused,
+// as opposed to the statement itself failing. Other network errors, such as a failed DNS
+// lookup, aren't something reconnecting fixes; timeouts are told apart by
+// isConnectionTimeout.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// class 08 is connection exceptions; 57P01-57P03 are the server shutting down,
+		// crashing or still starting up
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isConnectionTimeout reports whether err is a network timeout talking to postgres, which a
+// fresh connection may well not hit. The caller's own deadline running out isn't one: there
+// is no time left to retry in.
+func isConnectionTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// withReconnect runs op, and when it fails because postgres went away, waits with backoff for
+// the pool to reach it again and retries. database/sql drops broken connections and dials new
+// ones on its own, so all we need is to ping until that succeeds. Once the attempts run out,
+// or ctx is done, errDatabaseUnavailable is returned instead of the driver error.
+func (b postgresSearchBackend) withReconnect(ctx context.Context, what string, op func() error) error {
+	backoff := postgresMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		lost, timedOut := isConnectionError(err), isConnectionTimeout(err)
+		if !lost && !timedOut {
+			return err
+		}
+		if attempt == postgresRetryAttempts {
+			log.Printf("Postgres: %s failed after %d attempts: %v", what, attempt, err)
+			return errDatabaseUnavailable
+		}
+		if timedOut {
+			log.Printf("Postgres: %s timed out, retrying in %s: %v", what, backoff, err)
+		} else {
+			log.Printf("Postgres: connection lost during %s, retrying in %s: %v", what, backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errDatabaseUnavailable
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, postgresMaxBackoff)
+		pingCtx, cancel := context.WithTimeout(ctx, postgresMaxBackoff)
+		if err := b.DB.PingContext(pingCtx); err != nil {
+			log.Printf("Postgres: still unreachable: %v", err)
+		}
+		cancel()
+	}
+}
+
+func (b postgresSearchBackend) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	return b.withReconnect(ctx, "save", func() error { return b.PostgresBackend.SaveEvent(ctx, evt) })
+}
+
+func (b postgresSearchBackend) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	return b.withReconnect(ctx, "replace", func() error { return b.PostgresBackend.ReplaceEvent(ctx, evt) })
+}
+
+func (b postgresSearchBackend) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	return b.withReconnect(ctx, "delete", func() error { return b.PostgresBackend.DeleteEvent(ctx, evt) })
+}
+
+func (b postgresSearchBackend) CountEvents(ctx context.Context, filter nostr.Filter) (count int64, err error) {
+	err = b.withReconnect(ctx, "count", func() error {
+		count, err = b.PostgresBackend.CountEvents(ctx, filter)
+		return err
+	})
+	return count, err
+}
+
+func (b postgresSearchBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (ch chan *nostr.Event, err error) {
+	err = b.withReconnect(ctx, "query", func() error {
+		ch, err = b.queryEvents(ctx, filter)
+		return err
+	})
+	return ch, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// deadLetter is one line of the dead-letter file: an event the store refused, how it was
+// being stored and why it failed
+type deadLetter struct {
+	Op       string      `json:"op"`
+	Event    nostr.Event `json:"event"`
+	Error    string      `json:"error"`
+	FailedAt time.Time   `json:"failed_at"`
+}
+
+// deadLetterMu serializes appends, and replay rewriting the file, so lines never interleave
+var deadLetterMu sync.Mutex
+
+// withDeadLetter records every event store fails to save in DEAD_LETTER_FILE before passing
+// the error on, so it can be replayed once the cause is fixed. Duplicates aren't failures.
+func withDeadLetter(op string, store func(context.Context, *nostr.Event) error) func(context.Context, *nostr.Event) error {
+	return func(ctx context.Context, evt *nostr.Event) error {
+		err := store(ctx, evt)
+		if err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+			if appendErr := appendDeadLetter(deadLetter{Op: op, Event: *evt, Error: err.Error(), FailedAt: time.Now().UTC()}); appendErr != nil {
+				log.Printf("Dead letter: Failed to record event %s: %v", evt.ID, appendErr)
+			}
+		}
+		return err
+	}
+}
+
+func appendDeadLetter(entry deadLetter) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	file, err := fs.OpenFile(config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runReplayDeadLetters feeds the dead-lettered events back to the store: swarm replay-dead-letters.
+// Events that fail again stay in the file, so it can be rerun until it empties.
+func runReplayDeadLetters() {
+	if config.DeadLetterFile == "" {
+		log.Fatalf("replay-dead-letters: DEAD_LETTER_FILE is not set")
+	}
+	stored, failed, err := replayDeadLetters(context.Background())
+	if err != nil {
+		log.Fatalf("replay-dead-letters: %v", err)
+	}
+	log.Printf("replay-dead-letters: stored %d events, %d still failing", stored, failed)
+}
+
+// replayDeadLetters retries each dead-lettered event with the operation that first failed and
+// rewrites the file with only the ones that still fail
+func replayDeadLetters(ctx context.Context) (stored int, failed int, err error) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	body, err := afero.ReadFile(fs, config.DeadLetterFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var remaining bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return stored, failed, fmt.Errorf("%s line %d: %w", config.DeadLetterFile, line, err)
+		}
+
+		store := db.SaveEvent
+		if entry.Op == "replace" {
+			store = db.ReplaceEvent
+		}
+		err := store(ctx, &entry.Event)
+		if err == nil || errors.Is(err, eventstore.ErrDupEvent) {
+			stored++
+			continue
+		}
+		failed++
+		log.Printf("replay-dead-letters: event %s still failing: %v", entry.Event.ID, err)
+		entry.Error, entry.FailedAt = err.Error(), time.Now().UTC()
+		updated, err := json.Marshal(entry)
+		if err != nil {
+			updated = scanner.Bytes()
+		}
+		remaining.Write(updated)
+		remaining.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return stored, failed, err
+	}
+	return stored, failed, afero.WriteFile(fs, config.DeadLetterFile, remaining.Bytes(), 0600)
+}
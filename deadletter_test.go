@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestDeadLetterRecordsAndReplaysFailedEvents(t *testing.T) {
+	newTestDB(t)
+	fs = afero.NewMemMapFs()
+	config = Config{DeadLetterFile: "dead-letters.jsonl"}
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	diskFull := errors.New("no space left on device")
+	failing := withDeadLetter("save", func(context.Context, *nostr.Event) error { return diskFull })
+	lost := signedEvent(t, sk, nostr.KindTextNote, "please keep me")
+	if err := failing(ctx, lost); !errors.Is(err, diskFull) {
+		t.Fatalf("expected the store error to be passed on, got %v", err)
+	}
+	profile := signedEvent(t, sk, nostr.KindProfileMetadata, `{"name":"me"}`)
+	withDeadLetter("replace", func(context.Context, *nostr.Event) error { return diskFull })(ctx, profile)
+	withDeadLetter("save", func(context.Context, *nostr.Event) error { return eventstore.ErrDupEvent })(ctx, lost)
+
+	body, _ := afero.ReadFile(fs, config.DeadLetterFile)
+	if lines := strings.Split(strings.TrimSpace(string(body)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], "no space left on device") || !strings.Contains(lines[1], `"op":"replace"`) {
+		t.Fatalf("expected two dead letters and no duplicate, got:\n%s", body)
+	}
+
+	stored, failed, err := replayDeadLetters(ctx)
+	if err != nil || stored != 2 || failed != 0 {
+		t.Fatalf("expected both events replayed, got %d stored, %d failed, %v", stored, failed, err)
+	}
+	for _, evt := range []*nostr.Event{lost, profile} {
+		if found, _ := hasEvent(ctx, evt.ID); !found {
+			t.Fatalf("expected replayed event %s in the store", evt.ID)
+		}
+	}
+	if body, _ := afero.ReadFile(fs, config.DeadLetterFile); len(body) != 0 {
+		t.Fatalf("expected the dead-letter file to be emptied, got:\n%s", body)
+	}
+
+	afero.WriteFile(fs, config.DeadLetterFile, []byte("{not json\n"), 0600)
+	if _, _, err := replayDeadLetters(ctx); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("expected a malformed line to be reported, got %v", err)
+	}
+}
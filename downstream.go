@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// downstreamPublishTimeout bounds connecting to a downstream relay and waiting for its OK
+	downstreamPublishTimeout = 10 * time.Second
+	// downstreamMaxAttempts is how often an event is tried before it's given up on, so an
+	// event a downstream relay refuses for good doesn't hold up the rest of the queue
+	downstreamMaxAttempts = 5
+	downstreamMinBackoff  = time.Second
+	downstreamMaxBackoff  = time.Minute
+)
+
+// firehose mirrors every stored event to the DOWNSTREAM_RELAYS. Each relay has its own queue
+// and connection, so a slow or unreachable one never holds up the others or the store path.
+type firehose struct {
+	relays []*downstreamRelay
+}
+
+type downstreamRelay struct {
+	url   string
+	queue chan *nostr.Event
+	conn  *nostr.Relay
+}
+
+func newFirehose(urls []string, queueSize int) *firehose {
+	f := &firehose{}
+	for _, url := range urls {
+		d := &downstreamRelay{url: url, queue: make(chan *nostr.Event, queueSize)}
+		f.relays = append(f.relays, d)
+		go d.run()
+	}
+	return f
+}
+
+// forward is an OnEventSaved hook. It only queues the event; when a relay's queue is full the
+// event is dropped for that relay rather than making the client wait.
+func (f *firehose) forward(ctx context.Context, evt *nostr.Event) {
+	for _, d := range f.relays {
+		select {
+		case d.queue <- evt:
+		default:
+			log.Printf("Downstream %s: queue full, dropping event %s", redactURL(d.url), evt.ID)
+		}
+	}
+}
+
+func (d *downstreamRelay) run() {
+	backoff := downstreamMinBackoff
+	for evt := range d.queue {
+		for attempt := 1; ; attempt++ {
+			err := d.publish(evt)
+			if err == nil {
+				backoff = downstreamMinBackoff
+				break
+			}
+			if attempt == downstreamMaxAttempts {
+				log.Printf("Downstream %s: giving up on event %s after %d attempts: %v", redactURL(d.url), evt.ID, attempt, err)
+				break
+			}
+			log.Printf("Downstream %s: failed to publish event %s, retrying in %s: %v", redactURL(d.url), evt.ID, backoff, err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, downstreamMaxBackoff)
+		}
+	}
+}
+
+// publish sends evt over the relay's connection, reconnecting first if it has dropped
+func (d *downstreamRelay) publish(evt *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), downstreamPublishTimeout)
+	defer cancel()
+
+	if d.conn == nil || !d.conn.IsConnected() {
+		conn, err := nostr.RelayConnect(ctx, d.url)
+		if err != nil {
+			return err
+		}
+		d.conn = conn
+	}
+	return d.conn.Publish(ctx, *evt)
+}
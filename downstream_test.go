@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFirehoseMirrorsToDownstreamRelay(t *testing.T) {
+	received := make(chan *nostr.Event, 1)
+	downstream := khatru.NewRelay()
+	downstream.StoreEvent = append(downstream.StoreEvent, func(ctx context.Context, evt *nostr.Event) error {
+		received <- evt
+		return nil
+	})
+	server := httptest.NewServer(downstream)
+	defer server.Close()
+
+	f := newFirehose([]string{"ws" + strings.TrimPrefix(server.URL, "http")}, 10)
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "backup me")
+	f.forward(context.Background(), evt)
+
+	select {
+	case got := <-received:
+		if got.ID != evt.ID {
+			t.Fatalf("expected %s downstream, got %s", evt.ID, got.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event to be mirrored downstream")
+	}
+}
+
+func TestFirehoseNeverBlocksWhenQueueIsFull(t *testing.T) {
+	// no worker drains this queue, as if the relay were stuck reconnecting
+	f := &firehose{relays: []*downstreamRelay{{url: "ws://unreachable.invalid", queue: make(chan *nostr.Event, 1)}}}
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "overflow")
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			f.forward(context.Background(), evt)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected forward to drop events instead of blocking")
+	}
+	if len(f.relays[0].queue) != 1 {
+		t.Fatalf("expected the queue to stay bounded, got %d", len(f.relays[0].queue))
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// skipDuplicates wraps a store hook with a lookup by id, so an event we already have is
+// answered with eventstore.ErrDupEvent before any write is attempted. khatru turns that into
+// an accepted OK without broadcasting the event again, whichever backend or path (regular,
+// replaceable, batched) would otherwise have handled it.
+func skipDuplicates(store func(context.Context, *nostr.Event) error) func(context.Context, *nostr.Event) error {
+	return func(ctx context.Context, evt *nostr.Event) error {
+		exists, err := hasEvent(ctx, evt.ID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return eventstore.ErrDupEvent
+		}
+		return store(ctx, evt)
+	}
+}
+
+// hasEvent looks up a single event id in the store, bypassing the query cache
+func hasEvent(ctx context.Context, id string) (bool, error) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for range ch {
+		found = true
+	}
+	return found, nil
+}
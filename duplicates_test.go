@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// countingStore counts the writes that reach the backend
+type countingStore struct {
+	DBBackend
+	writes atomic.Int32
+}
+
+func (cs *countingStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	cs.writes.Add(1)
+	return cs.DBBackend.SaveEvent(ctx, evt)
+}
+
+func (cs *countingStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	cs.writes.Add(1)
+	return cs.DBBackend.ReplaceEvent(ctx, evt)
+}
+
+func TestRepublishedEventIsAcceptedWithoutSecondWrite(t *testing.T) {
+	newTestDB(t)
+	store := &countingStore{DBBackend: db}
+	db = store
+	config = Config{}
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	server := httptest.NewServer(rl)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	subscriber, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	sub, err := subscriber.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindTextNote, nostr.KindProfileMetadata}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sub.EndOfStoredEvents
+
+	publisher, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	for _, evt := range []*nostr.Event{
+		signedEvent(t, sk, nostr.KindTextNote, "once"),
+		signedEvent(t, sk, nostr.KindProfileMetadata, `{"name":"once"}`),
+	} {
+		store.writes.Store(0)
+		for i := 0; i < 2; i++ {
+			if err := publisher.Publish(ctx, *evt); err != nil {
+				t.Fatalf("expected publish %d of kind %d to be accepted, got %v", i+1, evt.Kind, err)
+			}
+		}
+		if writes := store.writes.Load(); writes != 1 {
+			t.Fatalf("expected a single write for kind %d, got %d", evt.Kind, writes)
+		}
+
+		if got := <-sub.Events; got.ID != evt.ID {
+			t.Fatalf("expected %s to be broadcast, got %s", evt.ID, got.ID)
+		}
+		select {
+		case got := <-sub.Events:
+			t.Fatalf("expected the duplicate not to be broadcast again, got %s", got.ID)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
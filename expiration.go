@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// expirationSweepPage is how many events each query of the expiration sweep reads
+const expirationSweepPage = 500
+
+// isExpired reports whether the event carries a NIP-40 expiration tag that has passed
+func isExpired(evt *nostr.Event, now nostr.Timestamp) bool {
+	expiresAt := nip40.GetExpiration(evt.Tags)
+	return expiresAt != -1 && expiresAt <= now
+}
+
+// queryUnexpired is the relay QueryEvents hook; it hides expired events that the sweeper
+// hasn't purged yet
+func queryUnexpired(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	events, err := db.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		now := nostr.Now()
+		for evt := range events {
+			if isExpired(evt, now) {
+				continue
+			}
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// sweepExpiredEventsEvery purges expired events on a fixed interval
+func sweepExpiredEventsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sweepExpiredEvents(context.Background())
+	}
+}
+
+// sweepExpiredEvents walks the whole store from newest to oldest and deletes every event
+// whose expiration tag has passed. It returns how many events were deleted.
+func sweepExpiredEvents(ctx context.Context) int {
+	now := nostr.Now()
+	deleted, err := deleteEventsWhere(ctx, func(evt *nostr.Event) bool { return isExpired(evt, now) })
+	if err != nil {
+		log.Printf("Expiration sweep: query failed: %v", err)
+	}
+	if deleted > 0 {
+		log.Printf("Expiration sweep: deleted %d expired events", deleted)
+	}
+	return deleted
+}
+
+// deleteEventsWhere pages through the whole store from newest to oldest and deletes every
+// event match returns true for. It returns how many events were deleted; failed deletes
+// are logged and skipped.
+func deleteEventsWhere(ctx context.Context, match func(*nostr.Event) bool) (int, error) {
+	deleted := 0
+	seen := make(map[string]bool)
+	var until *nostr.Timestamp
+
+	for {
+		ch, err := db.QueryEvents(ctx, nostr.Filter{Until: until, Limit: expirationSweepPage})
+		if err != nil {
+			return deleted, err
+		}
+
+		// pages overlap on the oldest timestamp so events sharing it aren't skipped
+		fresh := 0
+		page := make(map[string]bool)
+		var oldest nostr.Timestamp
+		for evt := range ch {
+			page[evt.ID] = true
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			if seen[evt.ID] {
+				continue
+			}
+			fresh++
+			if match(evt) {
+				if err := db.DeleteEvent(ctx, evt); err != nil {
+					log.Printf("Failed to delete %s: %v", evt.ID, err)
+					continue
+				}
+				deleted++
+			}
+		}
+		if fresh == 0 {
+			return deleted, nil
+		}
+		seen = page
+		until = &oldest
+	}
+}
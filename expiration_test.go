@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestExpiredEventsAreHiddenAndSwept(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	for i, expiresAt := range []nostr.Timestamp{nostr.Now() - 60, nostr.Now() + 3600, 0} {
+		evt := &nostr.Event{Kind: nostr.KindTextNote, Content: strconv.Itoa(i), CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+		if expiresAt != 0 {
+			evt.Tags = append(evt.Tags, nostr.Tag{"expiration", strconv.FormatInt(int64(expiresAt), 10)})
+		}
+		if err := evt.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(query func(context.Context, nostr.Filter) (chan *nostr.Event, error)) int {
+		ch, err := query(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	if n := count(queryUnexpired); n != 2 {
+		t.Fatalf("expected 2 unexpired events from queries, got %d", n)
+	}
+	if n := sweepExpiredEvents(ctx); n != 1 {
+		t.Fatalf("expected the sweep to delete 1 event, got %d", n)
+	}
+	if n := count(db.QueryEvents); n != 2 {
+		t.Fatalf("expected 2 events left in the store, got %d", n)
+	}
+}
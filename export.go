@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// exportPage is how many events GET /export reads per query
+const exportPage = 500
+
+// handleExport streams every stored event as newline-delimited JSON, newest first, without
+// holding more than a page in memory. kind (repeatable or comma-separated) and since (unix
+// seconds) narrow it down and gzip=true compresses the stream. The write deadline is lifted,
+// since a store with millions of events takes longer than any fixed timeout.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	filter := nostr.Filter{Limit: exportPage}
+	query := r.URL.Query()
+	for _, value := range query["kind"] {
+		for _, item := range splitList(value) {
+			kind, err := strconv.Atoi(item)
+			if err != nil {
+				http.Error(w, "kind must be an integer", http.StatusBadRequest)
+				return
+			}
+			filter.Kinds = append(filter.Kinds, kind)
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "since must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		ts := nostr.Timestamp(since)
+		filter.Since = &ts
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	var out io.Writer = w
+	flush := func() { rc.Flush() }
+	if compress, _ := strconv.ParseBool(query.Get("gzip")); compress {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="events.jsonl.gz"`)
+		gz := gzip.NewWriter(w)
+		defer func() {
+			gz.Close()
+			rc.Flush()
+		}()
+		out = gz
+		flush = func() {
+			gz.Flush()
+			rc.Flush()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	exported, err := exportEvents(r, filter, out, flush)
+	if err != nil {
+		// the 200 has usually gone out already, so all that is left is to cut the stream short
+		log.Printf("Export: stopped after %d events: %v", exported, err)
+		return
+	}
+	log.Printf("Export: streamed %d events", exported)
+}
+
+// exportEvents pages through the store from newest to oldest writing each event matching
+// filter to out as one line of JSON, and calls flush after every page. Pages overlap on
+// their oldest timestamp, as in deleteEventsWhere, and the duplicates that causes are skipped.
+func exportEvents(r *http.Request, filter nostr.Filter, out io.Writer, flush func()) (int, error) {
+	exported := 0
+	seen := make(map[string]bool)
+	encoder := json.NewEncoder(out)
+
+	for {
+		ch, err := db.QueryEvents(r.Context(), filter)
+		if err != nil {
+			return exported, err
+		}
+
+		fresh := 0
+		page := make(map[string]bool)
+		var oldest nostr.Timestamp
+		var writeErr error
+		for evt := range ch {
+			page[evt.ID] = true
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			if seen[evt.ID] || writeErr != nil {
+				continue
+			}
+			fresh++
+			if writeErr = encoder.Encode(evt); writeErr == nil {
+				exported++
+			}
+		}
+		if writeErr != nil {
+			return exported, writeErr
+		}
+		if fresh == 0 {
+			return exported, r.Context().Err()
+		}
+		flush()
+		seen = page
+		filter.Until = &oldest
+	}
+}
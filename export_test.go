@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestExportStreamsEveryEventOnce(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	// more than a page, with many events sharing each timestamp across page boundaries
+	total := exportPage*2 + 37
+	for i := 0; i < total; i++ {
+		evt := &nostr.Event{ID: fmt.Sprintf("%064x", i), Kind: 1 + i%2, CreatedAt: nostr.Timestamp(1000 + i/7)}
+		if err := db.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export := func(query string) (*httptest.ResponseRecorder, map[string]*nostr.Event) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleExport(rec, httptest.NewRequest("GET", "/export"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /export%s: expected 200, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+		var body io.Reader = rec.Body
+		if rec.Header().Get("Content-Type") == "application/gzip" {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gz
+		}
+		events := map[string]*nostr.Event{}
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			var evt nostr.Event
+			if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+				t.Fatalf("expected one event per line, got %q: %v", scanner.Text(), err)
+			}
+			if events[evt.ID] != nil {
+				t.Fatalf("event %s exported twice", evt.ID)
+			}
+			events[evt.ID] = &evt
+		}
+		return rec, events
+	}
+
+	if _, events := export(""); len(events) != total {
+		t.Fatalf("expected all %d events, got %d", total, len(events))
+	}
+
+	_, events := export("?kind=2&since=1050")
+	for _, evt := range events {
+		if evt.Kind != 2 || evt.CreatedAt < 1050 {
+			t.Fatalf("expected only kind 2 since 1050, got %+v", evt)
+		}
+	}
+	if len(events) == 0 {
+		t.Fatal("expected some kind 2 events since 1050")
+	}
+
+	rec, events := export("?gzip=true")
+	if rec.Header().Get("Content-Type") != "application/gzip" || len(events) != total {
+		t.Fatalf("expected a gzip stream of all %d events, got %q with %d", total, rec.Header().Get("Content-Type"), len(events))
+	}
+
+	rec = httptest.NewRecorder()
+	handleExport(rec, httptest.NewRequest("GET", "/export?kind=notes", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a bad kind to get 400, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// startTestRelay runs the relay in-process on an ephemeral port with an in-memory store. Its
+// membership comes from a mock .well-known/nostr.json listing members, fetched the same way
+// as in production. It returns the relay and its ws:// URL.
+func startTestRelay(t *testing.T, members ...string) (*khatru.Relay, string) {
+	t.Helper()
+	newTestDB(t)
+	fs = afero.NewMemMapFs()
+
+	wellKnown := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			http.NotFound(w, r)
+			return
+		}
+		names := make([]string, len(members))
+		for i, pubkey := range members {
+			names[i] = `"member` + string(rune('a'+i)) + `":"` + pubkey + `"`
+		}
+		w.Write([]byte(`{"names":{` + strings.Join(names, ",") + `}}`))
+	}))
+	t.Cleanup(wellKnown.Close)
+
+	config = Config{TeamDomain: "team.example", MembershipCache: "nostr-cache.json"}
+	membershipBaseURL = wellKnown.URL
+	setTeamData(NostrData{})
+	t.Cleanup(func() { setTeamData(NostrData{}); membershipBaseURL = "" })
+	if err := fetchNostrData(config.TeamDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	relay = khatru.NewRelay()
+	wireStore(relay)
+	relay.RejectEvent = append(relay.RejectEvent, rejectInvalidSignature, rejectNonMember)
+
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	return relay, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestRelayAcceptsMembersAndRejectsOthers(t *testing.T) {
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	_, url := startTestRelay(t, memberPub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted := signedEvent(t, member, nostr.KindTextNote, "hello team")
+	if err := conn.Publish(ctx, *accepted); err != nil {
+		t.Fatalf("expected the member's event to be accepted, got %v", err)
+	}
+
+	outsider := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "let me in")
+	if err := conn.Publish(ctx, *outsider); err == nil || !strings.Contains(err.Error(), "you are not part of the team") {
+		t.Fatalf("expected the random key to be rejected, got %v", err)
+	}
+
+	events, err := conn.QuerySync(ctx, nostr.Filter{Kinds: []int{nostr.KindTextNote}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != accepted.ID {
+		t.Fatalf("expected only the member's event to be stored, got %d events", len(events))
+	}
+}
+
+func TestEphemeralEventsAreBroadcastButNotStored(t *testing.T) {
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	rl, url := startTestRelay(t, memberPub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	subscriber, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	sub, err := subscriber.Subscribe(ctx, nostr.Filters{{Kinds: []int{20001}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sub.EndOfStoredEvents
+
+	publisher, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	ephemeral := signedEvent(t, member, 20001, "typing...")
+	if err := publisher.Publish(ctx, *ephemeral); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case evt := <-sub.Events:
+		if evt.ID != ephemeral.ID {
+			t.Fatalf("expected the ephemeral event, got %s", evt.ID)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the ephemeral event to reach the live subscription")
+	}
+
+	events, err := publisher.QuerySync(ctx, nostr.Filter{Kinds: []int{20001}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected ephemeral events not to be stored, got %d", len(events))
+	}
+
+	// even when handed to the store hooks directly
+	for _, store := range rl.StoreEvent {
+		if err := store(ctx, ephemeral); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := db.CountEvents(ctx, nostr.Filter{Kinds: []int{20001}}); n != 0 {
+		t.Fatalf("expected the store hooks to skip ephemeral events, got %d stored", n)
+	}
+}
+
+func TestOversizedWebsocketMessageClosesConnection(t *testing.T) {
+	rl, url := startTestRelay(t)
+	rl.MaxMessageSize = 1024
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"search":"`+strings.Repeat("a", 2048)+`"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Fatalf("expected the relay to close with 1009, got %v", err)
+		}
+		return
+	}
+}
+
+func TestIdleWebsocketIsPingedAndDeadOneReaped(t *testing.T) {
+	rl, url := startTestRelay(t)
+	rl.PingPeriod = 50 * time.Millisecond
+	rl.PongWait = 300 * time.Millisecond
+
+	alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	pings := make(chan struct{}, 100)
+	alive.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return alive.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				close(pings)
+				return
+			}
+		}
+	}()
+
+	dead, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	dead.SetPingHandler(func(string) error { return nil }) // never answers
+	dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	for {
+		if _, _, err := dead.ReadMessage(); err != nil {
+			if time.Since(start) > 3*time.Second {
+				t.Fatalf("expected the silent connection to be closed after the pong timeout, got %v", err)
+			}
+			break
+		}
+	}
+
+	// by now the answering client has been pinged several times past the pong timeout
+	count := 0
+	for range pings {
+		if count++; count == 8 {
+			return
+		}
+	}
+	t.Fatalf("expected the answering connection to stay open, it closed after %d pings", count)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"slices"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 sets server up for HTTP/2 as HTTP2_ENABLED and HTTP2_CLEARTEXT ask, once its
+// TLSConfig, if any, is in place. With TLS, h2 is offered over ALPN alongside http/1.1;
+// without it, HTTP2_CLEARTEXT accepts h2c, prior knowledge or an Upgrade: h2c, for a proxy
+// that speaks HTTP/2 to its backends. Either way websockets stay on HTTP/1.1: the HTTP/2
+// server doesn't announce extended CONNECT, so clients open a separate HTTP/1.1 connection
+// for the upgrade, which h2c passes through untouched.
+//
+// ReadTimeout and WriteTimeout apply to each HTTP/2 stream on its own, so a long upload
+// doesn't hold up the other requests multiplexed on its connection, and IdleTimeout closes
+// a connection once none are left.
+func configureHTTP2(server *http.Server) error {
+	if !config.HTTP2Enabled {
+		// a non-nil, empty TLSNextProto is what keeps net/http from enabling h2 itself
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		if server.TLSConfig != nil {
+			server.TLSConfig.NextProtos = slices.DeleteFunc(server.TLSConfig.NextProtos, func(proto string) bool {
+				return proto == http2.NextProtoTLS
+			})
+		}
+		return nil
+	}
+
+	h2 := &http2.Server{
+		MaxConcurrentStreams:     uint32(config.HTTP2MaxConcurrentStreams),
+		MaxUploadBufferPerStream: int32(config.HTTP2MaxUploadBuffer),
+	}
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return err
+	}
+	if config.HTTP2Cleartext {
+		server.Handler = h2c.NewHandler(server.Handler, h2)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2CleartextKeepsWebsocketsOnHTTP1(t *testing.T) {
+	config = Config{HTTP2Enabled: true, HTTP2Cleartext: true, HTTP2MaxConcurrentStreams: 10, HTTP2MaxUploadBuffer: 1 << 20}
+	var gotProto, gotUpgrade string
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProto, gotUpgrade = r.Proto, r.Header.Get("Upgrade")
+	})}
+	if err := configureHTTP2(server); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(server.Handler)
+	ts.Start()
+	defer ts.Close()
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := h2c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotProto != "HTTP/2.0" {
+		t.Fatalf("expected an h2c request to be served over HTTP/2, got %s", gotProto)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotProto != "HTTP/1.1" || gotUpgrade != "websocket" {
+		t.Fatalf("expected the websocket upgrade to reach the handler over HTTP/1.1, got %s with Upgrade %q", gotProto, gotUpgrade)
+	}
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	config = Config{}
+	server := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}}}
+	if err := configureHTTP2(server); err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSNextProto == nil || len(server.TLSNextProto) != 0 {
+		t.Fatalf("expected an empty TLSNextProto to keep net/http from enabling h2, got %v", server.TLSNextProto)
+	}
+	if slices.Contains(server.TLSConfig.NextProtos, "h2") || !slices.Contains(server.TLSConfig.NextProtos, "acme-tls/1") {
+		t.Fatalf("expected only h2 to be dropped from ALPN, got %v", server.TLSConfig.NextProtos)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// outbound HTTP clients, set up in LoadConfig from HTTP_CONNECT_TIMEOUT / HTTP_READ_TIMEOUT
+var (
+	// membershipClient fetches the small nostr.json document, so it bounds the whole request
+	membershipClient = http.DefaultClient
+	// mirrorClient downloads blobs of up to maxBlobSize: it bounds connecting and waiting for
+	// the response headers, while the body transfer is bounded by the caller's context
+	mirrorClient = http.DefaultClient
+	// moderationClient calls MODERATION_URL and bounds the whole request by MODERATION_TIMEOUT
+	moderationClient = http.DefaultClient
+)
+
+func newHTTPClients(connectTimeout time.Duration, readTimeout time.Duration, moderationTimeout time.Duration) {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+	}
+
+	// mirror sources are chosen by clients, so that transport refuses to dial private addresses.
+	// It never goes through a proxy, which would leave the check looking at the proxy's address
+	// instead of the source's.
+	mirrorTransport := transport.Clone()
+	mirrorTransport.Proxy = nil
+	mirrorTransport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second, Control: mirrorDialControl}).DialContext
+
+	membershipClient = &http.Client{Transport: transport, Timeout: connectTimeout + readTimeout}
+	mirrorClient = &http.Client{Transport: mirrorTransport, CheckRedirect: checkMirrorRedirect}
+	moderationClient = &http.Client{Transport: transport, Timeout: moderationTimeout}
+}
+
+// isTimeout reports whether err came from one of the client timeouts or a context deadline
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// runImport backfills events from another relay: swarm import -source wss://old.relay [flags]
+//
+// Events are fed through relay.AddEvent, so the same membership and policy checks apply as
+// for websocket clients. The source is paged backwards from -until down to -since; at the
+// end the newest timestamp seen is printed so a later run can resume with -since.
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	source := flags.String("source", "", "relay URL to import events from")
+	kinds := flags.String("kinds", "", "comma-separated kinds to import (default: all)")
+	authors := flags.String("authors", "", "comma-separated hex pubkeys to import (default: team members)")
+	since := flags.Int64("since", 0, "only import events created at or after this unix timestamp")
+	until := flags.Int64("until", 0, "only import events created at or before this unix timestamp")
+	pageSize := flags.Int("page", 500, "events to request per page")
+	rate := flags.Int("rate", 50, "maximum events to store per second")
+	flags.Parse(args)
+
+	if *source == "" {
+		log.Fatalf("import: -source is required")
+	}
+
+	filter := nostr.Filter{Limit: *pageSize}
+	for _, k := range splitList(*kinds) {
+		kind, err := strconv.Atoi(k)
+		if err != nil {
+			log.Fatalf("import: invalid kind %q", k)
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+	filter.Authors = splitList(*authors)
+	if len(filter.Authors) == 0 {
+		for _, pubkey := range teamData().Names {
+			filter.Authors = append(filter.Authors, pubkey)
+		}
+		if len(filter.Authors) == 0 {
+			log.Fatalf("import: no team members loaded and no -authors given")
+		}
+	}
+	if *since > 0 {
+		ts := nostr.Timestamp(*since)
+		filter.Since = &ts
+	}
+	if *until > 0 {
+		ts := nostr.Timestamp(*until)
+		filter.Until = &ts
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	src, err := nostr.RelayConnect(ctx, *source)
+	if err != nil {
+		log.Fatalf("import: failed to connect to %s: %v", *source, err)
+	}
+	defer src.Close()
+
+	throttle := time.NewTicker(time.Second / time.Duration(max(*rate, 1)))
+	defer throttle.Stop()
+
+	var imported, rejected int
+	var newest nostr.Timestamp
+	for ctx.Err() == nil {
+		sub, err := src.Subscribe(ctx, nostr.Filters{filter})
+		if err != nil {
+			log.Fatalf("import: failed to subscribe: %v", err)
+		}
+
+		received := 0
+		oldest := nostr.Timestamp(0)
+	page:
+		for {
+			select {
+			case evt, ok := <-sub.Events:
+				if !ok {
+					break page
+				}
+				received++
+				if oldest == 0 || evt.CreatedAt < oldest {
+					oldest = evt.CreatedAt
+				}
+				if evt.CreatedAt > newest {
+					newest = evt.CreatedAt
+				}
+
+				select {
+				case <-throttle.C:
+				case <-ctx.Done():
+					break page
+				}
+				if _, err := relay.AddEvent(ctx, evt); err != nil {
+					rejected++
+					log.Printf("import: skipped %s: %v", evt.ID, err)
+					continue
+				}
+				imported++
+			case <-sub.EndOfStoredEvents:
+				break page
+			case <-ctx.Done():
+				break page
+			}
+		}
+		sub.Unsub()
+
+		log.Printf("import: page done, %d received, %d imported, %d rejected so far", received, imported, rejected)
+		if received == 0 || (filter.Since != nil && oldest <= *filter.Since) {
+			break
+		}
+		next := oldest - 1
+		filter.Until = &next
+	}
+
+	log.Printf("import: finished with %d imported, %d rejected", imported, rejected)
+	if newest > 0 {
+		log.Printf("import: resume later with -since %d", newest)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// kindRateLimitPrefix starts the env vars that override RATE_LIMIT_DEFAULT for one kind, e.g.
+// RATE_LIMIT_KIND_7=60
+const kindRateLimitPrefix = "RATE_LIMIT_KIND_"
+
+// maxKindRateBuckets bounds how many author and kind pairs are tracked at once
+const maxKindRateBuckets = 100000
+
+// kindRateLimited counts events refused by kindRateLimiter, reported by /admin/status
+var kindRateLimited atomic.Int64
+
+// getEnvKindRates collects every non-empty RATE_LIMIT_KIND_<kind> variable into a map from
+// kind to events per minute
+func getEnvKindRates() map[int]int {
+	rates := map[int]int{}
+	for kind, key := range getEnvKindVars(kindRateLimitPrefix) {
+		rates[kind] = getEnvInt(key, 0)
+	}
+	return rates
+}
+
+// kindRateLimiter gives every author a token bucket per kind, refilling at the kind's rate
+// per minute and holding up to a minute's worth. A bucket left alone long enough to refill
+// completely is no different from a new one, so those are evicted whenever the limiter
+// fills up.
+type kindRateLimiter struct {
+	mu       sync.Mutex
+	fallback int
+	perKind  map[int]int
+	limit    int
+	buckets  map[kindRateKey]*tokenBucket
+}
+
+type kindRateKey struct {
+	pubkey string
+	kind   int
+}
+
+func newKindRateLimiter(fallback int, perKind map[int]int, limit int) *kindRateLimiter {
+	return &kindRateLimiter{fallback: fallback, perKind: perKind, limit: limit, buckets: make(map[kindRateKey]*tokenBucket)}
+}
+
+// rate is the events per minute allowed for kind, 0 meaning unlimited
+func (kl *kindRateLimiter) rate(kind int) int {
+	if rate, ok := kl.perKind[kind]; ok {
+		return rate
+	}
+	return kl.fallback
+}
+
+// allow reports whether pubkey may publish another event of kind right now
+func (kl *kindRateLimiter) allow(pubkey string, kind int) bool {
+	rate := kl.rate(kind)
+	if rate <= 0 {
+		return true
+	}
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	key := kindRateKey{pubkey, kind}
+	bucket, ok := kl.buckets[key]
+	if !ok {
+		if len(kl.buckets) >= kl.limit {
+			kl.evictIdle()
+		}
+		if len(kl.buckets) >= kl.limit {
+			return false
+		}
+		bucket = newTokenBucket(float64(rate)/60, float64(rate))
+		kl.buckets[key] = bucket
+	}
+	return bucket.allow()
+}
+
+// evictIdle drops every bucket that has had time to refill completely
+func (kl *kindRateLimiter) evictIdle() {
+	now := time.Now()
+	for key, bucket := range kl.buckets {
+		if now.Sub(bucket.last).Seconds()*bucket.rate+bucket.tokens >= bucket.burst {
+			delete(kl.buckets, key)
+		}
+	}
+}
+
+// rejectEvent is the RejectEvent policy. The relay's own key is never limited.
+func (kl *kindRateLimiter) rejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if isRelayPubkey(event.PubKey) || kl.allow(event.PubKey, event.Kind) {
+		return false, ""
+	}
+	kindRateLimited.Add(1)
+	return true, fmt.Sprintf(prefixRateLimited+"at most %d kind %d events per minute", kl.rate(event.Kind), event.Kind)
+}
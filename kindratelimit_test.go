@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKindRateLimitOverridesDefault(t *testing.T) {
+	t.Setenv("RATE_LIMIT_KIND_7", "3")
+	t.Setenv("RATE_LIMIT_KIND_30023", "0")
+	t.Setenv("RATE_LIMIT_KIND_1", "")
+	rates := getEnvKindRates()
+	if len(rates) != 2 || rates[7] != 3 || rates[30023] != 0 {
+		t.Fatalf("expected overrides for kinds 7 and 30023, got %v", rates)
+	}
+
+	limiter := newKindRateLimiter(1, rates, maxKindRateBuckets)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	publish := func(kind int) (bool, string) {
+		return limiter.rejectEvent(ctx, signedEvent(t, sk, kind, "hello"))
+	}
+
+	if reject, msg := publish(1); reject {
+		t.Fatalf("expected the first note to pass, got %q", msg)
+	}
+	if reject, msg := publish(1); !reject || !strings.HasPrefix(msg, "rate-limited: at most 1 kind 1 events") {
+		t.Fatalf("expected the default limit to apply to kind 1, got %v %q", reject, msg)
+	}
+	for i := 0; i < 3; i++ {
+		if reject, msg := publish(7); reject {
+			t.Fatalf("reaction %d: expected RATE_LIMIT_KIND_7 to allow 3, got %q", i, msg)
+		}
+	}
+	if reject, _ := publish(7); !reject {
+		t.Fatal("expected the fourth reaction to be limited")
+	}
+	for i := 0; i < 5; i++ {
+		if reject, msg := publish(30023); reject {
+			t.Fatalf("expected kind 30023 to be unlimited, got %q", msg)
+		}
+	}
+
+	// limits are per author
+	if reject, msg := limiter.rejectEvent(ctx, signedEvent(t, nostr.GeneratePrivateKey(), 1, "hi")); reject {
+		t.Fatalf("expected another author's note to pass, got %q", msg)
+	}
+}
+
+func TestKindRateLimiterEvictsIdleBuckets(t *testing.T) {
+	limiter := newKindRateLimiter(60, nil, 2)
+	if !limiter.allow("alice", 1) || !limiter.allow("bob", 1) {
+		t.Fatal("expected the first events to pass")
+	}
+	// both buckets still owe a token, so there is no room for a third author
+	if limiter.allow("carol", 1) {
+		t.Fatal("expected a full limiter to refuse new authors")
+	}
+
+	// a bucket that has refilled is as good as forgotten
+	limiter.buckets[kindRateKey{"alice", 1}].tokens = 60
+	if !limiter.allow("carol", 1) {
+		t.Fatal("expected the idle bucket to be evicted for a new author")
+	}
+	if _, ok := limiter.buckets[kindRateKey{"alice", 1}]; ok {
+		t.Fatal("expected alice's idle bucket to be gone")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// landingPage is what a browser gets at GET / unless LANDING_PAGE_FILE replaces it
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+<p>This is a <a href="https://nostr.com">nostr</a> relay. Point a nostr client at <code>{{.URL}}</code> to use it.</p>
+{{if .PubKey}}<p>Operator: <code>{{.PubKey}}</code></p>{{end}}
+{{if .Contact}}<p>Contact: {{.Contact}}</p>{{end}}
+</body>
+</html>
+`))
+
+// withLandingPage answers GET and HEAD / for anything but a websocket upgrade: with the NIP-11
+// document for clients that accept application/nostr+json, the same document as plain JSON
+// for ones asking for application/json, and the HTML page, or LANDING_PAGE_FILE, otherwise.
+// khatru itself only recognizes an Accept header that is exactly application/nostr+json and
+// otherwise leaves / to the router, which has nothing there.
+func withLandingPage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || r.Header.Get("Upgrade") == "websocket" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accept := r.Header.Get("Accept")
+		switch {
+		case strings.Contains(accept, "application/nostr+json"):
+			relay.HandleNIP11(w, r)
+		case strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html"):
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(relay.Info)
+		case config.LandingPageFile != "":
+			serveLandingPageFile(w)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			landingPage.Execute(w, struct {
+				Name, Description, PubKey, Contact, URL string
+			}{relay.Info.Name, relay.Info.Description, relay.Info.PubKey, relay.Info.Contact, relayWebsocketURL(r)})
+		}
+	})
+}
+
+func serveLandingPageFile(w http.ResponseWriter) {
+	body, err := afero.ReadFile(fs, config.LandingPageFile)
+	if err != nil {
+		log.Printf("Failed to read LANDING_PAGE_FILE %s: %v", config.LandingPageFile, err)
+		http.Error(w, "Landing page unavailable", http.StatusInternalServerError)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(config.LandingPageFile))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// relayWebsocketURL is RELAY_URL, or the ws(s):// form of the URL the page was requested on
+func relayWebsocketURL(r *http.Request) string {
+	if config.RelayURL != "" {
+		return config.RelayURL
+	}
+	url := strings.TrimSuffix(requestURL(r), r.URL.RequestURI())
+	if rest, ok := strings.CutPrefix(url, "https://"); ok {
+		return "wss://" + rest
+	}
+	return "ws://" + strings.TrimPrefix(url, "http://")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/spf13/afero"
+)
+
+func TestLandingPage(t *testing.T) {
+	previous := relay
+	t.Cleanup(func() { relay = previous })
+	relay = khatru.NewRelay()
+	relay.Info.Name = "Swarm Test"
+	relay.Info.Description = "a team relay"
+	fs = afero.NewMemMapFs()
+	config = Config{}
+	reachedRouter := false
+	handler := withLandingPage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reachedRouter = true }))
+	get := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/", "text/html,application/xhtml+xml,*/*;q=0.8")
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(rec.Body.String(), "Swarm Test") || !strings.Contains(rec.Body.String(), "ws://example.com") {
+		t.Fatalf("expected the HTML landing page, got %q: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	rec = get("/", "application/nostr+json, text/plain")
+	if rec.Header().Get("Content-Type") != "application/nostr+json" || !strings.Contains(rec.Body.String(), `"name":"Swarm Test"`) {
+		t.Fatalf("expected the NIP-11 document, got %q: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	rec = get("/", "application/json")
+	if rec.Header().Get("Content-Type") != "application/json" || !strings.Contains(rec.Body.String(), `"description":"a team relay"`) {
+		t.Fatalf("expected the relay info as JSON, got %q: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	config.LandingPageFile = "landing.html"
+	afero.WriteFile(fs, "landing.html", []byte("<h1>custom</h1>"), 0644)
+	if rec = get("/", "text/html"); rec.Body.String() != "<h1>custom</h1>" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("expected LANDING_PAGE_FILE to be served, got %q: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	if get("/list/abc", "text/html"); !reachedRouter {
+		t.Fatal("expected other paths to reach the router")
+	}
+}
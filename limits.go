@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subscriptionLimiter enforces MAX_SUBS_PER_CONN and MAX_FILTERS_PER_SUB from RejectFilter,
+// which khatru calls once per filter of every REQ. It goes last among the RejectFilter
+// policies, so a filter they refuse never takes a slot.
+//
+// A connection's subscriptions are the distinct ids it has opened and not closed since
+// connecting; re-sending a REQ with an id it already has open doesn't count again. khatru
+// has no hook for CLOSE, so withSubscriptionTracking watches for them on the connection, and
+// MAX_SUBS_PER_CONN is only enforced on connections that went through it.
+type subscriptionLimiter struct {
+	maxSubs    int
+	maxFilters int
+
+	filters sync.Map // REQ context Done channel -> *atomic.Int32
+}
+
+// connSubscriptions are the subscription ids a connection has open
+type connSubscriptions struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func (cs *connSubscriptions) release(id string) {
+	cs.mu.Lock()
+	delete(cs.ids, id)
+	cs.mu.Unlock()
+}
+
+type connSubscriptionsKey struct{}
+
+// subscriptionsOf returns the open subscriptions withSubscriptionTracking keeps for the
+// connection a REQ came in on, or nil when it isn't tracked
+func subscriptionsOf(ctx context.Context) *connSubscriptions {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil || ws.Request == nil {
+		return nil
+	}
+	subs, _ := ws.Request.Context().Value(connSubscriptionsKey{}).(*connSubscriptions)
+	return subs
+}
+
+func newSubscriptionLimiter(maxSubs int, maxFilters int) *subscriptionLimiter {
+	return &subscriptionLimiter{maxSubs: maxSubs, maxFilters: maxFilters}
+}
+
+func (sl *subscriptionLimiter) rejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if sl.maxFilters > 0 {
+		// every filter of one REQ shares the same request context
+		value, loaded := sl.filters.LoadOrStore(ctx.Done(), new(atomic.Int32))
+		if !loaded {
+			go func() {
+				<-ctx.Done()
+				sl.filters.Delete(ctx.Done())
+			}()
+		}
+		if value.(*atomic.Int32).Add(1) > int32(sl.maxFilters) {
+			// the whole REQ is closed, so it shouldn't use up a subscription slot
+			sl.forget(ctx)
+			return true, fmt.Sprintf(prefixBlocked+"too many filters in one subscription (max %d)", sl.maxFilters)
+		}
+	}
+
+	if subs := subscriptionsOf(ctx); sl.maxSubs > 0 && subs != nil {
+		id := khatru.GetSubscriptionID(ctx)
+		subs.mu.Lock()
+		defer subs.mu.Unlock()
+		if _, ok := subs.ids[id]; !ok {
+			if len(subs.ids) >= sl.maxSubs {
+				return true, fmt.Sprintf(prefixBlocked+"too many subscriptions on this connection (max %d)", sl.maxSubs)
+			}
+			subs.ids[id] = struct{}{}
+			go releaseIfRejected(ctx, subs, id)
+		}
+	}
+
+	return false, ""
+}
+
+// releaseIfRejected gives back the slot a REQ took if another of its filters is refused after
+// this one got through. khatru then answers with CLOSED and ends the REQ's context with the
+// rejection as its cause, rather than the plain cancellation of EOSE or a disconnect, and the
+// client has no reason to send a CLOSE for it.
+func releaseIfRejected(ctx context.Context, subs *connSubscriptions, id string) {
+	<-ctx.Done()
+	if !errors.Is(context.Cause(ctx), context.Canceled) {
+		subs.release(id)
+	}
+}
+
+func (sl *subscriptionLimiter) forget(ctx context.Context) {
+	if subs := subscriptionsOf(ctx); subs != nil {
+		subs.release(khatru.GetSubscriptionID(ctx))
+	}
+}
+
+// wsCloseMessageMax is as much of a message as is kept to read a CLOSE from, room for
+// ["CLOSE",...] around the longest subscription id NIP-01 allows, 64 characters
+const wsCloseMessageMax = 128
+
+// withSubscriptionTracking gives each websocket the record of open subscriptions that
+// MAX_SUBS_PER_CONN counts against, and releases a subscription's id as soon as a CLOSE for
+// it is read off the connection, before khatru handles it. A REQ closed again before khatru
+// got to it keeps its id until the connection ends, which clients that wait for EOSE or
+// CLOSED don't run into.
+func withSubscriptionTracking(next http.Handler) http.Handler {
+	if config.MaxSubsPerConn <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subs := &connSubscriptions{ids: make(map[string]struct{})}
+		r = r.WithContext(context.WithValue(r.Context(), connSubscriptionsKey{}, subs))
+		next.ServeHTTP(&subscriptionTrackingWriter{ResponseWriter: w, subs: subs}, r)
+	})
+}
+
+// subscriptionTrackingWriter hands the websocket upgrade a subscriptionTrackingConn
+type subscriptionTrackingWriter struct {
+	http.ResponseWriter
+	subs *connSubscriptions
+}
+
+func (sw *subscriptionTrackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracked := &subscriptionTrackingConn{
+		Conn:   conn,
+		reader: brw.Reader, // may already hold bytes read past the request
+		subs:   sw.subs,
+		frames: wsFrameScanner{keep: wsCloseMessageMax},
+	}
+	return tracked, bufio.NewReadWriter(bufio.NewReader(tracked), brw.Writer), nil
+}
+
+// subscriptionTrackingConn follows the websocket frames read from a client for CLOSE messages
+type subscriptionTrackingConn struct {
+	net.Conn
+	reader *bufio.Reader
+	subs   *connSubscriptions
+	frames wsFrameScanner
+}
+
+func (c *subscriptionTrackingConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.frames.messages(p[:n], func(start []byte) {
+		if id, ok := closedSubscription(start); ok {
+			c.subs.release(id)
+		}
+	})
+	return n, err
+}
+
+// closedSubscription returns the subscription id of a whole ["CLOSE", <id>] message
+func closedSubscription(message []byte) (string, bool) {
+	var env []string
+	if err := json.Unmarshal(message, &env); err != nil || len(env) != 2 || env[0] != "CLOSE" {
+		return "", false
+	}
+	return env[1], true
+}
+
+// capQueryLimit gives every filter passed to next a limit: defaultLimit when it has none, and
+// at most max, so a missing or oversized limit can't make the backend read everything that
+// matches. Results keep streaming through the returned channel either way. defaultLimit <= 0
+// gives limitless filters the max instead, and max <= 0 disables the ceiling. An explicit
+// "limit": 0, which asks for no stored events at all, is left alone.
+func capQueryLimit(defaultLimit int, max int, next func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	if max > 0 && (defaultLimit <= 0 || defaultLimit > max) {
+		defaultLimit = max
+	}
+	if defaultLimit <= 0 {
+		return next
+	}
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		switch {
+		case filter.LimitZero:
+		case filter.Limit <= 0:
+			filter.Limit = defaultLimit
+		case max > 0 && filter.Limit > max:
+			filter.Limit = max
+		}
+		return next(ctx, filter)
+	}
+}
+
+// rejectWideTimeRange enforces MAX_QUERY_TIME_RANGE: a filter whose since to until spans more
+// than max is refused rather than left to scan that much history. A missing until counts from
+// now, and a missing since from the beginning of time. Filters that are bounded some other
+// way are let through whatever their range, with or without a since: by ids, which are
+// looked up directly, by authors, which keeps profile and relay list lookups working, or by
+// a limit. Kinds alone don't bound anything.
+func rejectWideTimeRange(max time.Duration) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if len(filter.IDs) > 0 || len(filter.Authors) > 0 || filter.Limit > 0 {
+			return false, ""
+		}
+		until := nostr.Now()
+		if filter.Until != nil {
+			until = *filter.Until
+		}
+		var since nostr.Timestamp
+		if filter.Since != nil && *filter.Since > 0 {
+			since = *filter.Since
+		}
+		// in seconds, since a span of decades overflows a time.Duration
+		if int64(until)-int64(since) > int64(max/time.Second) {
+			return true, fmt.Sprintf(prefixBlocked+"filter time range is over %s, narrow it with since and until", max)
+		}
+		return false, ""
+	}
+}
+
+// rejectOversizedTags enforces MAX_EVENT_TAGS, MAX_TAG_VALUE_BYTES and MAX_TOTAL_TAG_BYTES, so
+// events can't carry whole files inside their tags. The total counts every tag element,
+// names included.
+func rejectOversizedTags(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if config.MaxEventTags > 0 && len(event.Tags) > config.MaxEventTags {
+		return true, fmt.Sprintf(prefixInvalid+"too many tags (max %d)", config.MaxEventTags)
+	}
+
+	total := 0
+	for _, tag := range event.Tags {
+		for i, value := range tag {
+			if i > 0 && config.MaxTagValueBytes > 0 && len(value) > config.MaxTagValueBytes {
+				return true, fmt.Sprintf(prefixInvalid+"%q tag value is %d bytes (max %d)", tag[0], len(value), config.MaxTagValueBytes)
+			}
+			total += len(value)
+		}
+	}
+	if config.MaxTotalTagBytes > 0 && total > config.MaxTotalTagBytes {
+		return true, fmt.Sprintf(prefixInvalid+"tags total %d bytes (max %d)", total, config.MaxTotalTagBytes)
+	}
+	return false, ""
+}
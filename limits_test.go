@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// expectClosed waits for the subscription to be closed by the relay and returns the reason,
+// or "" if it reached EOSE instead
+func expectClosed(t *testing.T, sub *nostr.Subscription) string {
+	t.Helper()
+	select {
+	case reason := <-sub.ClosedReason:
+		return reason
+	case <-sub.EndOfStoredEvents:
+		return ""
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for EOSE or CLOSED")
+		return ""
+	}
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	newTestDB(t)
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	rl.RejectFilter = append(rl.RejectFilter, newSubscriptionLimiter(2, 2).rejectFilter)
+	config = Config{MaxSubsPerConn: 2}
+	server := httptest.NewServer(withSubscriptionTracking(rl))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	kinds := func(k int) nostr.Filter { return nostr.Filter{Kinds: []int{k}} }
+
+	sub, err := conn.Subscribe(ctx, nostr.Filters{kinds(1), kinds(2), kinds(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := expectClosed(t, sub); !strings.HasPrefix(reason, "blocked: too many filters") {
+		t.Fatalf("expected too many filters, got %q", reason)
+	}
+
+	for i := 0; i < 2; i++ {
+		sub, err := conn.Subscribe(ctx, nostr.Filters{kinds(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := expectClosed(t, sub); reason != "" {
+			t.Fatalf("subscription %d unexpectedly closed: %q", i, reason)
+		}
+	}
+
+	sub, err = conn.Subscribe(ctx, nostr.Filters{kinds(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := expectClosed(t, sub); !strings.HasPrefix(reason, "blocked: too many subscriptions") {
+		t.Fatalf("expected too many subscriptions, got %q", reason)
+	}
+}
+
+func TestClosedSubscriptionsAreReleased(t *testing.T) {
+	newTestDB(t)
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	rl.RejectFilter = append(rl.RejectFilter, newSubscriptionLimiter(2, 0).rejectFilter)
+	config = Config{MaxSubsPerConn: 2}
+	server := httptest.NewServer(withSubscriptionTracking(rl))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a client rotating subscription ids never has more than one open
+	for i := 0; i < 5; i++ {
+		sub, err := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := expectClosed(t, sub); reason != "" {
+			t.Fatalf("subscription %d refused after the earlier ones were closed: %q", i, reason)
+		}
+		sub.Unsub()
+	}
+
+	// khatru handles messages concurrently, so each REQ is answered before the next is sent
+	for i, want := range []string{"", "", "blocked: too many subscriptions"} {
+		sub, err := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := expectClosed(t, sub); !strings.HasPrefix(reason, want) || (want == "" && reason != "") {
+			t.Fatalf("open subscription %d: expected %q, got %q", i+1, want, reason)
+		}
+	}
+}
+
+func TestRejectedSubscriptionsAreReleased(t *testing.T) {
+	newTestDB(t)
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	rejectKind2 := func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		return len(filter.Kinds) == 1 && filter.Kinds[0] == 2, "blocked: no kind 2"
+	}
+	// in front of the limiter as in main, so it refuses the second filter after the first took a slot
+	rl.RejectFilter = append(rl.RejectFilter, rejectKind2, newSubscriptionLimiter(1, 0).rejectFilter)
+	config = Config{MaxSubsPerConn: 1}
+	subsOf := make(chan *connSubscriptions, 1)
+	server := httptest.NewServer(withSubscriptionTracking(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subsOf <- r.Context().Value(connSubscriptionsKey{}).(*connSubscriptions)
+		rl.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	subs := <-subsOf
+
+	for i := 0; i < 3; i++ {
+		sub, err := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{2}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := expectClosed(t, sub); reason != "blocked: no kind 2" {
+			t.Fatalf("REQ %d: expected the second filter to be refused, got %q", i+1, reason)
+		}
+		// khatru writes CLOSED before it ends the REQ's context
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			subs.mu.Lock()
+			open := len(subs.ids)
+			subs.mu.Unlock()
+			if open == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("REQ %d: expected the refused subscription's slot back, %d still taken", i+1, open)
+			}
+		}
+	}
+
+	sub, err := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := expectClosed(t, sub); reason != "" {
+		t.Fatalf("expected a subscription after only refused ones, got %q", reason)
+	}
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	if len(subs.ids) != 1 {
+		t.Fatalf("expected the open subscription to keep its slot after EOSE, got %d", len(subs.ids))
+	}
+}
+
+func TestClosedSubscriptionIsParsed(t *testing.T) {
+	for message, want := range map[string]string{
+		`["CLOSE","sub:1"]`:   "sub:1",
+		` [ "CLOSE" , "x" ] `: "x",
+		`["REQ","sub:1",{}]`:  "",
+		`["CLOSE"]`:           "",
+		`["CLOSE","a","b"]`:   "",
+		`["CLOSE","truncated`: "",
+	} {
+		if id, ok := closedSubscription([]byte(message)); id != want || ok != (want != "") {
+			t.Errorf("%s: expected %q, got %q %v", message, want, id, ok)
+		}
+	}
+}
+
+func TestQueryLimitIsCapped(t *testing.T) {
+	newTestDB(t)
+	config = Config{MaxQueryLimit: 3}
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 5; i++ {
+		evt := signedEvent(t, sk, nostr.KindTextNote, fmt.Sprintf("note %d", i))
+		if _, err := rl.AddEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for limit, want := range map[int]int{0: 3, 2: 2, 1000: 3} {
+		ch, err := rl.QueryEvents[0](ctx, nostr.Filter{Kinds: []int{nostr.KindTextNote}, Limit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := 0
+		for range ch {
+			got++
+		}
+		if got != want {
+			t.Fatalf("limit %d: expected %d events, got %d", limit, want, got)
+		}
+	}
+}
+
+func TestOversizedTagsAreRejected(t *testing.T) {
+	config = Config{MaxTagValueBytes: 100, MaxTotalTagBytes: 300}
+	ctx := context.Background()
+
+	evt := &nostr.Event{Tags: nostr.Tags{{"t", "small"}, {"alt", strings.Repeat("a", 100)}}}
+	if reject, msg := rejectOversizedTags(ctx, evt); reject {
+		t.Fatalf("tags within the limits were rejected: %s", msg)
+	}
+
+	evt = &nostr.Event{Tags: nostr.Tags{{"t", "small"}, {"blob", strings.Repeat("a", 101)}}}
+	if reject, msg := rejectOversizedTags(ctx, evt); !reject || !strings.Contains(msg, `"blob" tag value`) {
+		t.Fatalf("expected the oversized tag value to be rejected, got %v %q", reject, msg)
+	}
+
+	// each value fits, but together they don't
+	evt = &nostr.Event{}
+	for i := 0; i < 4; i++ {
+		evt.Tags = append(evt.Tags, nostr.Tag{"r", strings.Repeat("b", 90)})
+	}
+	if reject, msg := rejectOversizedTags(ctx, evt); !reject || !strings.Contains(msg, "tags total 364 bytes") {
+		t.Fatalf("expected too many cumulative tag bytes to be rejected, got %v %q", reject, msg)
+	}
+}
+
+func TestDefaultQueryLimit(t *testing.T) {
+	var got nostr.Filter
+	query := capQueryLimit(2, 4, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		got = filter
+		return nil, nil
+	})
+
+	for limit, want := range map[int]int{0: 2, 3: 3, 1000: 4} {
+		query(context.Background(), nostr.Filter{Limit: limit})
+		if got.Limit != want {
+			t.Errorf("limit %d: expected %d, got %d", limit, want, got.Limit)
+		}
+	}
+
+	query(context.Background(), nostr.Filter{LimitZero: true})
+	if got.Limit != 0 || !got.LimitZero {
+		t.Errorf("expected an explicit limit 0 to be kept, got %d", got.Limit)
+	}
+}
+
+func TestWideTimeRangeIsRejected(t *testing.T) {
+	reject := rejectWideTimeRange(24 * time.Hour)
+	ctx := context.Background()
+	now := nostr.Now()
+	hoursAgo := func(h int) *nostr.Timestamp {
+		ts := now - nostr.Timestamp(h*60*60)
+		return &ts
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter nostr.Filter
+		reject bool
+	}{
+		{"recent", nostr.Filter{Kinds: []int{1}, Since: hoursAgo(23)}, false},
+		{"old but narrow", nostr.Filter{Since: hoursAgo(1000), Until: hoursAgo(990)}, false},
+		{"too wide", nostr.Filter{Since: hoursAgo(30), Until: hoursAgo(1)}, true},
+		{"explicit since of 0", nostr.Filter{Kinds: []int{1}, Since: new(nostr.Timestamp)}, true},
+		{"hugely negative since", nostr.Filter{Kinds: []int{1}, Since: hoursAgo(1 << 40)}, true},
+		{"kinds alone without since", nostr.Filter{Kinds: []int{1}}, true},
+		{"profile lookup without since", nostr.Filter{Authors: []string{"abc"}, Kinds: []int{0}}, false},
+		{"relay lists without since", nostr.Filter{Authors: []string{"abc"}, Kinds: []int{10002}}, false},
+		{"authors with a wide since", nostr.Filter{Authors: []string{"abc"}, Since: hoursAgo(48)}, false},
+		{"limited without since", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}, Limit: 20}, false},
+		{"limited with a wide since", nostr.Filter{Kinds: []int{1}, Since: hoursAgo(48), Limit: 20}, false},
+		{"no since and nothing else", nostr.Filter{Tags: nostr.TagMap{"t": {"nostr"}}}, true},
+		{"no bounds", nostr.Filter{}, true},
+		{"by id", nostr.Filter{IDs: []string{"abc"}}, false},
+	} {
+		rejected, msg := reject(ctx, tc.filter)
+		if rejected != tc.reject {
+			t.Errorf("%s: expected reject %v, got %v %q", tc.name, tc.reject, rejected, msg)
+		}
+		if rejected && !strings.HasPrefix(msg, prefixBlocked) {
+			t.Errorf("%s: expected a blocked: reason, got %q", tc.name, msg)
+		}
+	}
+}
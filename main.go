@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +17,8 @@ import (
 	"github.com/fiatjaf/khatru/blossom"
 	"github.com/joho/godotenv"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/spf13/afero"
 )
 
@@ -39,6 +37,125 @@ type Config struct {
 	BlossomEnabled   bool
 	BlossomPath      *string
 	BlossomURL       *string
+	BlossomPublicURL string
+	RequireProfile   bool
+	RequireAuthRead  bool
+	PublicReadKinds  []int
+	RequireRelayHint bool
+	RejectMalformed  bool
+	MembershipPolicy string
+	RelayURL         string
+	LandingPageFile  string
+	AdminPubkeys     []string
+	AdminIndex       bool
+	PprofEnabled     bool
+	CORSOrigins      []string
+
+	HTTPCompression         bool
+	HTTPCompressionMinBytes int
+
+	MembershipCache        string
+	MembershipRefresh      time.Duration
+	MembershipMaxStaleness time.Duration
+	MembershipStaleUnready bool
+
+	WOTEnabled    bool
+	WOTDepth      int
+	WOTMaxPubkeys int
+
+	HTTPConnectTimeout time.Duration
+	HTTPReadTimeout    time.Duration
+
+	MirrorAllowedHosts []string
+	MirrorAllowPrivate bool
+
+	ListenAddr        string
+	TLSCertFile       *string
+	TLSKeyFile        *string
+	TLSAutocertDomain *string
+	TLSAutocertCache  string
+
+	TrustForwardedHeaders bool
+
+	HTTP2Enabled              bool
+	HTTP2Cleartext            bool
+	HTTP2MaxConcurrentStreams int
+	HTTP2MaxUploadBuffer      int
+
+	BlossomAllowedExts []string
+	BlossomBlockedExts []string
+	BlossomShardDepth  int
+
+	BlossomUploadAuth   string
+	BlossomDownloadAuth string
+
+	MediaEnabled      bool
+	MediaMaxDimension int
+	MediaFormats      []string
+
+	MaxConcurrentUploads int
+	MaxBlobCount         int
+	UploadAuthMaxAge     time.Duration
+	PartialUploadTimeout time.Duration
+	BlossomTTL           time.Duration
+	BlossomTTLSweep      time.Duration
+	BlossomTTLKeepRefs   bool
+	StorageStatsCache    time.Duration
+	StorageStatsTop      int
+
+	ExpirationSweep time.Duration
+	KindRetention   map[int]time.Duration
+	RetentionSweep  time.Duration
+
+	MaxWSMessageBytes int
+	MaxConnections    int
+	WSPingInterval    time.Duration
+	WSPongTimeout     time.Duration
+	WSEventRate       int
+	WSEventBurst      int
+
+	RateLimitDefault int
+	KindRateLimits   map[int]int
+
+	MaxSubsPerConn    int
+	MaxFiltersPerSub  int
+	MaxQueryLimit     int
+	DefaultQueryLimit int
+	MaxQueryTimeRange time.Duration
+
+	MaxEventTags     int
+	MaxTagValueBytes int
+	MaxTotalTagBytes int
+	MinPowDifficulty int
+
+	QueryCacheEnabled bool
+	QueryCacheTTL     time.Duration
+	QueryCacheEntries int
+	QueryCacheBytes   int
+
+	DBBatchSize     int
+	DBBatchInterval time.Duration
+
+	DownstreamRelays    []string
+	DownstreamQueueSize int
+
+	ModerationURL          string
+	ModerationTimeout      time.Duration
+	ModerationFailOpen     bool
+	ModerationContentTypes []string
+
+	BlocklistFile string
+
+	DeadLetterFile string
+
+	BannedWordsFile  string
+	BannedWordsKinds []int
+
+	OTLPEndpoint string
+
+	RejectionLogLevel string
+
+	SelfTestEnabled bool
 }
 
 type NostrData struct {
@@ -46,7 +163,6 @@ type NostrData struct {
 	Relays map[string][]string `json:"relays"`
 }
 
-var data NostrData
 var relay *khatru.Relay
 var db DBBackend
 var fs afero.Fs
@@ -54,338 +170,221 @@ var config Config
 
 func main() {
 	relay = khatru.NewRelay()
+	checkConfigOnly = len(os.Args) > 1 && (os.Args[1] == "--check-config" || os.Args[1] == "-check-config")
 	config := LoadConfig()
-
-	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
-	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
-
-	fetchNostrData(config.TeamDomain)
-
-	go func() {
-		for {
-			time.Sleep(1 * time.Hour)
-			fetchNostrData(config.TeamDomain)
-		}
-	}()
-
-	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-		for _, pubkey := range data.Names {
-			if event.PubKey == pubkey {
-				return false, "" // allow
-			}
-		}
-		return true, "you are not part of the team"
-	})
-
-	if !config.BlossomEnabled {
-		// Configure HTTP server with timeouts suitable for large file uploads
-		server := &http.Server{
-			Addr:              ":3334",
-			Handler:           relay,
-			ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
-			WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
-			IdleTimeout:       5 * time.Minute,  // Increased idle timeout
-			ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
-			MaxHeaderBytes:    1 << 20,          // 1MB max header size
-		}
-
-		fmt.Println("running on :3334 with extended timeouts for large uploads")
-		server.ListenAndServe()
+	if checkConfigOnly {
+		db.Close()
+		fmt.Println("Configuration OK")
 		return
 	}
 
-	bl := blossom.New(relay, *config.BlossomURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
-	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
-		// Create context with timeout for large file operations
-		storeCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
-		defer cancel()
-
-		file, err := fs.Create(*config.BlossomPath + sha256)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		// Use streaming copy with context checking for large files
-		reader := bytes.NewReader(body)
-		buffer := make([]byte, 32*1024) // 32KB buffer for efficient copying
-
-		for {
-			select {
-			case <-storeCtx.Done():
-				return storeCtx.Err()
-			default:
-			}
-
-			n, err := reader.Read(buffer)
-			if n > 0 {
-				if _, writeErr := file.Write(buffer[:n]); writeErr != nil {
-					return writeErr
-				}
-			}
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
-		}
-
-		return file.Sync() // Ensure data is written to disk
-	})
+	shutdownTracing := setupTracing(context.Background())
+	defer shutdownTracing(context.Background())
 
-	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
-		filePath := *config.BlossomPath + sha256
-		log.Printf("LoadBlob: Attempting to open file at path: %s", filePath)
-		file, err := fs.Open(filePath)
-		if err != nil {
-			log.Printf("LoadBlob: Failed to open file %s: %v", filePath, err)
-			return nil, err
-		}
-		log.Printf("LoadBlob: Successfully opened file %s", filePath)
-		return file, nil
-	})
-	bl.DeleteBlob = append(bl.DeleteBlob, func(ctx context.Context, sha256 string) error {
-		return fs.Remove(*config.BlossomPath + sha256)
-	})
-	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, event *nostr.Event, size int, ext string) (bool, string, int) {
-		// Check for 100MB size limit (100 * 1024 * 1024 bytes)
-		maxSize := 200 * 1024 * 1024
-		if size > maxSize {
-			return true, "file size exceeds 200MB limit", 413
-		}
+	wireStore(relay)
 
-		for _, pubkey := range data.Names {
-			if pubkey == event.PubKey {
-				return false, ext, size
-			}
-		}
+	fetchNostrData(config.TeamDomain)
 
-		return true, "you are not part of the team", 403
-	})
+	go refreshNostrData(config.TeamDomain, config.MembershipRefresh)
 
-	// Add custom list endpoint for Sakura health checks
-	relay.Router().HandleFunc("/list/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	if config.ExpirationSweep > 0 {
+		go sweepExpiredEventsEvery(config.ExpirationSweep)
+	}
 
-		// Extract pubkey from URL path
-		pubkey := strings.TrimPrefix(r.URL.Path, "/list/")
-		if pubkey == "" {
-			http.Error(w, "Missing pubkey", http.StatusBadRequest)
-			return
-		}
+	if len(config.KindRetention) > 0 {
+		go pruneEventsEvery(config.RetentionSweep, config.KindRetention)
+	}
 
-		log.Printf("List blobs request for pubkey: %s", pubkey)
-
-		// Read all files from the blossom directory
-		blobs := []map[string]interface{}{}
-
-		if config.BlossomPath != nil {
-			file, err := fs.Open(*config.BlossomPath)
-			if err != nil {
-				log.Printf("Error opening blossom directory: %v", err)
-			} else {
-				defer file.Close()
-				fileInfos, err := file.Readdir(-1)
-				if err != nil {
-					log.Printf("Error reading blossom directory: %v", err)
-				} else {
-					for _, fileInfo := range fileInfos {
-						if !fileInfo.IsDir() {
-							fileName := fileInfo.Name()
-							// Validate that it looks like a SHA256 hash (64 hex characters)
-							if len(fileName) == 64 {
-								isValidHash := true
-								for _, char := range fileName {
-									if !((char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')) {
-										isValidHash = false
-										break
-									}
-								}
-
-								if isValidHash {
-									// Detect MIME type by reading the first 512 bytes
-									contentType := "application/octet-stream" // Default fallback
-									filePath := *config.BlossomPath + fileName
-									if blobFile, err := fs.Open(filePath); err == nil {
-										buffer := make([]byte, 512)
-										if n, err := blobFile.Read(buffer); err == nil && n > 0 {
-											detectedType := http.DetectContentType(buffer[:n])
-											if detectedType != "" {
-												contentType = detectedType
-											}
-										}
-										blobFile.Close()
-									}
-
-									blob := map[string]interface{}{
-										"sha256":   strings.ToLower(fileName),
-										"size":     fileInfo.Size(),
-										"type":     contentType,
-										"url":      *config.BlossomURL + "/" + strings.ToLower(fileName),
-										"uploaded": fileInfo.ModTime().Unix(),
-									}
-									blobs = append(blobs, blob)
-									log.Printf("Found blob: %s (size: %d, type: %s)", fileName, fileInfo.Size(), contentType)
-								}
-							}
-						}
-					}
-				}
-			}
+	if config.BlocklistFile != "" {
+		if err := loadBlocklist(); err != nil {
+			log.Fatalf("Error loading blocklist: %v", err)
 		}
+		go reloadOnHangup("blocklist", loadBlocklist)
+	}
 
-		log.Printf("Returning %d blobs for pubkey %s", len(blobs), pubkey)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(blobs)
-	})
-
-	// Add custom mirror endpoint handler for Sakura compatibility
-	relay.Router().HandleFunc("/mirror", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "PUT" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	if config.BannedWordsFile != "" {
+		if err := loadBannedWords(); err != nil {
+			log.Fatalf("Error loading banned words: %v", err)
 		}
+		go reloadOnHangup("banned words", loadBannedWords)
+	}
 
-		// Parse the request body to get source URL
-		var mirrorRequest struct {
-			URL string `json:"url"`
-		}
+	// malformed events are turned away before any of our other policies run. Over websockets
+	// khatru has already checked the id and signature by now; for imported and replayed
+	// events, which khatru doesn't check, this comes before rejectInvalidSignature's hashing.
+	if config.RejectMalformed {
+		relay.RejectEvent = append(relay.RejectEvent, logRejections("malformed", rejectMalformedEvent))
+	}
 
-		if err := json.NewDecoder(r.Body).Decode(&mirrorRequest); err != nil {
-			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-			return
-		}
+	relay.RejectEvent = append(relay.RejectEvent,
+		logRejections("signature", rejectInvalidSignature),
+		logRejections("pow", rejectInsufficientPow),
+		logRejections("tag_size", rejectOversizedTags),
+		logRejections("blocklist", rejectBlocklisted),
+		logRejections("banned_words", rejectBannedWords),
+		logRejections("membership", membershipPolicies[config.MembershipPolicy]),
+	)
+
+	// after membership, so only team members take up rate limit buckets
+	kindLimiter := newKindRateLimiter(config.RateLimitDefault, config.KindRateLimits, maxKindRateBuckets)
+	relay.RejectEvent = append(relay.RejectEvent, logRejections("kind_rate", kindLimiter.rejectEvent))
+
+	if config.RequireProfile {
+		relay.RejectEvent = append(relay.RejectEvent, logRejections("profile", rejectWithoutProfile))
+	}
 
-		if mirrorRequest.URL == "" {
-			http.Error(w, "Missing source URL", http.StatusBadRequest)
-			return
-		}
+	if config.RequireRelayHint {
+		relay.RejectEvent = append(relay.RejectEvent, logRejections("relay_hint", rejectWithoutRelayHint))
+	}
 
-		// Extract blob hash from source URL
-		blobHash := extractSha256FromURL(mirrorRequest.URL)
-		if blobHash == "" {
-			http.Error(w, "Cannot extract blob hash from source URL", http.StatusBadRequest)
-			return
-		}
+	if config.RequireAuthRead {
+		relay.RejectFilter = append(relay.RejectFilter, rejectUnauthedRead)
+	}
 
-		// Check if blob already exists
-		if _, err := fs.Open(*config.BlossomPath + blobHash); err == nil {
-			// Blob already exists, return success
-			response := map[string]interface{}{
-				"sha256": blobHash,
-				"url":    *config.BlossomURL + "/" + blobHash,
-				"size":   0, // We don't know the size without reading the file
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	if config.MaxQueryTimeRange > 0 {
+		relay.RejectFilter = append(relay.RejectFilter, rejectWideTimeRange(config.MaxQueryTimeRange))
+	}
 
-		// Download blob from source URL
-		resp, err := http.Get(mirrorRequest.URL)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch source blob: %v", err), http.StatusBadGateway)
-			return
+	// last, so only filters every other policy let through take a subscription slot
+	limiter := newSubscriptionLimiter(config.MaxSubsPerConn, config.MaxFiltersPerSub)
+	relay.RejectFilter = append(relay.RejectFilter, limiter.rejectFilter)
+
+	// subcommands run against the configured store and membership, then exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			runImport(os.Args[2:])
+		case "migrate-blobs":
+			runMigrateBlobs()
+		case "purge-blocked":
+			runPurgeBlocked()
+		case "migrate":
+			runMigrate(os.Args[2:])
+		case "replay-dead-letters":
+			runReplayDeadLetters()
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
 		}
-		defer resp.Body.Close()
+		return
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, fmt.Sprintf("Source server returned %d", resp.StatusCode), http.StatusBadGateway)
-			return
+	if config.SelfTestEnabled {
+		if err := runSelfTest(context.Background()); err != nil {
+			log.Fatalf("Self-test failed: %v", err)
 		}
+	}
 
-		// Read and verify the blob content
-		blobData, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to read blob data: %v", err), http.StatusInternalServerError)
-			return
-		}
+	if err := relayLists.load(context.Background()); err != nil {
+		log.Fatalf("Failed to load relay lists: %v", err)
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, relayLists.saved)
+	relay.DeleteEvent = append(relay.DeleteEvent, relayLists.deleted)
 
-		// Verify the hash matches
-		hasher := sha256.New()
-		hasher.Write(blobData)
-		actualHash := hex.EncodeToString(hasher.Sum(nil))
+	if len(config.DownstreamRelays) > 0 {
+		relay.OnEventSaved = append(relay.OnEventSaved, newFirehose(config.DownstreamRelays, config.DownstreamQueueSize).forward)
+	}
 
-		if actualHash != blobHash {
-			http.Error(w, "Blob hash mismatch", http.StatusBadRequest)
-			return
-		}
+	registerAdminRoutes(relay.Router())
+	relay.Router().HandleFunc("/relays", handleRelays)
+	relay.Router().HandleFunc("/readyz", handleReady)
 
-		// Store the blob using the existing StoreBlob functionality
-		ctx := r.Context()
-		for _, storeFunc := range bl.StoreBlob {
-			if err := storeFunc(ctx, blobHash, blobData); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to store blob: %v", err), http.StatusInternalServerError)
-				return
-			}
-		}
+	if !config.BlossomEnabled {
+		serve()
+		return
+	}
 
-		// Return success response
-		response := map[string]interface{}{
-			"sha256": blobHash,
-			"url":    *config.BlossomURL + "/" + blobHash,
-			"size":   len(blobData),
-		}
+	bl := blossom.New(relay, *config.BlossomURL)
+	index, err := newBlobIndex(context.Background(), blobBaseURL())
+	if err != nil {
+		log.Fatalf("Failed to build blob index: %v", err)
+	}
+	blobIndex = index
+	bl.Store = blobIndex
+	bl.StoreBlob = append(bl.StoreBlob, storeBlob)
+	bl.LoadBlob = append(bl.LoadBlob, loadBlob)
+	bl.DeleteBlob = append(bl.DeleteBlob, deleteBlob)
+	bl.RejectUpload = append(bl.RejectUpload, rejectUploadNonMember, rejectUploadExtension, rejectUploadBlobCount)
+
+	go sweepPartialUploadsEvery(partialUploadSweep, config.PartialUploadTimeout)
+	if config.BlossomTTL > 0 {
+		go sweepExpiredBlobsEvery(config.BlossomTTLSweep, config.BlossomTTL)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	// Serve HEAD and GET /<sha256> from the blob files before khatru's blossom routes
+	relay.SetRouter(withBlobRoutes(bl, relay.Router()))
 
-		log.Printf("Successfully mirrored blob %s from %s", blobHash, mirrorRequest.URL)
-	})
+	// BUD-02 list endpoint, also used by Sakura health checks
+	relay.Router().HandleFunc("/list/", handleList(bl))
 
-	// Configure HTTP server with timeouts suitable for large file uploads
-	server := &http.Server{
-		Addr:              ":3334",
-		Handler:           relay,
-		ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
-		WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
-		IdleTimeout:       5 * time.Minute,  // Increased idle timeout
-		ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
-		MaxHeaderBytes:    1 << 20,          // 1MB max header size
+	if config.MediaEnabled {
+		relay.Router().HandleFunc("/media/", handleMedia(bl))
 	}
 
-	fmt.Println("running on :3334 with extended timeouts for large uploads")
-	server.ListenAndServe()
+	// Add custom mirror endpoint handler for Sakura compatibility
+	relay.Router().HandleFunc("/mirror", handleMirror(bl))
+
+	serve()
 }
 
-func fetchNostrData(teamDomain string) {
-	response, err := http.Get("https://" + teamDomain + "/.well-known/nostr.json")
-	if err != nil {
-		log.Printf("Error getting well known file: %v", err)
-		return
+// wireStore connects the relay's event pipeline to db. khatru sends replaceable (0, 3,
+// 10000-19999) and addressable (30000-39999) kinds through ReplaceEvent instead of
+// StoreEvent, so older versions are superseded rather than kept alongside the new one.
+func wireStore(rl *khatru.Relay) {
+	saveEvent := db.SaveEvent
+	if saver, ok := db.(batchSaver); ok && config.DBBatchSize > 1 {
+		saveEvent = newBatchWriter(saver, config.DBBatchSize, config.DBBatchInterval).SaveEvent
 	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+	replaceEvent := db.ReplaceEvent
+	if config.DeadLetterFile != "" {
+		saveEvent = withDeadLetter("save", saveEvent)
+		replaceEvent = withDeadLetter("replace", replaceEvent)
 	}
-
-	var newData NostrData
-	err = json.Unmarshal(body, &newData)
-	if err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
-		return
+	// only pay for the span wrappers when spans are actually exported
+	if config.OTLPEndpoint != "" {
+		saveEvent = traceStore("event.store", saveEvent)
+		replaceEvent = traceStore("event.replace", replaceEvent)
 	}
-
-	data = newData
-	for pubkey, names := range data.Names {
-		fmt.Println(pubkey, names)
+	rl.StoreEvent = append(rl.StoreEvent, func(ctx context.Context, evt *nostr.Event) error {
+		// khatru only broadcasts ephemeral kinds (20000-29999), but make sure no other path
+		// into the store hooks persists them either
+		if nostr.IsEphemeralKind(evt.Kind) {
+			return nil
+		}
+		return skipDuplicates(saveEvent)(ctx, evt)
+	})
+	rl.ReplaceEvent = append(rl.ReplaceEvent, skipDuplicates(replaceEvent))
+	rl.DeleteEvent = append(rl.DeleteEvent, db.DeleteEvent)
+
+	query := queryUnexpired
+	if config.QueryCacheEnabled {
+		cache := newQueryCache(config.QueryCacheTTL, config.QueryCacheEntries, config.QueryCacheBytes)
+		query = cache.query(queryUnexpired)
+		rl.OnEventSaved = append(rl.OnEventSaved, cache.invalidate)
+		rl.DeleteEvent = append(rl.DeleteEvent, func(ctx context.Context, evt *nostr.Event) error {
+			cache.invalidate(ctx, evt)
+			return nil
+		})
 	}
-
-	log.Println("Updated NostrData from .well-known file")
+	query = capQueryLimit(config.DefaultQueryLimit, config.MaxQueryLimit, query)
+	if config.OTLPEndpoint != "" {
+		query = traceQuery(query)
+	}
+	rl.QueryEvents = append(rl.QueryEvents, query)
 }
 
 func LoadConfig() Config {
+	// a missing .env is normal in containers where the environment is injected directly;
+	// required keys are still enforced by getEnv below
 	err := godotenv.Load(".env")
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No .env file found, reading configuration from the environment")
+	} else if err != nil {
+		log.Fatalf("Error loading .env file: %v", err)
+	}
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			log.Fatalf("Error loading config file %s: %v", configFile, err)
+		}
 	}
 
 	config = Config{
@@ -402,34 +401,206 @@ func LoadConfig() Config {
 		TeamDomain:       getEnv("TEAM_DOMAIN"),
 		BlossomEnabled:   getEnvBool("BLOSSOM_ENABLED"),
 		BlossomPath:      getEnvNullable("BLOSSOM_PATH"),
-		BlossomURL:       getEnvNullable("BLOSSOM_URL"),
+		BlossomURL:       getEnvBaseURL("BLOSSOM_URL"),
+		BlossomPublicURL: strings.TrimRight(getEnvDefault("BLOSSOM_PUBLIC_URL", ""), "/"),
+		RequireProfile:   getEnvBool("REQUIRE_PROFILE"),
+		RequireAuthRead:  getEnvBool("REQUIRE_AUTH_READ"),
+		PublicReadKinds:  getEnvIntList("PUBLIC_READ_KINDS", nil),
+		RequireRelayHint: getEnvBool("REQUIRE_RELAY_HINT"),
+		RejectMalformed:  getEnvBool("REJECT_MALFORMED_EVENTS"),
+		MembershipPolicy: getEnvDefault("MEMBERSHIP_POLICY", "author"),
+		RelayURL:         getEnvDefault("RELAY_URL", ""),
+		LandingPageFile:  getEnvDefault("LANDING_PAGE_FILE", ""),
+		AdminPubkeys:     getEnvList("ADMIN_PUBKEYS"),
+		AdminIndex:       getEnvBool("ADMIN_INDEX"),
+		PprofEnabled:     getEnvBool("PPROF_ENABLED"),
+		CORSOrigins:      getEnvList("CORS_ALLOWED_ORIGINS"),
+
+		HTTPCompression:         getEnvBool("HTTP_COMPRESSION"),
+		HTTPCompressionMinBytes: getEnvInt("HTTP_COMPRESSION_MIN_BYTES", 1024),
+
+		MembershipCache:        getEnvDefault("MEMBERSHIP_CACHE_PATH", "nostr-cache.json"),
+		MembershipRefresh:      getEnvDuration("MEMBERSHIP_REFRESH_INTERVAL", time.Hour),
+		MembershipMaxStaleness: getEnvDuration("MEMBERSHIP_MAX_STALENESS", 24*time.Hour),
+		MembershipStaleUnready: getEnvBool("MEMBERSHIP_STALE_UNREADY"),
+
+		WOTEnabled:    getEnvBool("WOT_ENABLED"),
+		WOTDepth:      getEnvInt("WOT_DEPTH", 1),
+		WOTMaxPubkeys: getEnvInt("WOT_MAX_PUBKEYS", 10000),
+
+		HTTPConnectTimeout: getEnvDuration("HTTP_CONNECT_TIMEOUT", 10*time.Second),
+		HTTPReadTimeout:    getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+
+		MirrorAllowedHosts: getEnvList("MIRROR_ALLOWED_HOSTS"),
+		MirrorAllowPrivate: getEnvBool("MIRROR_ALLOW_PRIVATE_IPS"),
+
+		ListenAddr:        getEnvDefault("LISTEN_ADDR", ":3334"),
+		TLSCertFile:       getEnvNullable("TLS_CERT_FILE"),
+		TLSKeyFile:        getEnvNullable("TLS_KEY_FILE"),
+		TLSAutocertDomain: getEnvNullable("TLS_AUTOCERT_DOMAIN"),
+		TLSAutocertCache:  getEnvDefault("TLS_AUTOCERT_CACHE", "certs/"),
+
+		TrustForwardedHeaders: getEnvBool("TRUST_FORWARDED_HEADERS"),
+
+		HTTP2Enabled:              getEnvDefault("HTTP2_ENABLED", "true") == "true",
+		HTTP2Cleartext:            getEnvBool("HTTP2_CLEARTEXT"),
+		HTTP2MaxConcurrentStreams: getEnvInt("HTTP2_MAX_CONCURRENT_STREAMS", 250),
+		HTTP2MaxUploadBuffer:      getEnvInt("HTTP2_MAX_UPLOAD_BUFFER", 1<<20),
+
+		BlossomAllowedExts: getEnvList("BLOSSOM_ALLOWED_EXTS"),
+		BlossomBlockedExts: getEnvList("BLOSSOM_BLOCKED_EXTS"),
+		BlossomShardDepth:  getEnvInt("BLOSSOM_SHARD_DEPTH", 0),
+
+		BlossomUploadAuth:   getEnvDefault("BLOSSOM_UPLOAD_AUTH", blobAuthMember),
+		BlossomDownloadAuth: getEnvDefault("BLOSSOM_DOWNLOAD_AUTH", defaultDownloadAuth()),
+
+		MediaEnabled:      getEnvBool("MEDIA_ENABLED"),
+		MediaMaxDimension: getEnvInt("MEDIA_MAX_DIMENSION", 2048),
+		MediaFormats:      splitList(getEnvDefault("MEDIA_FORMATS", "jpeg,png")),
+
+		MaxConcurrentUploads: getEnvInt("MAX_CONCURRENT_UPLOADS", 8),
+		MaxBlobCount:         getEnvInt("MAX_BLOB_COUNT", 0),
+		UploadAuthMaxAge:     getEnvDuration("UPLOAD_AUTH_MAX_AGE", 10*time.Minute),
+		PartialUploadTimeout: getEnvDuration("PARTIAL_UPLOAD_TIMEOUT", time.Hour),
+		BlossomTTL:           getEnvDuration("BLOSSOM_TTL", 0),
+		BlossomTTLSweep:      getEnvDuration("BLOSSOM_TTL_SWEEP_INTERVAL", time.Hour),
+		BlossomTTLKeepRefs:   getEnvBool("BLOSSOM_TTL_KEEP_REFERENCED"),
+		StorageStatsCache:    getEnvDuration("STORAGE_STATS_CACHE", 10*time.Minute),
+		StorageStatsTop:      getEnvInt("STORAGE_STATS_TOP", 20),
+
+		ExpirationSweep: getEnvDuration("EXPIRATION_SWEEP_INTERVAL", time.Hour),
+		KindRetention:   getEnvKindRetention(),
+		RetentionSweep:  getEnvDuration("RETENTION_SWEEP_INTERVAL", time.Hour),
+
+		MaxWSMessageBytes: getEnvInt("MAX_WS_MESSAGE_BYTES", 512000),
+		MaxConnections:    getEnvInt("MAX_CONNECTIONS", 0),
+		WSPingInterval:    getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+		WSPongTimeout:     getEnvDuration("WS_PONG_TIMEOUT", 60*time.Second),
+		WSEventRate:       getEnvInt("WS_EVENT_RATE", 20),
+		WSEventBurst:      getEnvInt("WS_EVENT_BURST", 100),
+
+		RateLimitDefault: getEnvInt("RATE_LIMIT_DEFAULT", 0),
+		KindRateLimits:   getEnvKindRates(),
+
+		MaxSubsPerConn:    getEnvInt("MAX_SUBS_PER_CONN", 0),
+		MaxFiltersPerSub:  getEnvInt("MAX_FILTERS_PER_SUB", 20),
+		MaxQueryLimit:     getEnvInt("MAX_QUERY_LIMIT", 500),
+		DefaultQueryLimit: getEnvInt("DEFAULT_QUERY_LIMIT", 100),
+		MaxQueryTimeRange: getEnvDuration("MAX_QUERY_TIME_RANGE", 0),
+
+		MaxEventTags:     getEnvInt("MAX_EVENT_TAGS", 0),
+		MaxTagValueBytes: getEnvInt("MAX_TAG_VALUE_BYTES", 16*1024),
+		MaxTotalTagBytes: getEnvInt("MAX_TOTAL_TAG_BYTES", 256*1024),
+		MinPowDifficulty: getEnvInt("MIN_POW_DIFFICULTY", 0),
+
+		QueryCacheEnabled: getEnvBool("QUERY_CACHE_ENABLED"),
+		QueryCacheTTL:     getEnvDuration("QUERY_CACHE_TTL", 5*time.Second),
+		QueryCacheEntries: getEnvInt("QUERY_CACHE_MAX_ENTRIES", 1000),
+		QueryCacheBytes:   getEnvInt("QUERY_CACHE_MAX_BYTES", 16<<20),
+
+		DBBatchSize:     getEnvInt("DB_BATCH_SIZE", 1),
+		DBBatchInterval: getEnvDuration("DB_BATCH_INTERVAL", 5*time.Millisecond),
+
+		DownstreamRelays:    getEnvList("DOWNSTREAM_RELAYS"),
+		DownstreamQueueSize: getEnvInt("DOWNSTREAM_QUEUE_SIZE", 1000),
+
+		ModerationURL:          getEnvDefault("MODERATION_URL", ""),
+		ModerationTimeout:      getEnvDuration("MODERATION_TIMEOUT", 5*time.Second),
+		ModerationFailOpen:     getEnvDefault("MODERATION_FAIL_OPEN", "true") == "true",
+		ModerationContentTypes: splitList(getEnvDefault("MODERATION_CONTENT_TYPES", "image/")),
+
+		BlocklistFile: getEnvDefault("BLOCKLIST_FILE", ""),
+
+		DeadLetterFile: getEnvDefault("DEAD_LETTER_FILE", ""),
+
+		BannedWordsFile:  getEnvDefault("BANNED_WORDS", ""),
+		BannedWordsKinds: getEnvIntList("BANNED_WORDS_KINDS", []int{nostr.KindTextNote}),
+
+		OTLPEndpoint: getEnvDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+
+		RejectionLogLevel: getEnvDefault("REJECTION_LOG_LEVEL", "info"),
+
+		SelfTestEnabled: getEnvBool("SELFTEST_ENABLED"),
 	}
 
+	newHTTPClients(config.HTTPConnectTimeout, config.HTTPReadTimeout, config.ModerationTimeout)
+
 	relay.Info.Name = config.RelayName
+	pubkey, err := normalizePubkey(config.RelayPubkey)
+	if err != nil {
+		log.Fatalf("RELAY_PUBKEY is invalid: %v", err)
+	}
+	config.RelayPubkey = pubkey
 	relay.Info.PubKey = config.RelayPubkey
+	// khatru hands this to the websocket reader, which refuses a bigger frame before buffering
+	// it and closes the connection with 1009 (message too big)
+	relay.MaxMessageSize = int64(config.MaxWSMessageBytes)
+	// khatru pings every PingPeriod and drops a connection that hasn't sent a pong for
+	// PongWait. The HTTP server's timeouts don't apply here: the websocket upgrade clears them.
+	relay.PingPeriod = config.WSPingInterval
+	relay.PongWait = config.WSPongTimeout
+	relay.Info.Limitation = &nip11.RelayLimitationDocument{
+		MaxMessageLength: config.MaxWSMessageBytes,
+		MaxSubscriptions: config.MaxSubsPerConn,
+		MaxFilters:       config.MaxFiltersPerSub,
+		MaxLimit:         config.MaxQueryLimit,
+		MaxEventTags:     config.MaxEventTags,
+		MinPowDifficulty: config.MinPowDifficulty,
+		RestrictedWrites: true,
+		AuthRequired:     config.RequireAuthRead,
+	}
 	relay.Info.Description = config.RelayDescription
 	if config.DBPath == nil {
 		defaultPath := "db/"
 		config.DBPath = &defaultPath
 	}
 
+	if checkConfigOnly {
+		printConfig(os.Stdout, config)
+	}
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
 	db = newDBBackend(*config.DBPath)
 
 	if err := db.Init(); err != nil {
-		panic(err)
+		log.Fatalf("Error initializing the %s database: %v", *config.DBEngine, err)
+	}
+	if supportsSearch(db) {
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 50)
 	}
 
 	fs = afero.NewOsFs()
 	if config.BlossomEnabled {
-		if config.BlossomPath == nil {
-			log.Fatalf("Blossom enabled but no path set")
+		if err := initBlobStorage(); err != nil {
+			log.Fatalf("Blob storage: %v", err)
 		}
-		fs.MkdirAll(*config.BlossomPath, 0755)
+		cleanupTempBlobs()
+		cleanupPartialUploads()
+		uploadSlots = newUploadSlots(config.MaxConcurrentUploads)
 	}
 
 	return config
 }
 
+// normalizePubkey accepts a hex or npub public key and returns it as lowercase hex
+func normalizePubkey(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "npub1") {
+		prefix, decoded, err := nip19.Decode(value)
+		if err != nil || prefix != "npub" {
+			return "", fmt.Errorf("%q is not a valid npub", value)
+		}
+		value = decoded.(string)
+	}
+	value = strings.ToLower(value)
+	if !nostr.IsValidPublicKey(value) {
+		return "", fmt.Errorf("%q is not a 64-character hex public key or npub", value)
+	}
+	return value, nil
+}
+
 func getEnv(key string) string {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -446,6 +617,91 @@ func getEnvBool(key string) bool {
 	return value == "true"
 }
 
+func getEnvDefault(key string, fallback string) string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	return value
+}
+
+// getEnvDuration reads a Go duration string such as "30m" or "1h"
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid duration: %v", key, err)
+	}
+	return duration
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists || value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Environment variable %s is not a valid integer: %v", key, err)
+	}
+	return n
+}
+
+// getEnvList reads a comma-separated list, ignoring empty entries
+func getEnvList(key string) []string {
+	return splitList(os.Getenv(key))
+}
+
+// splitList splits a comma-separated value, trimming whitespace and dropping empty items
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvIntList reads a comma-separated list of integers, such as event kinds
+func getEnvIntList(key string, fallback []int) []int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	var list []int
+	for _, item := range splitList(value) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			log.Fatalf("Environment variable %s is not a list of integers: %v", key, err)
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// getEnvKindVars finds every non-empty variable named prefix followed by a kind, such as
+// RATE_LIMIT_KIND_7, and maps each kind to its variable's name
+func getEnvKindVars(prefix string) map[int]string {
+	keys := map[int]string{}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		suffix, ok := strings.CutPrefix(key, prefix)
+		if !ok || value == "" {
+			continue
+		}
+		kind, err := strconv.Atoi(suffix)
+		if err != nil {
+			log.Fatalf("Environment variable %s does not name a kind: %v", key, err)
+		}
+		keys[kind] = key
+	}
+	return keys
+}
+
 func getEnvNullable(key string) *string {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -470,13 +726,18 @@ func newDBBackend(path string) DBBackend {
 		config.DBEngine = &defaultEngine
 	}
 
-	switch *config.DBEngine {
+	return openDBBackend(*config.DBEngine, path)
+}
+
+// openDBBackend builds the backend for engine; lmdb and badger keep their files under path
+func openDBBackend(engine string, path string) DBBackend {
+	switch engine {
 	case "lmdb":
-		return newLMDBBackend(path)
+		return scanSearchBackend{cancellableBackend{newLMDBBackend(path)}}
 	case "badger":
-		return &badger.BadgerBackend{
+		return scanSearchBackend{cancellableBackend{&badger.BadgerBackend{
 			Path: path,
-		}
+		}}}
 	default:
 		return newPostgresBackend()
 	}
@@ -489,10 +750,10 @@ func newLMDBBackend(path string) *lmdb.LMDBBackend {
 }
 
 func newPostgresBackend() DBBackend {
-	return &postgresql.PostgresBackend{
+	return postgresSearchBackend{&postgresql.PostgresBackend{
 		DatabaseURL: fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
 			*config.PostgresUser, *config.PostgresPassword, *config.PostgresHost, *config.PostgresPort, *config.PostgresDB),
-	}
+	}}
 }
 
 // extractSha256FromURL extracts the SHA256 hash from a blossom URL
@@ -513,13 +774,7 @@ func extractSha256FromURL(url string) string {
 	}
 
 	// Validate that it looks like a SHA256 hash (64 hex characters)
-	if len(hashPart) == 64 {
-		// Check if all characters are valid hex
-		for _, char := range hashPart {
-			if !((char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')) {
-				return ""
-			}
-		}
+	if isValidSha256(hashPart) {
 		return strings.ToLower(hashPart)
 	}
 
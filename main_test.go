@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestReplaceableEventSupersedesOlder(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	rl := khatru.NewRelay()
+	wireStore(rl)
+	sk := nostr.GeneratePrivateKey()
+
+	older := &nostr.Event{Kind: nostr.KindProfileMetadata, Content: `{"name":"old"}`, CreatedAt: nostr.Now() - 10, Tags: nostr.Tags{}}
+	newer := &nostr.Event{Kind: nostr.KindProfileMetadata, Content: `{"name":"new"}`, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	for _, evt := range []*nostr.Event{older, newer} {
+		if err := evt.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rl.AddEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pubkey, _ := nostr.GetPublicKey(sk)
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindProfileMetadata}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*nostr.Event
+	for evt := range ch {
+		got = append(got, evt)
+	}
+	if len(got) != 1 || got[0].ID != newer.ID {
+		t.Fatalf("expected only the newer profile to remain, got %d events", len(got))
+	}
+}
+
+func TestNormalizePubkey(t *testing.T) {
+	hex := "8ad8f1f78c8e11966242e28a7ca15c936b23a999d5fb91bfe4e4472e2d6eaf55"
+	npub, err := nip19.EncodePublicKey(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range []string{hex, strings.ToUpper(hex), npub} {
+		got, err := normalizePubkey(input)
+		if err != nil || got != hex {
+			t.Fatalf("normalizePubkey(%q) = %q, %v", input, got, err)
+		}
+	}
+	for _, input := range []string{"", "abc", hex[:63] + "z", "npub1invalid"} {
+		if _, err := normalizePubkey(input); err == nil {
+			t.Fatalf("expected %q to be rejected", input)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/spf13/afero"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// derivedBlobDir is where transformed images are cached, relative to BlossomPath, one
+// directory per original blob so they can all go when it is deleted
+const derivedBlobDir = "derived/"
+
+// maxMediaSourcePixels bounds the images /media will decode, so a small file claiming huge
+// dimensions can't make us allocate gigabytes
+const maxMediaSourcePixels = 50_000_000
+
+var errNotAnImage = errors.New("blob is not a supported image")
+
+// mediaTransform is a /media request: fit the image within width x height, keeping its aspect
+// ratio and never enlarging it, and encode it as format
+type mediaTransform struct {
+	width  int
+	height int
+	format string
+}
+
+// parseMediaTransform reads width, height and format from the query, checking them against
+// MEDIA_MAX_DIMENSION and MEDIA_FORMATS. An empty format keeps the source's, where allowed.
+func parseMediaTransform(r *http.Request) (mediaTransform, error) {
+	var t mediaTransform
+	query := r.URL.Query()
+	for name, dst := range map[string]*int{"width": &t.width, "height": &t.height} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return t, fmt.Errorf("invalid %s", name)
+		}
+		if n > config.MediaMaxDimension {
+			return t, fmt.Errorf("%s exceeds %d", name, config.MediaMaxDimension)
+		}
+		*dst = n
+	}
+	if t.width == 0 && t.height == 0 {
+		return t, errors.New("width or height is required")
+	}
+
+	t.format = strings.ToLower(query.Get("format"))
+	if t.format == "jpg" {
+		t.format = "jpeg"
+	}
+	if t.format != "" && !slices.Contains(config.MediaFormats, t.format) {
+		return t, fmt.Errorf("format %q is not supported", t.format)
+	}
+	return t, nil
+}
+
+// mediaEncoders are the output formats /media can produce, which MEDIA_FORMATS chooses from
+var mediaEncoders = []string{"jpeg", "png", "gif"}
+
+// name identifies the transform among a blob's cached ones, e.g. 320x0.jpeg
+func (t mediaTransform) name() string {
+	format := t.format
+	if format == "" {
+		format = "original"
+	}
+	return fmt.Sprintf("%dx%d.%s", t.width, t.height, format)
+}
+
+// derivedBlobPath is where the result of applying t to the blob sha256 is cached
+func derivedBlobPath(sha256 string, t mediaTransform) string {
+	return *config.BlossomPath + derivedBlobDir + sha256 + "/" + t.name()
+}
+
+// deleteDerivedBlobs drops every cached transform of the blob sha256
+func deleteDerivedBlobs(sha256 string) error {
+	return fs.RemoveAll(*config.BlossomPath + derivedBlobDir + sha256)
+}
+
+// handleMedia serves GET /media/<sha256>?width=&height=&format= with the stored image resized
+// to fit, caching each result under derivedBlobDir. Blobs that aren't images we can decode are
+// served unchanged.
+func handleMedia(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hash := blobHashFromPath(strings.TrimPrefix(r.URL.Path, "/media"))
+		if hash == "" {
+			http.Error(w, "Invalid blob hash", http.StatusBadRequest)
+			return
+		}
+		if !authorizeBlobRead(w, r, "get", hash) {
+			return
+		}
+
+		transform, err := parseMediaTransform(r)
+		if err != nil {
+			writeBlobError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// never serve a cached transform of a blob that has since been deleted
+		if _, err := fs.Stat(blobPath(hash)); err != nil {
+			writeBlobError(w, "file not found", http.StatusNotFound)
+			return
+		}
+
+		cachePath := derivedBlobPath(hash, transform)
+		if cached, err := afero.ReadFile(fs, cachePath); err == nil {
+			serveDerivedBlob(w, r, hash+"-"+transform.name(), cached)
+			return
+		}
+
+		derived, err := transformBlob(hash, transform)
+		if errors.Is(err, errNotAnImage) {
+			handleGetBlob(bl, w, r, hash)
+			return
+		}
+		if err != nil {
+			log.Printf("Media: Failed to transform %s: %v", hash, err)
+			writeBlobError(w, "failed to transform image", http.StatusInternalServerError)
+			return
+		}
+
+		if err := writeDerivedBlob(cachePath, derived); err != nil {
+			log.Printf("Media: Failed to cache transformed %s: %v", hash, err)
+		}
+		serveDerivedBlob(w, r, hash+"-"+transform.name(), derived)
+	}
+}
+
+// transformBlob decodes the stored image, scales it to fit and encodes it again
+func transformBlob(hash string, t mediaTransform) ([]byte, error) {
+	file, err := openBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg, sourceFormat, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, errNotAnImage
+	}
+	if cfg.Width*cfg.Height > maxMediaSourcePixels {
+		return nil, fmt.Errorf("image is %dx%d, too large to transform", cfg.Width, cfg.Height)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errNotAnImage
+	}
+
+	format := t.format
+	if format == "" {
+		format = sourceFormat
+		if !slices.Contains(config.MediaFormats, format) {
+			format = "jpeg"
+		}
+	}
+
+	width, height := fitWithin(cfg.Width, cfg.Height, t.width, t.height)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+	case "png":
+		err = png.Encode(&out, dst)
+	case "gif":
+		err = gif.Encode(&out, dst, nil)
+	default:
+		err = fmt.Errorf("no encoder for %q", format)
+	}
+	return out.Bytes(), err
+}
+
+// fitWithin scales width x height down to fit within maxWidth x maxHeight, keeping the aspect
+// ratio; a zero maximum leaves that side unconstrained. Images are never enlarged.
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// writeDerivedBlob caches a transformed image, through a temp file so a half-written one is
+// never served
+func writeDerivedBlob(path string, body []byte) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := afero.TempFile(fs, filepath.Dir(path), filepath.Base(path)+".*"+tempBlobSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Rename(file.Name(), path)
+	}
+	if err != nil {
+		fs.Remove(file.Name())
+	}
+	return err
+}
+
+// serveDerivedBlob serves a transformed image. Its ETag names the original and the transform,
+// so each size and format is cached separately.
+func serveDerivedBlob(w http.ResponseWriter, r *http.Request, etag string, body []byte) {
+	w.Header().Set("Content-Type", http.DetectContentType(body))
+	setBlobCacheHeaders(w, etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
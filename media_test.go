@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func storeTestBlob(t *testing.T, content []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	if _, err := verifyAndStore(context.Background(), hash, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestMediaResizesAndCaches(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.MediaMaxDimension = 1000
+	config.MediaFormats = []string{"jpeg", "png"}
+	handler := handleMedia(bl)
+
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for x := 0; x < 400; x++ {
+		src.Set(x, x%200, color.RGBA{255, 0, 0, 255})
+	}
+	var encoded bytes.Buffer
+	png.Encode(&encoded, src)
+	hash := storeTestBlob(t, encoded.Bytes())
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/media/"+hash+query, nil))
+		return rec
+	}
+
+	rec := get("?width=100")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected a png, got %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+	resized, err := png.DecodeConfig(rec.Body)
+	if err != nil || resized.Width != 100 || resized.Height != 50 {
+		t.Fatalf("expected 100x50, got %dx%d (%v)", resized.Width, resized.Height, err)
+	}
+	if exists, _ := afero.Exists(fs, derivedBlobPath(hash, mediaTransform{width: 100})); !exists {
+		t.Fatal("expected the transform to be cached")
+	}
+
+	if rec := get("?height=50&format=jpg"); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("expected a jpeg, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, query := range []string{"", "?width=2000", "?width=-1", "?width=10&format=bmp"} {
+		if rec := get(query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", query, rec.Code)
+		}
+	}
+
+	if err := deleteBlob(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.DirExists(fs, *config.BlossomPath+derivedBlobDir+hash); exists {
+		t.Fatal("expected cached transforms to be deleted with the blob")
+	}
+	if rec := get("?width=100"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 once the original is gone, got %d", rec.Code)
+	}
+}
+
+func TestMediaServesNonImagesUnchanged(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.MediaMaxDimension = 1000
+	hash := storeTestBlob(t, []byte("just some text"))
+
+	rec := httptest.NewRecorder()
+	handleMedia(bl).ServeHTTP(rec, httptest.NewRequest("GET", "/media/"+hash+"?width=100", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "just some text" {
+		t.Fatalf("expected the original blob, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// lastMembershipFetch is the unix time of the last successful nostr.json fetch,
+// membershipFromCache whether the members in use were loaded from the membership cache
+// instead, and membershipCurrentAt when the members in use were last known to be current:
+// the fetch time, or the cache file's modification time. All are reported by /admin/status.
+var (
+	lastMembershipFetch atomic.Int64
+	membershipFromCache atomic.Bool
+	membershipCurrentAt atomic.Int64
+)
+
+// nostrData holds the last nostr.json loaded. The refresh goroutine swaps in a new one while
+// request handlers are reading it, so it is only reached through teamData and setTeamData,
+// and a NostrData's maps are never modified once it has been stored.
+var nostrData atomic.Pointer[NostrData]
+
+// teamData returns the current membership data, empty until nostr.json is first loaded
+func teamData() NostrData {
+	if d := nostrData.Load(); d != nil {
+		return *d
+	}
+	return NostrData{}
+}
+
+func setTeamData(d NostrData) {
+	nostrData.Store(&d)
+}
+
+// isTeamMember reports whether pubkey is listed in the team's .well-known/nostr.json, or is
+// in the web of trust with WOT_ENABLED. The relay's own key always counts, whatever the file
+// says, so relay-generated events and uploads never get locked out.
+func isTeamMember(pubkey string) bool {
+	if isRelayPubkey(pubkey) || isWebOfTrust(pubkey) {
+		return true
+	}
+	for _, member := range teamData().Names {
+		if member == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+func isRelayPubkey(pubkey string) bool {
+	return pubkey != "" && pubkey == config.RelayPubkey
+}
+
+// rejectNonMember only accepts events signed by team members
+func rejectNonMember(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if isTeamMember(event.PubKey) {
+		return false, "" // allow
+	}
+	return true, prefixRestricted + "you are not part of the team"
+}
+
+// rejectWithoutMemberMention is the mention-gated alternative to rejectNonMember: anyone may
+// publish, as long as the event p-tags at least one team member
+func rejectWithoutMemberMention(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if isRelayPubkey(event.PubKey) {
+		return false, ""
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && isTeamMember(tag[1]) {
+			return false, ""
+		}
+	}
+	return true, prefixRestricted + "event must mention a team member"
+}
+
+// membershipPolicies are the values MEMBERSHIP_POLICY accepts, each with the check it installs
+var membershipPolicies = map[string]func(context.Context, *nostr.Event) (bool, string){
+	"author":  rejectNonMember,
+	"mention": rejectWithoutMemberMention,
+}
+
+// refreshNostrData re-fetches the team's nostr.json every interval, and immediately
+// whenever the process receives SIGHUP
+func refreshNostrData(teamDomain string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-hup:
+			log.Println("Received SIGHUP, refreshing NostrData")
+		}
+		fetchNostrData(teamDomain)
+		if age, stale := membershipStale(); stale {
+			log.Printf("WARNING: team membership is %s old, over MEMBERSHIP_MAX_STALENESS (%s); nostr.json at %s has not been fetched since",
+				age.Round(time.Second), config.MembershipMaxStaleness, wellKnownBaseURL(teamDomain))
+		}
+	}
+}
+
+// membershipAge is how long ago the members in use were last known to be current, and false
+// before any have been loaded
+func membershipAge() (time.Duration, bool) {
+	at := membershipCurrentAt.Load()
+	if at == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(at, 0)), true
+}
+
+// membershipStale reports whether the members in use are older than MEMBERSHIP_MAX_STALENESS
+func membershipStale() (time.Duration, bool) {
+	age, loaded := membershipAge()
+	return age, loaded && config.MembershipMaxStaleness > 0 && age > config.MembershipMaxStaleness
+}
+
+// fetchNostrData loads the team's nostr.json as the team data, falling back to the membership
+// cache on failure, and re-expands the web of trust from whichever members it ends up with.
+// The error is returned for callers that report it, such as /admin/refresh.
+func fetchNostrData(teamDomain string) error {
+	defer refreshWebOfTrust(context.Background())
+
+	body, err := downloadNostrData(membershipClient, wellKnownBaseURL(teamDomain))
+	var newData NostrData
+	if err == nil {
+		if newData, err = parseNostrData(body); err != nil {
+			err = fmt.Errorf("error unmarshalling JSON: %w", err)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		loadCachedNostrData()
+		return err
+	}
+
+	setTeamData(newData)
+	lastMembershipFetch.Store(time.Now().Unix())
+	membershipCurrentAt.Store(time.Now().Unix())
+	membershipFromCache.Store(false)
+	for pubkey, names := range newData.Names {
+		fmt.Println(pubkey, names)
+	}
+
+	if err := afero.WriteFile(fs, config.MembershipCache, body, 0644); err != nil {
+		log.Printf("Error writing membership cache %s: %v", config.MembershipCache, err)
+	}
+
+	log.Println("Updated NostrData from .well-known file")
+	return nil
+}
+
+// membershipBaseURL overrides where nostr.json is fetched from, so tests can serve it from an
+// httptest.Server. Empty means https://<team domain>.
+var membershipBaseURL string
+
+func wellKnownBaseURL(teamDomain string) string {
+	if membershipBaseURL != "" {
+		return membershipBaseURL
+	}
+	return "https://" + teamDomain
+}
+
+// downloadNostrData fetches baseURL's /.well-known/nostr.json with client
+func downloadNostrData(client *http.Client, baseURL string) ([]byte, error) {
+	response, err := client.Get(strings.TrimSuffix(baseURL, "/") + "/.well-known/nostr.json")
+	if err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("timed out getting well known file: %w", err)
+		}
+		return nil, fmt.Errorf("error getting well known file: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting well known file: %s returned %d", baseURL, response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	return body, nil
+}
+
+// loadCachedNostrData falls back to the last nostr.json we fetched successfully, so a
+// restart while the team domain is unreachable doesn't leave us with no members at all.
+// Data already in memory is never replaced by the cache.
+func loadCachedNostrData() {
+	if len(teamData().Names) > 0 {
+		return
+	}
+
+	body, err := afero.ReadFile(fs, config.MembershipCache)
+	if err != nil {
+		log.Printf("No usable membership cache at %s: %v", config.MembershipCache, err)
+		return
+	}
+
+	cached, err := parseNostrData(body)
+	if err != nil {
+		log.Printf("Error unmarshalling membership cache %s: %v", config.MembershipCache, err)
+		return
+	}
+
+	setTeamData(cached)
+	membershipFromCache.Store(true)
+	if info, err := fs.Stat(config.MembershipCache); err == nil {
+		membershipCurrentAt.Store(info.ModTime().Unix())
+	}
+	log.Printf("Loaded %d members from membership cache %s", len(cached.Names), config.MembershipCache)
+}
+
+// parseNostrData decodes a nostr.json document. Only "names" is required to be well-formed:
+// a malformed "relays" section (or entry) is logged and skipped so membership still updates.
+func parseNostrData(body []byte) (NostrData, error) {
+	var raw struct {
+		Names  map[string]string `json:"names"`
+		Relays json.RawMessage   `json:"relays"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return NostrData{}, err
+	}
+
+	newData := NostrData{Names: raw.Names}
+	if len(raw.Relays) == 0 || string(raw.Relays) == "null" {
+		return newData, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw.Relays, &entries); err != nil {
+		log.Printf("Ignoring malformed relays section in nostr.json: %v", err)
+		return newData, nil
+	}
+
+	newData.Relays = make(map[string][]string, len(entries))
+	for pubkey, entry := range entries {
+		var relays []string
+		if err := json.Unmarshal(entry, &relays); err != nil {
+			log.Printf("Ignoring malformed relays entry for %s in nostr.json: %v", pubkey, err)
+			continue
+		}
+		newData.Relays[pubkey] = relays
+	}
+
+	return newData, nil
+}
+
+// handleRelays exposes the relay hints from the team's nostr.json, optionally for a single pubkey
+func handleRelays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	relays := teamData().Relays
+	if relays == nil {
+		relays = map[string][]string{}
+	}
+	if pubkey := r.URL.Query().Get("pubkey"); pubkey != "" {
+		relays = map[string][]string{pubkey: relays[pubkey]}
+		if relays[pubkey] == nil {
+			relays[pubkey] = []string{}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(relays)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestParseNostrDataPartiallyMalformed(t *testing.T) {
+	alice := "8ad8f1f78c8e11966242e28a7ca15c936b23a999d5fb91bfe4e4472e2d6eaf55"
+	bob := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+
+	for name, body := range map[string]string{
+		"relays not an object": `{"names":{"alice":"` + alice + `"},"relays":"wss://oops"}`,
+		"one bad relay entry":  `{"names":{"alice":"` + alice + `","bob":"` + bob + `"},"relays":{"` + alice + `":["wss://a.example"],"` + bob + `":42}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := parseNostrData([]byte(body))
+			if err != nil {
+				t.Fatalf("expected names to be applied despite malformed relays, got %v", err)
+			}
+			if parsed.Names["alice"] != alice {
+				t.Fatalf("expected alice in names, got %v", parsed.Names)
+			}
+			if _, ok := parsed.Relays[bob]; ok {
+				t.Fatalf("expected malformed relay entry to be dropped, got %v", parsed.Relays)
+			}
+		})
+	}
+
+	parsed, _ := parseNostrData([]byte(`{"names":{"alice":"` + alice + `"},"relays":{"` + alice + `":["wss://a.example"],"` + bob + `":42}}`))
+	if len(parsed.Relays[alice]) != 1 {
+		t.Fatalf("expected well-formed relay entry to be kept, got %v", parsed.Relays)
+	}
+
+	if _, err := parseNostrData([]byte(`{"names":["not","a","map"]}`)); err == nil {
+		t.Fatal("expected malformed names to fail")
+	}
+}
+
+func TestFetchNostrDataFromMockWellKnown(t *testing.T) {
+	alice := "8ad8f1f78c8e11966242e28a7ca15c936b23a999d5fb91bfe4e4472e2d6eaf55"
+	healthy := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+		if !healthy {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"names":{"alice":"` + alice + `"}}`))
+	}))
+	defer ts.Close()
+
+	fs = afero.NewMemMapFs()
+	config = Config{TeamDomain: "team.example", MembershipCache: "nostr-cache.json"}
+	membershipBaseURL = ts.URL
+	defer func() { membershipBaseURL = "" }()
+	setTeamData(NostrData{})
+	defer func() { setTeamData(NostrData{}) }()
+
+	if err := fetchNostrData(config.TeamDomain); err != nil {
+		t.Fatal(err)
+	}
+	if !isTeamMember(alice) {
+		t.Fatalf("expected alice to be a member, got %v", teamData().Names)
+	}
+	if cached, err := afero.ReadFile(fs, config.MembershipCache); err != nil || !strings.Contains(string(cached), alice) {
+		t.Fatalf("expected nostr.json to be cached, got %q (%v)", cached, err)
+	}
+
+	// a fresh process with the team domain down starts from the cache
+	healthy = false
+	setTeamData(NostrData{})
+	if err := fetchNostrData(config.TeamDomain); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected the 503 to be reported, got %v", err)
+	}
+	if !isTeamMember(alice) {
+		t.Fatalf("expected membership to fall back to the cache, got %v", teamData().Names)
+	}
+}
+
+func TestRelayPubkeyIsNeverRejected(t *testing.T) {
+	relaySK := nostr.GeneratePrivateKey()
+	relayPK, _ := nostr.GetPublicKey(relaySK)
+	config = Config{RelayPubkey: relayPK, BlossomAllowedExts: []string{"png"}}
+	setTeamData(NostrData{Names: map[string]string{}})
+	ctx := context.Background()
+
+	if !isTeamMember(relayPK) {
+		t.Fatal("relay pubkey is not treated as a team member")
+	}
+	if reject, msg := rejectNonMember(ctx, signedEvent(t, relaySK, 1, "from the relay")); reject {
+		t.Fatalf("relay event rejected: %s", msg)
+	}
+	auth := &nostr.Event{PubKey: relayPK}
+	for _, rejectUpload := range []func(context.Context, *nostr.Event, int, string) (bool, string, int){rejectUploadNonMember, rejectUploadExtension} {
+		if reject, msg, _ := rejectUpload(ctx, auth, 1024, ".pdf"); reject {
+			t.Fatalf("relay upload rejected: %s", msg)
+		}
+	}
+
+	if reject, _ := rejectNonMember(ctx, signedEvent(t, nostr.GeneratePrivateKey(), 1, "stranger")); !reject {
+		t.Fatal("non-member event accepted with an empty member list")
+	}
+	if reject, _, _ := rejectUploadNonMember(ctx, &nostr.Event{PubKey: strings.Repeat("ab", 32)}, 1024, ".png"); !reject {
+		t.Fatal("non-member upload accepted with an empty member list")
+	}
+}
+
+func TestMentionPolicyRequiresMemberPTag(t *testing.T) {
+	memberSK, strangerSK := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPK, _ := nostr.GetPublicKey(memberSK)
+	config = Config{}
+	setTeamData(NostrData{Names: map[string]string{"member": memberPK}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	ctx := context.Background()
+
+	mention := signedEvent(t, strangerSK, 1, "hi member")
+	mention.Tags = nostr.Tags{{"p", strings.Repeat("ab", 32)}, {"p", memberPK, "wss://relay.example"}}
+	mention.Sign(strangerSK)
+	if reject, msg := rejectWithoutMemberMention(ctx, mention); reject {
+		t.Fatalf("event mentioning a member rejected: %s", msg)
+	}
+
+	if reject, msg := rejectWithoutMemberMention(ctx, signedEvent(t, memberSK, 1, "no mentions")); !reject || !strings.HasPrefix(msg, prefixRestricted) {
+		t.Fatalf("expected an event without member p-tags to be restricted, got %v %q", reject, msg)
+	}
+	other := signedEvent(t, strangerSK, 1, "hi stranger")
+	other.Tags = nostr.Tags{{"p"}, {"p", strings.Repeat("ab", 32)}}
+	other.Sign(strangerSK)
+	if reject, _ := rejectWithoutMemberMention(ctx, other); !reject {
+		t.Fatal("event mentioning only outsiders accepted")
+	}
+
+	config.MembershipPolicy = "mention"
+	if err := validateConfig(config); err != nil && strings.Contains(err.Error(), "MEMBERSHIP_POLICY") {
+		t.Fatalf("mention policy refused: %v", err)
+	}
+	config.MembershipPolicy = "everyone"
+	if err := validateConfig(config); err == nil || !strings.Contains(err.Error(), "MEMBERSHIP_POLICY") {
+		t.Fatalf("expected an unknown policy to be refused, got %v", err)
+	}
+}
+
+// TestConcurrentFetchAndReject is meant for go test -race: membership refreshes while events
+// are being checked against it must not race
+func TestConcurrentFetchAndReject(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"names":{"member":"` + pub + `"},"relays":{"` + pub + `":["wss://member.example"]}}`))
+	}))
+	defer ts.Close()
+
+	fs = afero.NewMemMapFs()
+	config = Config{TeamDomain: "team.example", MembershipCache: "nostr-cache.json"}
+	membershipBaseURL = ts.URL
+	setTeamData(NostrData{Names: map[string]string{"member": pub}})
+	t.Cleanup(func() { setTeamData(NostrData{}); membershipBaseURL = "" })
+	evt := signedEvent(t, sk, 1, "hello")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 20 {
+			fetchNostrData(config.TeamDomain)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if reject, msg := rejectNonMember(context.Background(), evt); reject {
+			t.Fatalf("member rejected during a refresh: %s", msg)
+		}
+		handleRelays(httptest.NewRecorder(), httptest.NewRequest("GET", "/relays?pubkey="+pub, nil))
+	}
+}
+
+func TestStaleMembershipFailsReadiness(t *testing.T) {
+	alice := "8ad8f1f78c8e11966242e28a7ca15c936b23a999d5fb91bfe4e4472e2d6eaf55"
+	healthy := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"names":{"alice":"` + alice + `"}}`))
+	}))
+	defer ts.Close()
+
+	fs = afero.NewMemMapFs()
+	config = Config{TeamDomain: "team.example", MembershipCache: "nostr-cache.json", MembershipMaxStaleness: time.Hour, MembershipStaleUnready: true}
+	membershipBaseURL = ts.URL
+	setTeamData(NostrData{})
+	t.Cleanup(func() { setTeamData(NostrData{}); membershipBaseURL = ""; membershipCurrentAt.Store(0) })
+	afero.WriteFile(fs, config.MembershipCache, []byte(`{"names":{"alice":"`+alice+`"}}`), 0644)
+	lastWritten := time.Now().Add(-2 * time.Hour)
+	fs.Chtimes(config.MembershipCache, lastWritten, lastWritten)
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		handleReady(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	fetchNostrData(config.TeamDomain)
+	if age, stale := membershipStale(); !stale || age < 2*time.Hour-time.Minute {
+		t.Fatalf("expected a two-hour-old cache to be stale, got %s (stale %v)", age, stale)
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness to fail on stale membership, got %d", code)
+	}
+
+	healthy = true
+	fetchNostrData(config.TeamDomain)
+	if _, stale := membershipStale(); stale {
+		t.Fatal("expected a successful fetch to make membership current")
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("expected readiness to recover, got %d", code)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// migrateState is saved after every page so an interrupted migration can pick up where it
+// left off instead of starting over
+type migrateState struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Until   nostr.Timestamp `json:"until"`
+	Copied  int             `json:"copied"`
+	Skipped int             `json:"skipped"`
+}
+
+// runMigrate copies every event from one database backend to another:
+// swarm migrate -from badger -to postgres [flags]
+//
+// Events are read newest to oldest through QueryEvents and written with SaveEvent, so any
+// pair of backends works. Progress is kept in -state; rerunning the same command after an
+// interruption resumes from the last finished page, and events already in the destination
+// are skipped.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "backend to copy events from: lmdb, badger or postgres")
+	to := flags.String("to", "", "backend to copy events to: lmdb, badger or postgres")
+	fromPath := flags.String("from-path", *config.DBPath, "database directory of an lmdb or badger source")
+	toPath := flags.String("to-path", *config.DBPath, "database directory of an lmdb or badger destination")
+	statePath := flags.String("state", "migrate-state.json", "file recording progress, for resuming")
+	pageSize := flags.Int("page", 500, "events to read per query")
+	flags.Parse(args)
+
+	for _, engine := range []string{*from, *to} {
+		if engine != "lmdb" && engine != "badger" && engine != "postgres" {
+			log.Fatalf("migrate: -from and -to must be lmdb, badger or postgres, got %q", engine)
+		}
+	}
+	if *from == *to && (*from == "postgres" || *fromPath == *toPath) {
+		log.Fatalf("migrate: source and destination are the same database")
+	}
+
+	source, err := openMigrateBackend(*from, *fromPath)
+	if err != nil {
+		log.Fatalf("migrate: opening %s source: %v", *from, err)
+	}
+	defer source.Close()
+	dest, err := openMigrateBackend(*to, *toPath)
+	if err != nil {
+		log.Fatalf("migrate: opening %s destination: %v", *to, err)
+	}
+	defer dest.Close()
+
+	state, err := loadMigrateState(*statePath, *from, *to)
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	if state.Until > 0 {
+		log.Printf("migrate: resuming from %s, %d events copied so far", state.Until.Time().UTC(), state.Copied)
+	}
+
+	if err := migrateEvents(context.Background(), source, dest, state, *pageSize, func(state *migrateState) error {
+		log.Printf("migrate: %d events copied, %d already present, now at %s", state.Copied, state.Skipped, state.Until.Time().UTC())
+		return saveMigrateState(*statePath, state)
+	}); err != nil {
+		log.Fatalf("migrate: %v (copied %d events before failing; rerun to resume)", err, state.Copied)
+	}
+	fs.Remove(*statePath)
+	log.Printf("migrate: done, %d events copied from %s to %s, %d already present", state.Copied, *from, *to, state.Skipped)
+}
+
+// openMigrateBackend opens a backend by engine name. The one configured for the relay is
+// already open as db, and an embedded store can only be opened once per process.
+func openMigrateBackend(engine string, path string) (DBBackend, error) {
+	if engine == *config.DBEngine && (engine == "postgres" || path == *config.DBPath) {
+		return db, nil
+	}
+	backend := openDBBackend(engine, path)
+	return backend, backend.Init()
+}
+
+// migrateEvents pages through source from state.Until down to the oldest event, saving each
+// one to dest, and calls checkpoint after every page. Pages overlap on their oldest
+// timestamp, as in deleteEventsWhere, and the duplicates that causes are skipped.
+func migrateEvents(ctx context.Context, source, dest DBBackend, state *migrateState, pageSize int, checkpoint func(*migrateState) error) error {
+	seen := make(map[string]bool)
+	for {
+		filter := nostr.Filter{Limit: pageSize}
+		if state.Until > 0 {
+			until := state.Until
+			filter.Until = &until
+		}
+		ch, err := source.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		fresh := 0
+		page := make(map[string]bool)
+		var oldest nostr.Timestamp
+		for evt := range ch {
+			page[evt.ID] = true
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			if seen[evt.ID] {
+				continue
+			}
+			fresh++
+			err := dest.SaveEvent(ctx, evt)
+			switch {
+			case errors.Is(err, eventstore.ErrDupEvent):
+				state.Skipped++
+			case err != nil:
+				return fmt.Errorf("saving event %s: %w", evt.ID, err)
+			default:
+				state.Copied++
+			}
+		}
+		if fresh == 0 {
+			return nil
+		}
+		seen = page
+		state.Until = oldest
+		if err := checkpoint(state); err != nil {
+			return err
+		}
+	}
+}
+
+func loadMigrateState(path string, from string, to string) (*migrateState, error) {
+	state := &migrateState{From: from, To: to}
+	body, err := afero.ReadFile(fs, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if state.From != from || state.To != to {
+		return nil, fmt.Errorf("%s is for a migration from %s to %s; remove it to start a new one", path, state.From, state.To)
+	}
+	return state, nil
+}
+
+func saveMigrateState(path string, state *migrateState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, body, 0644)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestMigrateEventsResumes(t *testing.T) {
+	ctx := context.Background()
+	source, dest := &slicestore.SliceStore{}, &slicestore.SliceStore{}
+	source.Init()
+	dest.Init()
+	sk := nostr.GeneratePrivateKey()
+	for i := range 7 {
+		evt := signedEvent(t, sk, nostr.KindTextNote, "note")
+		evt.CreatedAt = nostr.Timestamp(1000 + i/2) // pairs share a timestamp, across page boundaries
+		evt.Content = string(rune('a' + i))
+		evt.Sign(sk)
+		if err := source.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	interrupted := errors.New("interrupted")
+	state := &migrateState{From: "badger", To: "postgres"}
+	err := migrateEvents(ctx, source, dest, state, 3, func(*migrateState) error { return interrupted })
+	if !errors.Is(err, interrupted) || state.Copied != 3 || state.Until == 0 {
+		t.Fatalf("expected to stop after the first page with 3 copied, got %v, %+v", err, state)
+	}
+
+	fs = afero.NewMemMapFs()
+	if err := saveMigrateState("migrate-state.json", state); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := loadMigrateState("migrate-state.json", "badger", "postgres")
+	if err != nil || resumed.Until != state.Until {
+		t.Fatalf("expected the saved state back, got %+v, %v", resumed, err)
+	}
+	if _, err := loadMigrateState("migrate-state.json", "lmdb", "postgres"); err == nil {
+		t.Fatal("expected a state file for another migration to be refused")
+	}
+
+	if err := migrateEvents(ctx, source, dest, resumed, 3, func(*migrateState) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := dest.CountEvents(ctx, nostr.Filter{}); count != 7 {
+		t.Fatalf("expected all 7 events in the destination, got %d", count)
+	}
+	if resumed.Copied != 7 {
+		t.Fatalf("expected 7 events copied in total, got %+v", resumed)
+	}
+}
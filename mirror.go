@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	errMirrorHostNotAllowed = errors.New("source host is not in MIRROR_ALLOWED_HOSTS")
+	errMirrorPrivateAddress = errors.New("source resolves to a private address")
+)
+
+// mirrorError is the body of every failed /mirror response
+type mirrorError struct {
+	Error string `json:"error"`
+}
+
+// handleMirror implements BUD-04 PUT /mirror for Sakura compatibility: it downloads the blob
+// at the requested URL, checks it hashes to the sha256 in that URL and stores it as if the
+// caller had uploaded it. Every failure is answered with a JSON mirrorError and an X-Reason
+// header carrying the same reason.
+func handleMirror(bl *blossom.BlossomServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the auth, upload slot and moderation helpers write plain-text errors of their own
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		defer jw.finish()
+		w = jw
+
+		if r.Method != "PUT" {
+			writeBlobError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the request body to get source URL
+		var mirrorRequest struct {
+			URL string `json:"url"`
+		}
+
+		// keep the raw body around so a NIP-98 "payload" tag can be checked against it
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuthPayload))
+		if err != nil {
+			writeBlobError(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if err := json.Unmarshal(body, &mirrorRequest); err != nil {
+			writeBlobError(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		if mirrorRequest.URL == "" {
+			writeBlobError(w, "missing source URL", http.StatusBadRequest)
+			return
+		}
+
+		// Extract blob hash from source URL
+		blobHash := extractSha256FromURL(mirrorRequest.URL)
+		if blobHash == "" {
+			writeBlobError(w, "cannot extract blob hash from source URL", http.StatusBadRequest)
+			return
+		}
+
+		// BUD-04: mirroring needs the same upload authorization as a direct upload
+		pubkey, ok := requireUploadAuth(w, r, blobHash)
+		if !ok {
+			return
+		}
+		if err := checkUploadAuth(r); err != nil {
+			writeAuthUseError(w, err)
+			return
+		}
+
+		// Check if blob already exists
+		if info, err := fs.Stat(blobPath(blobHash)); err == nil {
+			// Blob already exists, it only needs recording for this user, with the type the
+			// index already has for it
+			declared := ""
+			if known, err := bl.Store.Get(r.Context(), blobHash); err == nil && known != nil {
+				declared = known.Type
+			}
+			descriptor, err := indexMirroredBlob(r.Context(), bl, blobHash, info.Size(), declared, pubkey)
+			if err != nil {
+				writeBlobError(w, "failed to save blob entry", http.StatusInternalServerError)
+				return
+			}
+			writeBlobDescriptor(w, descriptor)
+			return
+		}
+
+		if err := checkBlobCount(); err != nil {
+			writeBlobError(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+
+		release, ok := acquireUploadSlot(w)
+		if !ok {
+			return
+		}
+		defer release()
+
+		// Download blob from source URL, giving up on the body after mirrorTimeout
+		ctx, cancel := context.WithTimeout(r.Context(), mirrorTimeout)
+		defer cancel()
+		ctx, span := startBlobSpan(ctx, "blob.mirror", blobHash)
+		span.SetAttributes(attribute.String("blob.source_url", mirrorRequest.URL))
+		defer span.End()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", mirrorRequest.URL, nil)
+		if err != nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+			writeBlobError(w, "invalid source URL", http.StatusBadRequest)
+			return
+		}
+		if !mirrorHostAllowed(req.URL) {
+			writeAuthError(w, errMirrorHostNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		resp, err := mirrorClient.Do(req)
+		if err != nil {
+			if errors.Is(err, errMirrorHostNotAllowed) || errors.Is(err, errMirrorPrivateAddress) {
+				writeAuthError(w, fmt.Sprintf("refusing to fetch source blob: %v", err), http.StatusForbidden)
+				return
+			}
+			if isTimeout(err) {
+				writeBlobError(w, fmt.Sprintf("timed out fetching source blob: %v", err), http.StatusGatewayTimeout)
+				return
+			}
+			writeBlobError(w, fmt.Sprintf("failed to fetch source blob: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			writeBlobError(w, fmt.Sprintf("source server returned %d", resp.StatusCode), http.StatusBadGateway)
+			return
+		}
+
+		// Stream the blob to disk, verifying the hash matches
+		size, err := verifyAndStore(ctx, blobHash, resp.Body)
+		span.SetAttributes(attribute.Int64("blob.size", size))
+		switch {
+		case errors.Is(err, errHashMismatch):
+			writeBlobError(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errBlobTooLarge):
+			writeBlobError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case isTimeout(err):
+			writeBlobError(w, fmt.Sprintf("timed out downloading source blob: %v", err), http.StatusGatewayTimeout)
+			return
+		case errors.Is(err, errBlobFlagged), errors.Is(err, errModerationUnavailable):
+			writeModerationError(w, err)
+			return
+		case errors.Is(err, errBlobStorageFull):
+			writeBlobError(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		case errors.Is(err, errBlobStorageUnavailable):
+			writeBlobError(w, err.Error(), http.StatusInternalServerError)
+			return
+		case err != nil:
+			writeBlobError(w, fmt.Sprintf("failed to store blob: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// the descriptor carries the size actually stored, not whatever the source claimed
+		descriptor, err := indexMirroredBlob(r.Context(), bl, blobHash, size, resp.Header.Get("Content-Type"), pubkey)
+		if err != nil {
+			writeBlobError(w, "failed to save blob entry", http.StatusInternalServerError)
+			return
+		}
+
+		// Return success response
+		writeBlobDescriptor(w, descriptor)
+
+		log.Printf("Successfully mirrored blob %s from %s", blobHash, mirrorRequest.URL)
+	}
+}
+
+// mirrorHostAllowed reports whether MIRROR_ALLOWED_HOSTS lets /mirror fetch from u. An entry
+// matches its host exactly, or with a leading "*." any subdomain of it; an empty list allows
+// every host, leaving mirrorDialControl to keep requests off private addresses.
+func mirrorHostAllowed(u *url.URL) bool {
+	if len(config.MirrorAllowedHosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, allowed := range config.MirrorAllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMirrorRedirect holds redirects from a mirror source to MIRROR_ALLOWED_HOSTS too
+func checkMirrorRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !mirrorHostAllowed(req.URL) {
+		return fmt.Errorf("redirect to %s: %w", req.URL.Hostname(), errMirrorHostNotAllowed)
+	}
+	return nil
+}
+
+// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), carrier-grade NAT space that net.IP's
+// IsPrivate leaves out but that is no more reachable from the internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// mirrorDialControl runs on every connection mirrorClient makes, after DNS resolution, so a
+// source host can't point /mirror at loopback, private, shared or link-local services,
+// whether directly, through a redirect or by re-resolving between checks.
+// MIRROR_ALLOW_PRIVATE_IPS turns it off.
+func mirrorDialControl(network string, address string, _ syscall.RawConn) error {
+	if config.MirrorAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%s: %w", host, errMirrorPrivateAddress)
+	}
+	return nil
+}
+
+// jsonErrorWriter turns an error response written with http.Error into a JSON mirrorError.
+// Successful responses pass straight through; an error's text body is held until finish.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (jw *jsonErrorWriter) WriteHeader(status int) {
+	if status < 400 {
+		jw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	jw.status = status
+}
+
+func (jw *jsonErrorWriter) Write(b []byte) (int, error) {
+	if jw.status != 0 {
+		return jw.body.Write(b)
+	}
+	return jw.ResponseWriter.Write(b)
+}
+
+// finish writes the held error, if there was one, as JSON
+func (jw *jsonErrorWriter) finish() {
+	if jw.status == 0 {
+		return
+	}
+	reason := strings.TrimSpace(jw.body.String())
+	h := jw.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+	h.Set("Content-Type", "application/json")
+	if h.Get("X-Reason") == "" {
+		h.Set("X-Reason", reason)
+	}
+	jw.ResponseWriter.WriteHeader(jw.status)
+	json.NewEncoder(jw.ResponseWriter).Encode(mirrorError{Error: reason})
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (jw *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return jw.ResponseWriter
+}
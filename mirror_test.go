@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMirrorErrorsAreJSON(t *testing.T) {
+	bl := newTestBlossom(t)
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	setTeamData(NostrData{Names: map[string]string{"member": pub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+
+	content := []byte("mirrored")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, hash) {
+			w.Write(content)
+			return
+		}
+		w.Write([]byte("something else"))
+	}))
+	defer source.Close()
+	mirror := handleMirror(bl)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		auth   bool
+		status int
+	}{
+		{"wrong method", "GET", "", true, http.StatusMethodNotAllowed},
+		{"invalid json", "PUT", "{", true, http.StatusBadRequest},
+		{"no hash in url", "PUT", `{"url":"` + source.URL + `/blob/file.png"}`, true, http.StatusBadRequest},
+		{"unauthenticated", "PUT", `{"url":"` + source.URL + `/` + hash + `"}`, false, http.StatusUnauthorized},
+		{"hash mismatch", "PUT", `{"url":"` + source.URL + `/` + strings.Repeat("ab", 32) + `"}`, true, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(tc.method, "/mirror", strings.NewReader(tc.body))
+		if tc.auth {
+			req = withHTTPAuth(t, req, sk)
+		}
+		rec := httptest.NewRecorder()
+		mirror(rec, req)
+
+		if rec.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.name, tc.status, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Fatalf("%s: expected a JSON error, got Content-Type %q", tc.name, got)
+		}
+		var body mirrorError
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Fatalf("%s: expected an error field, got %q", tc.name, rec.Body.String())
+		}
+		if rec.Header().Get("X-Reason") != body.Error {
+			t.Fatalf("%s: expected X-Reason %q to match the error, got %q", tc.name, body.Error, rec.Header().Get("X-Reason"))
+		}
+	}
+
+	req := withHTTPAuth(t, httptest.NewRequest("PUT", "/mirror", strings.NewReader(`{"url":"`+source.URL+`/`+hash+`"}`)), sk)
+	rec := httptest.NewRecorder()
+	mirror(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the mirror to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var descriptor blossom.BlobDescriptor
+	if err := json.Unmarshal(rec.Body.Bytes(), &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.SHA256 != hash || descriptor.Size != len(content) {
+		t.Fatalf("expected a descriptor for %s of %d bytes, got %+v", hash, len(content), descriptor)
+	}
+}
+
+func TestMirrorRefusesDisallowedAndPrivateSources(t *testing.T) {
+	bl := newTestBlossom(t)
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	setTeamData(NostrData{Names: map[string]string{"member": pub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	newHTTPClients(time.Second, time.Second, time.Second)
+	t.Cleanup(func() { mirrorClient = http.DefaultClient })
+
+	content := []byte("internal")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer internal.Close()
+	mirror := handleMirror(bl)
+	try := func(source string) *httptest.ResponseRecorder {
+		req := withHTTPAuth(t, httptest.NewRequest("PUT", "/mirror", strings.NewReader(`{"url":"`+source+`"}`)), sk)
+		rec := httptest.NewRecorder()
+		mirror(rec, req)
+		return rec
+	}
+
+	if rec := try(internal.URL + "/" + hash); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "private address") {
+		t.Fatalf("expected a loopback source to be refused with 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for address, refused := range map[string]bool{"100.64.0.1:443": true, "100.127.255.254:443": true, "100.128.0.1:443": false, "93.184.216.34:443": false} {
+		if err := mirrorDialControl("tcp", address, nil); (err != nil) != refused {
+			t.Fatalf("mirrorDialControl(%s): expected refused %v, got %v", address, refused, err)
+		}
+	}
+
+	// a proxy from the environment would be the only address the dial check sees
+	t.Setenv("HTTPS_PROXY", internal.URL)
+	newHTTPClients(time.Second, time.Second, time.Second)
+	if proxy := mirrorClient.Transport.(*http.Transport).Proxy; proxy != nil {
+		t.Fatal("expected the mirror transport not to use a proxy")
+	}
+
+	config.MirrorAllowedHosts = []string{"cdn.example.com", "*.blossom.example"}
+	for host, allowed := range map[string]bool{"cdn.example.com": true, "CDN.example.com": true, "a.blossom.example": true, "blossom.example": false, "evil.example.com": false} {
+		if got := mirrorHostAllowed(&url.URL{Host: host + ":443"}); got != allowed {
+			t.Fatalf("mirrorHostAllowed(%s): expected %v, got %v", host, allowed, got)
+		}
+	}
+	if rec := try(internal.URL + "/" + hash); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "MIRROR_ALLOWED_HOSTS") {
+		t.Fatalf("expected a host off the allowlist to be refused with 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	config.MirrorAllowedHosts, config.MirrorAllowPrivate = nil, true
+	if rec := try(internal.URL + "/" + hash); rec.Code != http.StatusOK {
+		t.Fatalf("expected MIRROR_ALLOW_PRIVATE_IPS to allow the loopback source, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
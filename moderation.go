@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	errBlobFlagged           = errors.New("blob rejected by moderation")
+	errModerationUnavailable = errors.New("moderation service unavailable")
+)
+
+// moderatedBlobKey marks a request context whose blob has already been through moderation,
+// so storeBlob doesn't send it to the classifier a second time
+type moderatedBlobKey struct{}
+
+// moderateBlob sends a blob to the MODERATION_URL classifier when its sniffed content type
+// matches MODERATION_CONTENT_TYPES. The blob is POSTed as the request body with its sha256 in
+// X-SHA-256, and the classifier answers {"flagged": bool, "reason": "..."}. When it can't be
+// reached or answers with an error, MODERATION_FAIL_OPEN decides whether the blob goes through.
+func moderateBlob(ctx context.Context, hash string, content io.ReadSeeker) error {
+	if config.ModerationURL == "" || ctx.Value(moderatedBlobKey{}) == hash {
+		return nil
+	}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(content, head)
+	contentType := http.DetectContentType(head[:n])
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !moderatedContentType(contentType) {
+		return nil
+	}
+
+	flagged, reason, err := classifyBlob(ctx, hash, contentType, content)
+	if err != nil {
+		if config.ModerationFailOpen {
+			log.Printf("Moderation: classifier failed for %s, accepting it: %v", hash, err)
+			return nil
+		}
+		log.Printf("Moderation: classifier failed for %s, rejecting it: %v", hash, err)
+		return errModerationUnavailable
+	}
+	if flagged {
+		log.Printf("Moderation: %s flagged: %s", hash, reason)
+		if reason != "" {
+			return fmt.Errorf("%w: %s", errBlobFlagged, reason)
+		}
+		return errBlobFlagged
+	}
+	return nil
+}
+
+func moderatedContentType(contentType string) bool {
+	for _, prefix := range config.ModerationContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func classifyBlob(ctx context.Context, hash string, contentType string, content io.Reader) (bool, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", config.ModerationURL, content)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-SHA-256", hash)
+
+	resp, err := moderationClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("classifier returned %d", resp.StatusCode)
+	}
+
+	var verdict struct {
+		Flagged bool   `json:"flagged"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&verdict); err != nil {
+		return false, "", fmt.Errorf("invalid classifier response: %w", err)
+	}
+	return verdict.Flagged, verdict.Reason, nil
+}
+
+// moderateUpload runs a spooled PUT /upload body through moderation before khatru sees it,
+// since khatru has already indexed the blob by the time StoreBlob could refuse it, and only
+// answers StoreBlob errors with a 500. The caller has already checked the authorization
+// covers hash. It returns the request to pass on, or nil when the response has been written.
+func moderateUpload(w http.ResponseWriter, r *http.Request, body *spooledBody, hash string) *http.Request {
+	// a section reader leaves the file's offset alone, and the classifier request can't
+	// close it
+	if err := moderateBlob(r.Context(), hash, io.NewSectionReader(body, 0, body.size)); err != nil {
+		writeModerationError(w, err)
+		return nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), moderatedBlobKey{}, hash))
+}
+
+// writeModerationError answers a moderation failure: 451 for flagged blobs, 503 when the
+// classifier is down and MODERATION_FAIL_OPEN is off
+func writeModerationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBlobFlagged):
+		writeBlobError(w, err.Error(), http.StatusUnavailableForLegalReasons)
+	case errors.Is(err, errModerationUnavailable):
+		writeBlobError(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		writeBlobError(w, "failed to moderate blob", http.StatusInternalServerError)
+	}
+}
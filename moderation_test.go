@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// pngHeader is enough for content sniffing to call the blob an image
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func newTestClassifier(t *testing.T, flagged string, status int) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("X-SHA-256") == flagged {
+			w.Write([]byte(`{"flagged":true,"reason":"nsfw"}`))
+			return
+		}
+		w.Write([]byte(`{"flagged":false}`))
+	}))
+	t.Cleanup(ts.Close)
+	config.ModerationURL = ts.URL
+	config.ModerationContentTypes = []string{"image/"}
+	moderationClient = ts.Client()
+	return &calls
+}
+
+func blobWithHash(content []byte) ([]byte, string) {
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+func TestModerationRejectsFlaggedImages(t *testing.T) {
+	newTestBlossom(t)
+	bad, badHash := blobWithHash(append(pngHeader, "flagged"...))
+	good, goodHash := blobWithHash(append(pngHeader, "fine"...))
+	text, textHash := blobWithHash([]byte("plain text is not sent"))
+	calls := newTestClassifier(t, badHash, http.StatusOK)
+	ctx := context.Background()
+
+	if _, err := verifyAndStore(ctx, badHash, bytes.NewReader(bad)); !errors.Is(err, errBlobFlagged) {
+		t.Fatalf("expected the flagged image to be rejected, got %v", err)
+	}
+	if exists, _ := afero.Exists(fs, blobPath(badHash)); exists {
+		t.Fatal("expected the flagged image not to be stored")
+	}
+	if _, err := verifyAndStore(ctx, goodHash, bytes.NewReader(good)); err != nil {
+		t.Fatalf("expected the clean image to be stored, got %v", err)
+	}
+	if _, err := verifyAndStore(ctx, textHash, bytes.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected only the two images to reach the classifier, got %d calls", calls.Load())
+	}
+}
+
+func TestModerationFailurePolicy(t *testing.T) {
+	newTestBlossom(t)
+	image, hash := blobWithHash(append(pngHeader, "whatever"...))
+	newTestClassifier(t, "", http.StatusInternalServerError)
+	ctx := context.Background()
+
+	config.ModerationFailOpen = false
+	if _, err := verifyAndStore(ctx, hash, bytes.NewReader(image)); !errors.Is(err, errModerationUnavailable) {
+		t.Fatalf("expected fail-closed to reject while the classifier is down, got %v", err)
+	}
+	config.ModerationFailOpen = true
+	if _, err := verifyAndStore(ctx, hash, bytes.NewReader(image)); err != nil {
+		t.Fatalf("expected fail-open to accept while the classifier is down, got %v", err)
+	}
+}
+
+func TestModeratedUploadAnswers451(t *testing.T) {
+	bl := newTestBlossom(t)
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	image, hash := blobWithHash(append(pngHeader, "flagged"...))
+	newTestClassifier(t, hash, http.StatusOK)
+
+	reached := false
+	handler := withBlobRoutes(bl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	req := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", bytes.NewReader(image)), member, "upload", nostr.Tag{"x", hash})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("expected 451, got %d: %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+	if reached {
+		t.Fatal("expected the flagged upload not to reach khatru")
+	}
+}
+
+func TestModeratedUploadIsSpooledAfterAuth(t *testing.T) {
+	bl := newTestBlossom(t)
+	member, outsider := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	image, hash := blobWithHash(append(pngHeader, "clean"...))
+	calls := newTestClassifier(t, "", http.StatusOK)
+
+	var received []byte
+	handler := withBlobRoutes(bl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", bytes.NewReader(image)), outsider, "upload"))
+	if rec.Code != http.StatusForbidden || calls.Load() != 0 || received != nil {
+		t.Fatalf("expected an outsider's upload to be refused before it is read, got %d with %d classifier calls", rec.Code, calls.Load())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", bytes.NewReader(image)), member, "upload", nostr.Tag{"x", hash}))
+	if rec.Code != http.StatusOK || calls.Load() != 1 || !bytes.Equal(received, image) {
+		t.Fatalf("expected the moderated upload to be passed on intact, got %d (%s) with %d classifier calls", rec.Code, rec.Body.String(), calls.Load())
+	}
+	entries, err := afero.ReadDir(fs, *config.BlossomPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempBlobSuffix) {
+			t.Fatalf("expected the spooled upload to be removed, found %s", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// httpAuthMaxAge is how far a NIP-98 event's created_at may be from now
+const httpAuthMaxAge = time.Minute
+
+// maxAuthPayload bounds how much of a request body we'll buffer to check a NIP-98 "payload" tag
+const maxAuthPayload = 1 << 20
+
+// readHTTPAuth validates a NIP-98 "Authorization: Nostr <base64 event>" header against
+// the request and returns the signing pubkey. When the event has a "payload" tag the
+// body must hash to it; the body is buffered and restored for the handler.
+func readHTTPAuth(r *http.Request) (string, error) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return "", fmt.Errorf("missing authorization")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, "Nostr "))
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization encoding")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != 27235 || !evt.CheckID() {
+		return "", fmt.Errorf("invalid authorization event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", fmt.Errorf("invalid authorization signature")
+	}
+
+	if age := time.Since(evt.CreatedAt.Time()); age > httpAuthMaxAge || age < -httpAuthMaxAge {
+		return "", fmt.Errorf("authorization event is too old or in the future")
+	}
+	if u := evt.Tags.GetFirst([]string{"u", ""}); u == nil || (*u)[1] != requestURL(r) {
+		return "", fmt.Errorf("authorization \"u\" tag does not match request URL")
+	}
+	if m := evt.Tags.GetFirst([]string{"method", ""}); m == nil || !strings.EqualFold((*m)[1], r.Method) {
+		return "", fmt.Errorf("authorization \"method\" tag does not match request method")
+	}
+	if p := evt.Tags.GetFirst([]string{"payload", ""}); p != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuthPayload+1))
+		if err != nil || len(body) > maxAuthPayload {
+			return "", fmt.Errorf("failed to read request body for \"payload\" check")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold((*p)[1], hex.EncodeToString(sum[:])) {
+			return "", fmt.Errorf("authorization \"payload\" tag does not match request body")
+		}
+	}
+
+	return evt.PubKey, nil
+}
+
+// requestURL reconstructs the absolute URL the client used. X-Forwarded-Host and
+// X-Forwarded-Proto are only honored with TRUST_FORWARDED_HEADERS on, since any client can
+// send them and would otherwise get a u tag signed for some other host accepted here.
+func requestURL(r *http.Request) string {
+	host := r.Host
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if config.TrustForwardedHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+			proto = forwarded
+		}
+	}
+	return proto + "://" + host + r.URL.RequestURI()
+}
+
+// authorizationKind peeks at the kind of the event in a "Nostr" Authorization header, so
+// Blossom (24242) and NIP-98 (27235) auth can share it. It returns 0 without a header and
+// -1 when the header can't be decoded.
+func authorizationKind(r *http.Request) int {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return 0
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, "Nostr "))
+	if err != nil {
+		return -1
+	}
+	var evt struct {
+		Kind int `json:"kind"`
+	}
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return -1
+	}
+	return evt.Kind
+}
+
+// requestAuthor authenticates r with either a Blossom authorization for action or a NIP-98
+// HTTP auth event and returns the signer. For Blossom, a hash must be listed in the "x" tags
+// when the event has any, and always for deletes. The status is what to answer with on error.
+func requestAuthor(r *http.Request, action string, hash string) (string, int, error) {
+	switch authorizationKind(r) {
+	case 0:
+		return "", http.StatusUnauthorized, fmt.Errorf("missing authorization")
+	case 27235:
+		pubkey, err := readHTTPAuth(r)
+		if err != nil {
+			return "", http.StatusUnauthorized, err
+		}
+		return pubkey, http.StatusOK, nil
+	default:
+		auth, err := readBlossomAuth(r, action)
+		if err != nil {
+			return "", http.StatusUnauthorized, err
+		}
+		if hash != "" && (action == "delete" || auth.Tags.GetFirst([]string{"x", ""}) != nil) && auth.Tags.GetFirst([]string{"x", hash}) == nil {
+			return "", http.StatusForbidden, fmt.Errorf("authorization is not valid for this blob")
+		}
+		return auth.PubKey, http.StatusOK, nil
+	}
+}
+
+// requireTeamAuth authenticates r like requestAuthor and checks the signer is a team member.
+// On failure the error response has been written and ok is false.
+func requireTeamAuth(w http.ResponseWriter, r *http.Request, action string, hash string) (pubkey string, ok bool) {
+	pubkey, code, err := requestAuthor(r, action, hash)
+	if err != nil {
+		writeAuthError(w, err.Error(), code)
+		return "", false
+	}
+	if !isTeamMember(pubkey) {
+		writeAuthError(w, "you are not part of the team", http.StatusForbidden)
+		return "", false
+	}
+	return pubkey, true
+}
+
+// writeAuthError answers a request that failed authentication (401) or authorization (403),
+// with the reason in X-Reason
+func writeAuthError(w http.ResponseWriter, reason string, code int) {
+	w.Header().Set("X-Reason", reason)
+	http.Error(w, reason, code)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// withHTTPAuth signs a NIP-98 auth event for req with sk and attaches it
+func withHTTPAuth(t *testing.T, req *http.Request, sk string, tags ...nostr.Tag) *http.Request {
+	t.Helper()
+	evt := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags:      append(nostr.Tags{{"u", requestURL(req)}, {"method", req.Method}}, tags...),
+	}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(evt.String())))
+	return req
+}
+
+func TestReadHTTPAuthChecksPayload(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	body := `{"url":"https://example.com/blob"}`
+	sum := sha256.Sum256([]byte(body))
+
+	req := withHTTPAuth(t, httptest.NewRequest("PUT", "/mirror", strings.NewReader(body)), sk, nostr.Tag{"payload", hex.EncodeToString(sum[:])})
+	pubkey, err := readHTTPAuth(req)
+	if err != nil || pubkey != pk {
+		t.Fatalf("expected valid auth for %s, got %q, %v", pk, pubkey, err)
+	}
+	if restored, _ := io.ReadAll(req.Body); string(restored) != body {
+		t.Fatalf("expected body to be restored, got %q", restored)
+	}
+
+	req = withHTTPAuth(t, httptest.NewRequest("PUT", "/mirror", strings.NewReader("tampered")), sk, nostr.Tag{"payload", hex.EncodeToString(sum[:])})
+	if _, err := readHTTPAuth(req); err == nil {
+		t.Fatal("expected a payload mismatch to be rejected")
+	}
+
+	req = withHTTPAuth(t, httptest.NewRequest("GET", "/mirror", nil), sk)
+	req.Method = "PUT"
+	if _, err := readHTTPAuth(req); err == nil {
+		t.Fatal("expected a method mismatch to be rejected")
+	}
+}
+
+func TestRequestURLTrustsForwardedHeadersOnlyWhenConfigured(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://relay.example/admin/status?x=1", nil)
+	req.Header.Set("X-Forwarded-Host", "other.example")
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	config = Config{}
+	if got := requestURL(req); got != "http://relay.example/admin/status?x=1" {
+		t.Fatalf("expected forwarded headers to be ignored by default, got %s", got)
+	}
+	config = Config{TrustForwardedHeaders: true}
+	if got := requestURL(req); got != "https://other.example/admin/status?x=1" {
+		t.Fatalf("expected forwarded headers with TRUST_FORWARDED_HEADERS, got %s", got)
+	}
+}
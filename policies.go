@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Machine-readable prefixes for rejection messages, following the NIP-01 convention for OK
+// and CLOSED messages so clients can tell why something was refused
+const (
+	prefixInvalid      = "invalid: "
+	prefixBlocked      = "blocked: "
+	prefixRestricted   = "restricted: "
+	prefixAuthRequired = "auth-required: "
+	prefixRateLimited  = "rate-limited: "
+	prefixPow          = "pow: "
+	prefixError        = "error: "
+)
+
+// invalidSignatures counts events rejected by rejectInvalidSignature, reported by /admin/status
+var invalidSignatures atomic.Int64
+
+// rejectInvalidSignature checks the event id and signature ourselves. khatru verifies events
+// arriving over websockets, but relay.AddEvent (used by import) does not, and the relay's
+// security shouldn't depend on that detail of the library.
+func rejectInvalidSignature(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if !event.CheckID() {
+		return true, prefixInvalid + "event id does not match its content"
+	}
+	if ok, _ := event.CheckSignature(); !ok {
+		invalidSignatures.Add(1)
+		return true, prefixInvalid + "invalid signature"
+	}
+	return false, ""
+}
+
+// rejectMalformedEvent refuses events missing the fields every event needs: an id and pubkey
+// of 32-byte hex, a kind between 0 and 65535 and a signature. It only looks at their shape,
+// which is cheap enough to run ahead of the other RejectEvent policies; the id and signature
+// are checked for correctness by rejectInvalidSignature, and before any policy by khatru for
+// events read from a websocket. Events khatru has verified can still fail it, with an
+// out-of-range kind.
+func rejectMalformedEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if !nostr.IsValid32ByteHex(event.ID) || !nostr.IsValid32ByteHex(event.PubKey) ||
+		event.Kind < 0 || event.Kind > 65535 || event.Sig == "" {
+		return true, prefixInvalid + "malformed event"
+	}
+	return false, ""
+}
+
+// rejectWithoutProfile only accepts events from authors that already have a kind-0
+// profile stored on this relay, as a lightweight sybil deterrent
+func rejectWithoutProfile(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind == nostr.KindProfileMetadata || isRelayPubkey(event.PubKey) {
+		return false, ""
+	}
+
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		Authors: []string{event.PubKey},
+		Kinds:   []int{nostr.KindProfileMetadata},
+		Limit:   1,
+	})
+	if err != nil {
+		return true, prefixError + "failed to look up author profile"
+	}
+
+	found := false
+	for range ch {
+		found = true
+	}
+	if !found {
+		return true, prefixRestricted + "publish a profile (kind 0) before posting"
+	}
+	return false, ""
+}
+
+// rejectWithoutRelayHint only accepts events with a tag pointing at RELAY_URL, such as an "r"
+// tag or the relay hint of an "e" or "p" tag, so everything stored here was meant for this
+// relay. URLs are compared after normalization, so a trailing slash or letter case doesn't
+// matter.
+func rejectWithoutRelayHint(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if isRelayPubkey(event.PubKey) {
+		return false, ""
+	}
+	relayURL := nostr.NormalizeURL(config.RelayURL)
+	for _, tag := range event.Tags {
+		for _, value := range tag[min(1, len(tag)):] {
+			if strings.HasPrefix(value, "ws") && nostr.NormalizeURL(value) == relayURL {
+				return false, ""
+			}
+		}
+	}
+	return true, prefixRestricted + "events must reference " + relayURL + " in their tags"
+}
+
+// rejectUnauthedRead requires subscribers to authenticate (NIP-42) as a team member, unless
+// the filter only asks for PUBLIC_READ_KINDS
+func rejectUnauthedRead(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if len(filter.Kinds) > 0 && !slices.ContainsFunc(filter.Kinds, func(kind int) bool {
+		return !slices.Contains(config.PublicReadKinds, kind)
+	}) {
+		return false, ""
+	}
+	authed := khatru.GetAuthed(ctx)
+	if authed == "" {
+		return true, prefixAuthRequired + "this relay requires authentication to read"
+	}
+	if !isTeamMember(authed) {
+		return true, prefixRestricted + "you are not part of the team"
+	}
+	return false, ""
+}
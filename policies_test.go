@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+func newTestDB(t *testing.T) {
+	t.Helper()
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db = store
+}
+
+func signedEvent(t *testing.T, sk string, kind int, content string) *nostr.Event {
+	t.Helper()
+	evt := &nostr.Event{Kind: kind, Content: content, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestRejectWithoutProfile(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	note := signedEvent(t, sk, nostr.KindTextNote, "hello")
+	if reject, _ := rejectWithoutProfile(ctx, note); !reject {
+		t.Fatal("expected note to be rejected before the author has a profile")
+	}
+
+	profile := signedEvent(t, sk, nostr.KindProfileMetadata, `{"name":"alice"}`)
+	if reject, msg := rejectWithoutProfile(ctx, profile); reject {
+		t.Fatalf("expected profile to be accepted, got %q", msg)
+	}
+	if err := db.SaveEvent(ctx, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if reject, msg := rejectWithoutProfile(ctx, note); reject {
+		t.Fatalf("expected note to be accepted once the profile exists, got %q", msg)
+	}
+}
+
+func TestRejectInvalidSignature(t *testing.T) {
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	valid := signedEvent(t, sk, nostr.KindTextNote, "signed")
+	if reject, msg := rejectInvalidSignature(ctx, valid); reject {
+		t.Fatalf("expected a properly signed event to pass, got %q", msg)
+	}
+
+	// a signature made by a different key, attached to this author's event
+	forged := *valid
+	other := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "signed")
+	forged.Sig = other.Sig
+	before := invalidSignatures.Load()
+	if reject, msg := rejectInvalidSignature(ctx, &forged); !reject || msg != "invalid: invalid signature" {
+		t.Fatalf("expected a forged signature to be rejected, got %v %q", reject, msg)
+	}
+	if invalidSignatures.Load() != before+1 {
+		t.Fatal("expected the invalid signature counter to go up")
+	}
+
+	tampered := *valid
+	tampered.Content = "edited after signing"
+	if reject, msg := rejectInvalidSignature(ctx, &tampered); !reject || !strings.Contains(msg, "id does not match") {
+		t.Fatalf("expected edited content to be rejected, got %v %q", reject, msg)
+	}
+}
+
+func TestRejectMalformedEvent(t *testing.T) {
+	ctx := context.Background()
+	valid := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "well formed")
+	if reject, msg := rejectMalformedEvent(ctx, valid); reject {
+		t.Fatalf("expected a well-formed event to pass, got %q", msg)
+	}
+
+	for name, mutate := range map[string]func(*nostr.Event){
+		"no id":         func(e *nostr.Event) { e.ID = "" },
+		"short pubkey":  func(e *nostr.Event) { e.PubKey = "abcd" },
+		"negative kind": func(e *nostr.Event) { e.Kind = -1 },
+		"kind too big":  func(e *nostr.Event) { e.Kind = 70000 },
+		"no signature":  func(e *nostr.Event) { e.Sig = "" },
+	} {
+		malformed := *valid
+		mutate(&malformed)
+		if reject, msg := rejectMalformedEvent(ctx, &malformed); !reject || msg != "invalid: malformed event" {
+			t.Errorf("%s: expected invalid: malformed event, got %v %q", name, reject, msg)
+		}
+	}
+}
+
+func TestRejectInsufficientPow(t *testing.T) {
+	ctx := context.Background()
+	config = Config{MinPowDifficulty: 8}
+	defer func() { config = Config{} }()
+	sk := nostr.GeneratePrivateKey()
+
+	mined := func(target int) *nostr.Event {
+		evt := &nostr.Event{Kind: 1, Content: "worked for it", CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+		evt.PubKey, _ = nostr.GetPublicKey(sk)
+		tag, err := nip13.DoWork(ctx, *evt, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt.Tags = append(evt.Tags, tag)
+		evt.Sign(sk)
+		return evt
+	}
+
+	if reject, msg := rejectInsufficientPow(ctx, mined(8)); reject {
+		t.Fatalf("expected 8 bits of work to pass, got %q", msg)
+	}
+	if reject, msg := rejectInsufficientPow(ctx, signedEvent(t, sk, 1, "no work")); !reject || !strings.HasPrefix(msg, "pow: ") {
+		t.Fatalf("expected an event without work to be rejected, got %v %q", reject, msg)
+	}
+
+	// lucky work for a lower target doesn't count, even when the id happens to qualify
+	lucky := &nostr.Event{Kind: 1, Content: "lucky", CreatedAt: nostr.Now()}
+	lucky.PubKey, _ = nostr.GetPublicKey(sk)
+	for nonce := 0; nip13.Difficulty(lucky.GetID()) < 8; nonce++ {
+		lucky.Tags = nostr.Tags{{"nonce", strconv.Itoa(nonce), "2"}}
+	}
+	lucky.Sign(sk)
+	if reject, msg := rejectInsufficientPow(ctx, lucky); !reject || !strings.Contains(msg, "nonce tag must commit") {
+		t.Fatalf("expected a nonce committing to less to be rejected, got %v %q", reject, msg)
+	}
+}
+
+func TestRejectionMessagesArePrefixed(t *testing.T) {
+	newTestDB(t)
+	config = Config{
+		RequireProfile:     true,
+		MaxEventTags:       1,
+		BlossomBlockedExts: []string{"exe"},
+		BannedWordsKinds:   []int{nostr.KindTextNote},
+	}
+	setTeamData(NostrData{Names: map[string]string{}})
+	blocklist.Store(&eventBlocklist{ids: map[string]bool{}, patterns: []*regexp.Regexp{regexp.MustCompile("spam")}})
+	bannedWords.Store(regexp.MustCompile("(?i)eggs"))
+	t.Cleanup(func() {
+		blocklist.Store(nil)
+		bannedWords.Store(nil)
+	})
+	ctx := context.Background()
+	stranger := signedEvent(t, nostr.GeneratePrivateKey(), nostr.KindTextNote, "spam and eggs")
+	tampered := *stranger
+	tampered.Content = "edited"
+	stranger.Tags = nostr.Tags{{"t", "a"}, {"t", "b"}}
+
+	var messages []string
+	for _, reject := range []func(context.Context, *nostr.Event) (bool, string){
+		rejectOversizedTags, rejectBlocklisted, rejectBannedWords, rejectNonMember, rejectWithoutProfile,
+	} {
+		_, msg := reject(ctx, stranger)
+		messages = append(messages, msg)
+	}
+	_, msg := rejectInvalidSignature(ctx, &tampered)
+	messages = append(messages, msg)
+	_, msg = rejectUnauthedRead(ctx, nostr.Filter{})
+	messages = append(messages, msg)
+	for _, upload := range []struct {
+		size int
+		ext  string
+	}{{maxBlobSize + 1, ".png"}, {1, ".png"}} {
+		_, msg, _ := rejectUploadNonMember(ctx, stranger, upload.size, upload.ext)
+		messages = append(messages, msg)
+	}
+	_, msg, _ = rejectUploadExtension(ctx, stranger, 1, ".exe")
+	messages = append(messages, msg)
+
+	prefixes := []string{prefixInvalid, prefixBlocked, prefixRestricted, prefixAuthRequired, prefixError}
+	for _, msg := range messages {
+		if !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(msg, prefix) }) {
+			t.Errorf("rejection %q has no machine-readable prefix", msg)
+		}
+	}
+}
+
+func TestRejectWithoutRelayHint(t *testing.T) {
+	config = Config{RequireRelayHint: true, RelayURL: "wss://relay.team.example"}
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	for name, tags := range map[string]nostr.Tags{
+		"no tags":           nil,
+		"another relay":     {{"e", strings.Repeat("ab", 32), "wss://elsewhere.example"}},
+		"url in a tag name": {{"wss://relay.team.example"}},
+	} {
+		evt := signedEvent(t, sk, nostr.KindTextNote, "hi")
+		evt.Tags = tags
+		if reject, _ := rejectWithoutRelayHint(ctx, evt); !reject {
+			t.Errorf("%s: expected the event to be rejected", name)
+		}
+	}
+	for name, tags := range map[string]nostr.Tags{
+		"r tag":            {{"r", "wss://relay.team.example"}},
+		"e tag relay hint": {{"e", strings.Repeat("ab", 32), "wss://Relay.Team.example/"}},
+		"p tag relay hint": {{"p", strings.Repeat("cd", 32), "wss://relay.team.example"}},
+	} {
+		evt := signedEvent(t, sk, nostr.KindTextNote, "hi")
+		evt.Tags = tags
+		if reject, msg := rejectWithoutRelayHint(ctx, evt); reject {
+			t.Errorf("%s: expected the event to be accepted, got %q", name, msg)
+		}
+	}
+}
+
+func TestPublicReadKindsSkipReadAuth(t *testing.T) {
+	config = Config{RequireAuthRead: true, PublicReadKinds: []int{0, 10002}}
+	ctx := context.Background()
+
+	for name, filter := range map[string]nostr.Filter{
+		"profiles":               {Kinds: []int{0}},
+		"profiles & relay lists": {Kinds: []int{0, 10002}, Authors: []string{strings.Repeat("ab", 32)}},
+	} {
+		if reject, msg := rejectUnauthedRead(ctx, filter); reject {
+			t.Fatalf("%s: expected no auth to be needed, got %q", name, msg)
+		}
+	}
+	for name, filter := range map[string]nostr.Filter{
+		"notes":            {Kinds: []int{1}},
+		"profiles & notes": {Kinds: []int{0, 1}},
+		"every kind":       {},
+	} {
+		if reject, msg := rejectUnauthedRead(ctx, filter); !reject || !strings.HasPrefix(msg, prefixAuthRequired) {
+			t.Fatalf("%s: expected auth to be required, got %v %q", name, reject, msg)
+		}
+	}
+}
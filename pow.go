@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// rejectInsufficientPow enforces MIN_POW_DIFFICULTY (NIP-13): the event id needs that many
+// leading zero bits, and a nonce tag committing to at least that target, so work done for
+// a lower target that happened to come out better doesn't count. It runs after
+// rejectInvalidSignature, which guarantees a well-formed id. The relay's own key is exempt.
+func rejectInsufficientPow(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if config.MinPowDifficulty <= 0 || isRelayPubkey(event.PubKey) {
+		return false, ""
+	}
+	if nip13.CommittedDifficulty(event) >= config.MinPowDifficulty {
+		return false, ""
+	}
+	if nip13.Difficulty(event.ID) < config.MinPowDifficulty {
+		return true, fmt.Sprintf(prefixPow+"difficulty %d is less than %d", nip13.Difficulty(event.ID), config.MinPowDifficulty)
+	}
+	return true, fmt.Sprintf(prefixPow+"nonce tag must commit to a difficulty of at least %d", config.MinPowDifficulty)
+}
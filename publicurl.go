@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// blobBaseURL is where clients are told to fetch blobs from: BLOSSOM_PUBLIC_URL, e.g. a CDN in
+// front of the blob storage, or BLOSSOM_URL when there is none
+func blobBaseURL() string {
+	if config.BlossomPublicURL != "" {
+		return config.BlossomPublicURL
+	}
+	return *config.BlossomURL
+}
+
+// publicBlobURL is the link to the blob sha256 given out in descriptors
+func publicBlobURL(sha256 string, ext string) string {
+	return joinURL(blobBaseURL(), sha256+ext)
+}
+
+// joinURL appends name to base with exactly one slash between them, however many either
+// side brings
+func joinURL(base string, name string) string {
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(name, "/")
+}
+
+// getEnvBaseURL reads a base URL such as BLOSSOM_URL without its trailing slashes, since
+// khatru appends "/" and the hash to it as is; nil when unset
+func getEnvBaseURL(key string) *string {
+	value := getEnvNullable(key)
+	if value == nil {
+		return nil
+	}
+	trimmed := strings.TrimRight(*value, "/")
+	return &trimmed
+}
+
+// validateBaseURL checks that value, the base URL in the env var key, is an absolute http
+// or https URL that blob names can be appended to
+func validateBaseURL(key string, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid URL: %v", key, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s must start with http:// or https://, got %q", key, value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s has no host: %q", key, value)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%s must not have a query or fragment: %q", key, value)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlossomURLTrailingSlash(t *testing.T) {
+	t.Setenv("BLOSSOM_URL", "https://blobs.example.com/media//")
+	blossomURL := getEnvBaseURL("BLOSSOM_URL")
+	if blossomURL == nil || *blossomURL != "https://blobs.example.com/media" {
+		t.Fatalf("expected the trailing slashes to be stripped, got %v", blossomURL)
+	}
+	config = Config{BlossomURL: blossomURL}
+	hash := strings.Repeat("ab", 32)
+	if got := publicBlobURL(hash, ".png"); got != "https://blobs.example.com/media/"+hash+".png" {
+		t.Fatalf("expected a single slash before the hash, got %s", got)
+	}
+
+	// descriptors are joined properly even from a base that was never normalized
+	config.BlossomPublicURL = "https://cdn.example.com/"
+	if got := publicBlobURL(hash, ""); got != "https://cdn.example.com/"+hash {
+		t.Fatalf("expected a single slash before the hash, got %s", got)
+	}
+	if got := getEnvBaseURL("BLOSSOM_UNSET_URL"); got != nil {
+		t.Fatalf("expected an unset URL to stay nil, got %q", *got)
+	}
+}
+
+func TestBlossomURLMustHaveSchemeAndHost(t *testing.T) {
+	cases := map[string]string{
+		"https://blobs.example.com":      "",
+		"http://localhost:3334/blossom":  "",
+		"blobs.example.com":              "http:// or https://",
+		"ftp://blobs.example.com":        "http:// or https://",
+		"https://":                       "no host",
+		"https://blobs.example.com/?a=b": "query",
+		"https://blobs.example.com/%zz":  "not a valid URL",
+		"//blobs.example.com/no-scheme/": "http:// or https://",
+	}
+	for value, problem := range cases {
+		err := validateBaseURL("BLOSSOM_URL", value)
+		if problem == "" {
+			if err != nil {
+				t.Errorf("%s: expected it to be accepted, got %v", value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), problem) || !strings.Contains(err.Error(), "BLOSSOM_URL") {
+			t.Errorf("%s: expected an error about %q, got %v", value, problem, err)
+		}
+	}
+
+	path, missingScheme := "blossom/", "blobs.example.com"
+	err := validateConfig(Config{BlossomEnabled: true, BlossomPath: &path, BlossomURL: &missingScheme, BlossomPublicURL: "cdn.example.com"})
+	if err == nil || !strings.Contains(err.Error(), "BLOSSOM_URL must start with") || !strings.Contains(err.Error(), "BLOSSOM_PUBLIC_URL must start with") {
+		t.Fatalf("expected both URLs to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// queryCache is an LRU of recent QueryEvents results, bounded by entry count and by the
+// approximate size of the cached events. Entries live for at most ttl and are dropped as
+// soon as an event matching their filter is saved or deleted through the relay.
+type queryCache struct {
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	entries map[[32]byte]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int
+	gen     uint64 // bumped on every invalidation
+}
+
+type queryCacheEntry struct {
+	key     [32]byte
+	filter  nostr.Filter
+	events  []*nostr.Event
+	size    int
+	expires time.Time
+}
+
+func newQueryCache(ttl time.Duration, maxEntries int, maxBytes int) *queryCache {
+	return &queryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[[32]byte]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// query wraps a QueryEvents hook, serving repeated filters from the cache
+func (qc *queryCache) query(next func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		key := filterKey(filter)
+		if events, ok := qc.get(key); ok {
+			return replayEvents(ctx, events), nil
+		}
+
+		gen := qc.generation()
+		results, err := next(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			var events []*nostr.Event
+			for evt := range results {
+				select {
+				case ch <- evt:
+					events = append(events, evt)
+				case <-ctx.Done():
+					// a partial result must not be cached
+					return
+				}
+			}
+			qc.put(key, filter, events, gen)
+		}()
+		return ch, nil
+	}
+}
+
+// invalidate drops every cached result whose filter matches evt. It has the OnEventSaved
+// signature; wrap it for DeleteEvent.
+func (qc *queryCache) invalidate(ctx context.Context, evt *nostr.Event) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.gen++
+	for elem := qc.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*queryCacheEntry); entry.filter.Matches(evt) {
+			qc.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (qc *queryCache) generation() uint64 {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	return qc.gen
+}
+
+func (qc *queryCache) get(key [32]byte) ([]*nostr.Event, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	elem, ok := qc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*queryCacheEntry)
+	if time.Now().After(entry.expires) {
+		qc.remove(elem)
+		return nil, false
+	}
+	qc.lru.MoveToFront(elem)
+	return entry.events, true
+}
+
+// put stores a result unless an event was saved or deleted since the query started (gen),
+// in which case the result may already be stale
+func (qc *queryCache) put(key [32]byte, filter nostr.Filter, events []*nostr.Event, gen uint64) {
+	size := 0
+	for _, evt := range events {
+		size += eventSize(evt)
+	}
+	if size > qc.maxBytes {
+		return
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.gen != gen {
+		return
+	}
+
+	if elem, ok := qc.entries[key]; ok {
+		qc.remove(elem)
+	}
+	qc.entries[key] = qc.lru.PushFront(&queryCacheEntry{
+		key:     key,
+		filter:  filter,
+		events:  events,
+		size:    size,
+		expires: time.Now().Add(qc.ttl),
+	})
+	qc.bytes += size
+
+	for qc.lru.Len() > qc.maxEntries || qc.bytes > qc.maxBytes {
+		qc.remove(qc.lru.Back())
+	}
+}
+
+// remove must be called with qc.mu held
+func (qc *queryCache) remove(elem *list.Element) {
+	entry := qc.lru.Remove(elem).(*queryCacheEntry)
+	delete(qc.entries, entry.key)
+	qc.bytes -= entry.size
+}
+
+// filterKey hashes a canonical form of filter, so filters that only differ in the order of
+// their ids, authors, kinds or tag values share a cache entry
+func filterKey(filter nostr.Filter) [32]byte {
+	canonical := filter
+	canonical.IDs = slices.Sorted(slices.Values(filter.IDs))
+	canonical.Authors = slices.Sorted(slices.Values(filter.Authors))
+	canonical.Kinds = slices.Sorted(slices.Values(filter.Kinds))
+	if filter.Tags != nil {
+		canonical.Tags = make(nostr.TagMap, len(filter.Tags))
+		for name, values := range filter.Tags {
+			canonical.Tags[name] = slices.Sorted(slices.Values(values))
+		}
+	}
+	raw, _ := json.Marshal(canonical)
+	return sha256.Sum256(raw)
+}
+
+// eventSize approximates the memory held by a cached event
+func eventSize(evt *nostr.Event) int {
+	size := 64 + 64 + 128 + 8 + 8 + len(evt.Content) // id, pubkey, sig, created_at, kind
+	for _, tag := range evt.Tags {
+		for _, item := range tag {
+			size += len(item)
+		}
+	}
+	return size
+}
+
+func replayEvents(ctx context.Context, events []*nostr.Event) chan *nostr.Event {
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		now := nostr.Now()
+		for _, evt := range events {
+			if isExpired(evt, now) {
+				continue
+			}
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
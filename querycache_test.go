@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryCacheServesAndInvalidates(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	cache := newQueryCache(time.Minute, 10, 1<<20)
+	query := cache.query(db.QueryEvents)
+
+	count := func(filter nostr.Filter) int {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	first := signedEvent(t, sk, nostr.KindTextNote, "one")
+	db.SaveEvent(ctx, first)
+	filter := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindTextNote, nostr.KindProfileMetadata}}
+	if n := count(filter); n != 1 {
+		t.Fatalf("expected 1 event, got %d", n)
+	}
+
+	// stored behind the cache's back: a reordered but equivalent filter still hits the cache
+	second := signedEvent(t, sk, nostr.KindTextNote, "two")
+	db.SaveEvent(ctx, second)
+	reordered := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindProfileMetadata, nostr.KindTextNote}}
+	if n := count(reordered); n != 1 {
+		t.Fatalf("expected cached result of 1 event, got %d", n)
+	}
+
+	cache.invalidate(ctx, second)
+	if n := count(filter); n != 2 {
+		t.Fatalf("expected 2 events after invalidation, got %d", n)
+	}
+}
+
+func TestQueryCacheEvictsByEntryCount(t *testing.T) {
+	cache := newQueryCache(time.Minute, 2, 1<<20)
+	for kind := 1; kind <= 3; kind++ {
+		filter := nostr.Filter{Kinds: []int{kind}}
+		cache.put(filterKey(filter), filter, nil, 0)
+	}
+	if cache.lru.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", cache.lru.Len())
+	}
+	if _, ok := cache.get(filterKey(nostr.Filter{Kinds: []int{1}})); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// cancellableBackend makes QueryEvents honor ctx for backends that don't. lmdb and badger
+// send their results from inside a read transaction without watching the context, so when
+// the client behind a query goes away mid-stream and nothing reads on, their goroutine
+// blocks forever and the transaction stays open, keeping lmdb from reusing pages. Here the
+// results are passed on only until ctx is done; the channel is then closed and the rest
+// are read off in the background, which is quick since these backends have already
+// collected them, so the backend finishes and lets go of the transaction.
+type cancellableBackend struct {
+	DBBackend
+}
+
+func (b cancellableBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	events, err := b.DBBackend.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return forwardUntilDone(ctx, events), nil
+}
+
+// forwardUntilDone passes events on until they run out or ctx is done, and after that
+// drains them so whatever is producing them can finish
+func forwardUntilDone(ctx context.Context, events chan *nostr.Event) chan *nostr.Event {
+	ch := make(chan *nostr.Event)
+	go func() {
+		for evt := range events {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				close(ch)
+				for range events {
+				}
+				return
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
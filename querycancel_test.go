@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// stubbornBackend sends its results the way lmdb and badger do, without watching the context
+type stubbornBackend struct {
+	DBBackend
+	done chan struct{}
+}
+
+func (b stubbornBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(b.done)
+		defer close(ch)
+		for i := range 100 {
+			ch <- &nostr.Event{ID: string(rune('a' + i%26)), Kind: 1, Tags: nostr.Tags{}}
+		}
+	}()
+	return ch, nil
+}
+
+func TestQueryStopsWhenTheClientGoesAway(t *testing.T) {
+	newTestDB(t)
+	backend := stubbornBackend{DBBackend: db, done: make(chan struct{})}
+	db = scanSearchBackend{cancellableBackend{backend}}
+	baseline := runtime.NumGoroutine()
+
+	cache := newQueryCache(time.Minute, 10, 1<<20)
+	query := traceQuery(cache.query(queryUnexpired))
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := query(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, ok := <-ch; !ok {
+			t.Fatal("expected the query to stream events")
+		}
+	}
+	cancel()
+
+	select {
+	case <-backend.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the backend to be released once the query was cancelled")
+	}
+	deadline := time.After(2 * time.Second)
+	for range ch {
+		// whatever was already in flight; the channel must close
+		select {
+		case <-deadline:
+			t.Fatal("expected the query channel to close after cancellation")
+		default:
+		}
+	}
+	for runtime.NumGoroutine() > baseline {
+		select {
+		case <-deadline:
+			t.Fatalf("expected no goroutines left behind, %d more than before", runtime.NumGoroutine()-baseline)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
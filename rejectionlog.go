@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// rejectionLogLevels are the values REJECTION_LOG_LEVEL accepts. "off" logs nothing.
+var rejectionLogLevels = map[string]slog.Level{
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logRejections wraps a RejectEvent policy so every event it refuses is logged, with the
+// policy's name, the event's id, pubkey and kind, the sender's IP and the reason given to the
+// client, at REJECTION_LOG_LEVEL
+func logRejections(policy string, check func(context.Context, *nostr.Event) (bool, string)) func(context.Context, *nostr.Event) (bool, string) {
+	level, ok := rejectionLogLevels[config.RejectionLogLevel]
+	if !ok {
+		return check
+	}
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		reject, msg = check(ctx, event)
+		if reject {
+			ctx = eventContext(ctx, event)
+			requestLogger(ctx).Log(ctx, level, "event rejected",
+				"policy", policy,
+				"id", event.ID,
+				"pubkey", event.PubKey,
+				"kind", event.Kind,
+				"ip", khatru.GetIP(ctx),
+				"reason", strings.TrimSpace(msg),
+			)
+		}
+		return reject, msg
+	}
+}
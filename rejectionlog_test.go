@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRejectionsAreLogged(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	setTeamData(NostrData{})
+	config = Config{RejectionLogLevel: "warn"}
+
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), 1, "let me in")
+	if reject, _ := logRejections("membership", rejectNonMember)(context.Background(), evt); !reject {
+		t.Fatal("expected a non-member to be rejected")
+	}
+	line := out.String()
+	for _, want := range []string{"level=WARN", "policy=membership", "id=" + evt.ID, "pubkey=" + evt.PubKey, "kind=1", "you are not part of the team", "request_id=evt-" + evt.ID[:16]} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("expected %q in the rejection log, got %q", want, line)
+		}
+	}
+
+	out.Reset()
+	config.RejectionLogLevel = "off"
+	logRejections("membership", rejectNonMember)(context.Background(), evt)
+	if out.Len() > 0 {
+		t.Fatalf("expected nothing logged with REJECTION_LOG_LEVEL=off, got %q", out.String())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayLists holds the latest NIP-65 relay list (kind 10002) of every author we store one for
+var relayLists = newRelayListIndex()
+
+// relayList is an author's NIP-65 preferences: where they publish and where they read
+type relayList struct {
+	ID        string
+	CreatedAt nostr.Timestamp
+	Read      []string
+	Write     []string
+}
+
+// relayListIndex keeps the parsed relay lists by pubkey, so looking one up doesn't cost a query
+type relayListIndex struct {
+	mu    sync.RWMutex
+	lists map[string]relayList
+}
+
+func newRelayListIndex() *relayListIndex {
+	return &relayListIndex{lists: make(map[string]relayList)}
+}
+
+// parseRelayList reads the "r" tags of a kind-10002 event. A tag without a marker means the
+// relay is used for both reading and writing; URLs that aren't websocket URLs are skipped.
+func parseRelayList(evt *nostr.Event) relayList {
+	list := relayList{ID: evt.ID, CreatedAt: evt.CreatedAt}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		if raw := strings.ToLower(tag[1]); !strings.HasPrefix(raw, "ws://") && !strings.HasPrefix(raw, "wss://") {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		marker := ""
+		if len(tag) >= 3 {
+			marker = tag[2]
+		}
+		if marker == "" || marker == "read" {
+			list.Read = append(list.Read, url)
+		}
+		if marker == "" || marker == "write" {
+			list.Write = append(list.Write, url)
+		}
+	}
+	return list
+}
+
+// load fills the index from the relay lists already in the store
+func (idx *relayListIndex) load(ctx context.Context) error {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{nostr.KindRelayListMetadata}})
+	if err != nil {
+		return err
+	}
+	for evt := range ch {
+		idx.saved(ctx, evt)
+	}
+	idx.mu.RLock()
+	log.Printf("Relay lists: %d authors", len(idx.lists))
+	idx.mu.RUnlock()
+	return nil
+}
+
+// saved is an OnEventSaved hook that records a newer relay list for its author
+func (idx *relayListIndex) saved(ctx context.Context, evt *nostr.Event) {
+	if evt.Kind != nostr.KindRelayListMetadata {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if current, ok := idx.lists[evt.PubKey]; ok && current.CreatedAt > evt.CreatedAt {
+		return
+	}
+	idx.lists[evt.PubKey] = parseRelayList(evt)
+}
+
+// deleted is a DeleteEvent hook that forgets a relay list once it is removed from the store
+func (idx *relayListIndex) deleted(ctx context.Context, evt *nostr.Event) error {
+	if evt.Kind != nostr.KindRelayListMetadata {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if current, ok := idx.lists[evt.PubKey]; ok && current.ID == evt.ID {
+		delete(idx.lists, evt.PubKey)
+	}
+	return nil
+}
+
+// writeRelays is where pubkey publishes: the write relays of their NIP-65 list, or for a team
+// member without one, the relays listed for them in nostr.json
+func (idx *relayListIndex) writeRelays(pubkey string) []string {
+	idx.mu.RLock()
+	list, ok := idx.lists[pubkey]
+	idx.mu.RUnlock()
+	if ok && len(list.Write) > 0 {
+		return list.Write
+	}
+	return teamData().Relays[pubkey]
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRelayListIndexTracksWriteRelays(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	member := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	setTeamData(NostrData{Relays: map[string][]string{member: {"wss://member.example"}}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+
+	list := &nostr.Event{
+		Kind:      nostr.KindRelayListMetadata,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"r", "wss://Both.example/"},
+			{"r", "wss://read.example", "read"},
+			{"r", "wss://write.example", "write"},
+			{"r", "https://not-a-relay.example"},
+			{"r"},
+		},
+	}
+	if err := list.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveEvent(ctx, list); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newRelayListIndex()
+	if err := idx.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.writeRelays(pk); !slices.Equal(got, []string{"wss://both.example", "wss://write.example"}) {
+		t.Fatalf("unexpected write relays %v", got)
+	}
+	if got := idx.lists[pk].Read; !slices.Equal(got, []string{"wss://both.example", "wss://read.example"}) {
+		t.Fatalf("unexpected read relays %v", got)
+	}
+
+	older := &nostr.Event{Kind: nostr.KindRelayListMetadata, CreatedAt: list.CreatedAt - 10, Tags: nostr.Tags{{"r", "wss://old.example"}}}
+	older.Sign(sk)
+	idx.saved(ctx, older)
+	if got := idx.writeRelays(pk); slices.Contains(got, "wss://old.example") {
+		t.Fatalf("expected an older list not to replace the current one, got %v", got)
+	}
+
+	idx.deleted(ctx, list)
+	if got := idx.writeRelays(pk); got != nil {
+		t.Fatalf("expected no write relays once the list was deleted, got %v", got)
+	}
+	if got := idx.writeRelays(member); !slices.Equal(got, []string{"wss://member.example"}) {
+		t.Fatalf("expected the nostr.json relays for a member without a list, got %v", got)
+	}
+}
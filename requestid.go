@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLength bounds an inbound X-Request-ID; longer ones are replaced
+const maxRequestIDLength = 128
+
+// withRequestID gives every request an id, the client's X-Request-ID when it sent a sensible
+// one and a random one otherwise. It goes in the request's context, for requestLogger to add
+// to every structured log line about the request, and in the X-Request-ID response header,
+// so a client reporting an error can quote it. It wraps everything else, the access log
+// included. Websocket upgrades get one in their response too, but khatru does not pass the
+// request's context on to its event hooks; see eventContext.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of letters, digits and . _ - : only, so a client can't inject
+// anything odd into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID is the id withRequestID stored in ctx, or "" outside an HTTP request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// eventContext gives ctx a request id for event, for hooks that run per event. khatru hands
+// every message on a websocket the same connection context, so events that arrived that way
+// are identified by their own id instead: "evt-" and its first 16 hex digits, the same in
+// every hook that sees the event.
+func eventContext(ctx context.Context, event *nostr.Event) context.Context {
+	if requestID(ctx) != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, "evt-"+event.ID[:min(len(event.ID), 16)])
+}
+
+// requestLogger is the default slog logger with the request id from ctx, if any, attached as
+// request_id; every structured log line about a request or event goes through it
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
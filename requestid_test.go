@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDIsLoggedAndReturned(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	var seen string
+	handler := withRequestID(withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+		http.Error(w, "nope", http.StatusForbidden)
+	})))
+
+	req := httptest.NewRequest("GET", "/anything", nil)
+	req.Header.Set("X-Request-ID", "client-trace.42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen != "client-trace.42" || rec.Header().Get("X-Request-ID") != "client-trace.42" {
+		t.Fatalf("expected the inbound id to be kept, got %q in context and %q in the response", seen, rec.Header().Get("X-Request-ID"))
+	}
+	if !strings.Contains(out.String(), "request_id=client-trace.42") {
+		t.Fatalf("expected the access log line to carry the request id, got %q", out.String())
+	}
+
+	for _, inbound := range []string{"", "has spaces in it", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest("GET", "/anything", nil)
+		req.Header.Set("X-Request-ID", inbound)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Request-ID"); got == inbound || !validRequestID(got) || got != seen {
+			t.Errorf("inbound %q: expected a fresh id, got %q (context %q)", inbound, got, seen)
+		}
+	}
+}
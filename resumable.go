@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+// Resumable uploads send a blob in chunks to /upload/<sha256>, so a dropped connection only
+// costs the chunk in flight:
+//
+//	HEAD  /upload/<sha256>  answers Upload-Offset (bytes received so far) and Upload-Length
+//	PATCH /upload/<sha256>  appends the body at Upload-Offset; the first chunk also carries
+//	                        Upload-Length (the full size) and optionally X-Content-Type
+//
+// Each request needs the same upload authorization as PUT /upload. Once Upload-Length bytes
+// have arrived the blob is verified against the sha256 and stored like any other upload, and
+// the PATCH answers with its blob descriptor. Partial data lives under partialUploadDir and is
+// dropped when no chunk arrives for PARTIAL_UPLOAD_TIMEOUT.
+
+// partialUploadDir is where partial uploads are kept, relative to BlossomPath
+const partialUploadDir = "partial/"
+
+// partialUploadSweep is how often abandoned partial uploads are looked for
+const partialUploadSweep = time.Minute
+
+type partialUpload struct {
+	// busy serializes chunks, so a retried chunk can't interleave with the original
+	busy sync.Mutex
+
+	pubkey    string
+	length    int64
+	ext       string
+	offset    int64
+	lastWrite time.Time
+}
+
+var (
+	partialUploadsMu sync.Mutex
+	partialUploads   = map[string]*partialUpload{}
+)
+
+func partialUploadPath(sha256 string) string {
+	return *config.BlossomPath + partialUploadDir + sha256
+}
+
+// cleanupPartialUploads clears the partial upload area. Offsets are only tracked in memory,
+// so whatever is left from before a restart can't be resumed.
+func cleanupPartialUploads() {
+	dir := *config.BlossomPath + partialUploadDir
+	if err := fs.RemoveAll(dir); err != nil {
+		log.Printf("Error clearing partial uploads in %s: %v", dir, err)
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating partial upload directory %s: %v", dir, err)
+	}
+}
+
+// sweepPartialUploadsEvery drops partial uploads that haven't received a chunk within timeout
+func sweepPartialUploadsEvery(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := sweepPartialUploads(timeout); n > 0 {
+			log.Printf("Dropped %d abandoned partial uploads", n)
+		}
+	}
+}
+
+func sweepPartialUploads(timeout time.Duration) int {
+	partialUploadsMu.Lock()
+	defer partialUploadsMu.Unlock()
+
+	dropped := 0
+	for sha256, upload := range partialUploads {
+		// a chunk being written right now isn't abandoned
+		if !upload.busy.TryLock() {
+			continue
+		}
+		if time.Since(upload.lastWrite) > timeout {
+			fs.Remove(partialUploadPath(sha256))
+			delete(partialUploads, sha256)
+			dropped++
+		}
+		upload.busy.Unlock()
+	}
+	return dropped
+}
+
+// handleResumableUpload serves HEAD and PATCH /upload/<sha256>
+func handleResumableUpload(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string) {
+	if r.Method != http.MethodHead && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pubkey, ok := requireUploadAuth(w, r, hash)
+	if !ok {
+		return
+	}
+	// every request's authorization must be as fresh as a PUT /upload's, and starting an
+	// upload uses it up the same way
+	if _, _, err := uploadAuthUses(r); err != nil {
+		writeAuthUseError(w, err)
+		return
+	}
+
+	partialUploadsMu.Lock()
+	upload := partialUploads[hash]
+	partialUploadsMu.Unlock()
+
+	if r.Method == http.MethodHead {
+		if upload == nil {
+			writeBlobError(w, "no upload in progress", http.StatusNotFound)
+			return
+		}
+		upload.busy.Lock()
+		defer upload.busy.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeBlobError(w, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if upload == nil {
+		if offset != 0 {
+			w.Header().Set("Upload-Offset", "0")
+			writeBlobError(w, "no upload in progress, start at offset 0", http.StatusConflict)
+			return
+		}
+		if err := checkUploadAuth(r); err != nil {
+			writeAuthUseError(w, err)
+			return
+		}
+		if upload, ok = startPartialUpload(bl, w, r, hash, pubkey); !ok {
+			return
+		}
+	}
+
+	upload.busy.Lock()
+	defer upload.busy.Unlock()
+
+	partialUploadsMu.Lock()
+	current := partialUploads[hash] == upload
+	partialUploadsMu.Unlock()
+	if !current {
+		w.Header().Set("Upload-Offset", "0")
+		writeBlobError(w, "upload expired, start again at offset 0", http.StatusConflict)
+		return
+	}
+	if upload.pubkey != pubkey {
+		writeAuthError(w, "upload was started by another pubkey", http.StatusForbidden)
+		return
+	}
+	if offset != upload.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		writeBlobError(w, fmt.Sprintf("expected Upload-Offset %d", upload.offset), http.StatusConflict)
+		return
+	}
+
+	if !checkBlobStorage() {
+		writeBlobError(w, errBlobStorageUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	release, ok := acquireUploadSlot(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	written, err := appendChunk(hash, upload, r.Body)
+	upload.offset += written
+	upload.lastWrite = time.Now()
+	switch {
+	case errors.Is(err, errBlobTooLarge):
+		dropPartialUpload(hash)
+		writeBlobError(w, "chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errBlobStorageFull):
+		writeBlobError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		// the client resumes from the offset we report, whatever part of the chunk made it
+		log.Printf("ResumableUpload: chunk for %s interrupted at %d: %v", hash, upload.offset, err)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		writeBlobError(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	if upload.offset < upload.length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	finishPartialUpload(bl, w, r, hash, upload)
+}
+
+// startPartialUpload checks a new upload like PUT /upload would and registers it
+func startPartialUpload(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string, pubkey string) (*partialUpload, bool) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeBlobError(w, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var ext string
+	if exts, _ := mime.ExtensionsByType(r.Header.Get("X-Content-Type")); len(exts) > 0 {
+		ext = exts[0]
+	}
+	for _, rejectUpload := range bl.RejectUpload {
+		if reject, reason, code := rejectUpload(r.Context(), &nostr.Event{PubKey: pubkey}, int(length), ext); reject {
+			writeBlobError(w, reason, code)
+			return nil, false
+		}
+	}
+
+	partialUploadsMu.Lock()
+	defer partialUploadsMu.Unlock()
+	// another request may have started it in the meantime
+	if upload := partialUploads[hash]; upload != nil {
+		return upload, true
+	}
+	if err := afero.WriteFile(fs, partialUploadPath(hash), nil, 0644); err != nil {
+		writeBlobError(w, blobStorageFailure(hash, partialUploadPath(hash), err).Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	upload := &partialUpload{pubkey: pubkey, length: length, ext: ext, lastWrite: time.Now()}
+	partialUploads[hash] = upload
+	return upload, true
+}
+
+// appendChunk writes body to the end of the partial file, refusing anything past its length
+func appendChunk(hash string, upload *partialUpload, body io.Reader) (int64, error) {
+	path := partialUploadPath(hash)
+	file, err := fs.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, blobStorageFailure(hash, path, err)
+	}
+	defer file.Close()
+
+	remaining := upload.length - upload.offset
+	dst := &writeErrRecorder{Writer: file}
+	written, err := io.Copy(dst, io.LimitReader(body, remaining))
+	if dst.err != nil {
+		return written, blobStorageFailure(hash, path, dst.err)
+	}
+	if err != nil {
+		return written, err
+	}
+	if written == remaining {
+		if n, _ := body.Read(make([]byte, 1)); n > 0 {
+			return written, errBlobTooLarge
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return written, blobStorageFailure(hash, path, err)
+	}
+	return written, nil
+}
+
+// writeErrRecorder tells write failures apart from the client going away mid-chunk
+type writeErrRecorder struct {
+	io.Writer
+	err error
+}
+
+func (w *writeErrRecorder) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func dropPartialUpload(hash string) {
+	partialUploadsMu.Lock()
+	delete(partialUploads, hash)
+	partialUploadsMu.Unlock()
+	fs.Remove(partialUploadPath(hash))
+}
+
+// finishPartialUpload verifies the assembled blob, moves it into place and records the
+// uploader as an owner. A blob that doesn't hash to sha256 is thrown away.
+func finishPartialUpload(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request, hash string, upload *partialUpload) {
+	path := partialUploadPath(hash)
+	defer dropPartialUpload(hash)
+
+	file, err := fs.Open(path)
+	if err != nil {
+		writeBlobError(w, blobStorageFailure(hash, path, err).Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), mirrorTimeout)
+	defer cancel()
+	_, err = verifyAndStore(ctx, hash, file)
+	file.Close()
+	switch {
+	case errors.Is(err, errHashMismatch):
+		writeBlobError(w, "assembled blob does not match its sha256", http.StatusBadRequest)
+		return
+	case errors.Is(err, errBlobFlagged), errors.Is(err, errModerationUnavailable):
+		writeModerationError(w, err)
+		return
+	case errors.Is(err, errBlobStorageFull):
+		writeBlobError(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		writeBlobError(w, "failed to store blob", http.StatusInternalServerError)
+		return
+	}
+
+	contentType, ext, err := detectStoredBlobType(hash, mime.TypeByExtension(upload.ext))
+	if err != nil {
+		log.Printf("ResumableUpload: Failed to detect the type of %s: %v", hash, err)
+		contentType, ext = mime.TypeByExtension(upload.ext), upload.ext
+	}
+	descriptor := blossom.BlobDescriptor{
+		URL:      publicBlobURL(hash, ext),
+		SHA256:   hash,
+		Size:     int(upload.length),
+		Type:     contentType,
+		Uploaded: nostr.Now(),
+	}
+	if err := bl.Store.Keep(r.Context(), descriptor, upload.pubkey); err != nil {
+		log.Printf("ResumableUpload: Failed to index %s for %s: %v", hash, upload.pubkey, err)
+		writeBlobError(w, "failed to save blob entry", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Assembled resumable upload %s (%d bytes)", hash, upload.length)
+	writeBlobDescriptor(w, descriptor)
+}
+
+// uploadHashFromPath extracts the sha256 from an /upload/<sha256> path
+func uploadHashFromPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/upload/")
+	if !ok || !isValidSha256(rest) {
+		return ""
+	}
+	return strings.ToLower(rest)
+}
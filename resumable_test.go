@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestResumableUploadAssemblesChunks(t *testing.T) {
+	bl := newTestBlossom(t)
+	cleanupPartialUploads()
+	t.Cleanup(func() { partialUploads = map[string]*partialUpload{} })
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+
+	content := "first chunk|second chunk"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	chunk := func(offset int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/upload/"+hash, strings.NewReader(body))
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		req.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+		req.Header.Set("X-Content-Type", "image/png")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, withBlossomAuth(t, req, member, "upload", nostr.Tag{"x", hash}))
+		return rec
+	}
+
+	if rec := chunk(0, content[:12]); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "12" {
+		t.Fatalf("expected the first chunk to be accepted at offset 12, got %d %q: %s", rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("X-Reason"))
+	}
+
+	// a client that lost track asks where to resume
+	req := withBlossomAuth(t, httptest.NewRequest("HEAD", "/upload/"+hash, nil), member, "upload", nostr.Tag{"x", hash})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "12" || rec.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("expected HEAD to report offset 12, got %d %v", rec.Code, rec.Header())
+	}
+
+	if rec := chunk(5, content[5:]); rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != "12" {
+		t.Fatalf("expected a wrong offset to be refused with the current one, got %d %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+
+	rec = chunk(12, content[12:])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the last chunk to complete the upload, got %d: %s", rec.Code, rec.Header().Get("X-Reason"))
+	}
+	if !strings.Contains(rec.Body.String(), `"sha256":"`+hash+`"`) || !strings.Contains(rec.Body.String(), hash+".png") {
+		t.Fatalf("expected a blob descriptor, got %s", rec.Body.String())
+	}
+	if stored, err := afero.ReadFile(fs, *config.BlossomPath+hash); err != nil || string(stored) != content {
+		t.Fatalf("expected the assembled blob to be stored, got %q (%v)", stored, err)
+	}
+	if exists, _ := afero.Exists(fs, partialUploadPath(hash)); exists {
+		t.Fatal("expected the partial file to be removed")
+	}
+	if descriptor, err := bl.Store.Get(context.Background(), hash); err != nil || descriptor == nil {
+		t.Fatalf("expected the blob to be indexed, got %v (%v)", descriptor, err)
+	}
+}
+
+func TestResumableUploadRejectsMismatchedContent(t *testing.T) {
+	bl := newTestBlossom(t)
+	cleanupPartialUploads()
+	t.Cleanup(func() { partialUploads = map[string]*partialUpload{} })
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+
+	hash := strings.Repeat("ab", 32)
+	req := httptest.NewRequest("PATCH", "/upload/"+hash, strings.NewReader("not it"))
+	req.Header.Set("Upload-Offset", "0")
+	req.Header.Set("Upload-Length", "6")
+	rec := httptest.NewRecorder()
+	withBlobRoutes(bl, http.NotFoundHandler()).ServeHTTP(rec, withBlossomAuth(t, req, member, "upload"))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for content that doesn't match the hash, got %d", rec.Code)
+	}
+	if exists, _ := afero.Exists(fs, *config.BlossomPath+hash); exists {
+		t.Fatal("expected nothing to be stored")
+	}
+	if len(partialUploads) != 0 {
+		t.Fatal("expected the partial upload to be dropped")
+	}
+}
+
+func TestResumableUploadChecksAuthorizationAge(t *testing.T) {
+	bl := newTestBlossom(t)
+	cleanupPartialUploads()
+	config.UploadAuthMaxAge = 10 * time.Minute
+	uploadAuths = newSeenAuthEvents(maxSeenAuthEvents)
+	t.Cleanup(func() { partialUploads = map[string]*partialUpload{} })
+	member := nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+	start := func(hash string, auth string) int {
+		req := httptest.NewRequest("PATCH", "/upload/"+hash, strings.NewReader("chunk"))
+		req.Header.Set("Upload-Offset", "0")
+		req.Header.Set("Upload-Length", "100")
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	stale := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Timestamp(time.Now().Add(-time.Hour).Unix()),
+		Tags:      nostr.Tags{{"t", "upload"}, {"expiration", "9999999999"}},
+	}
+	stale.Sign(member)
+	raw, _ := json.Marshal(stale)
+	if code := start(strings.Repeat("aa", 32), "Nostr "+base64.StdEncoding.EncodeToString(raw)); code != http.StatusUnauthorized {
+		t.Fatalf("expected an hour-old authorization to get 401, got %d", code)
+	}
+
+	auth := withBlossomAuth(t, httptest.NewRequest("PATCH", "/upload", nil), member, "upload").Header.Get("Authorization")
+	if code := start(strings.Repeat("bb", 32), auth); code != http.StatusNoContent {
+		t.Fatalf("expected a fresh authorization to start an upload, got %d", code)
+	}
+	if code := start(strings.Repeat("cc", 32), auth); code != http.StatusUnauthorized {
+		t.Fatalf("expected the used authorization not to start another upload, got %d", code)
+	}
+}
+
+func TestSweepPartialUploadsDropsAbandoned(t *testing.T) {
+	newTestBlossom(t)
+	cleanupPartialUploads()
+	t.Cleanup(func() { partialUploads = map[string]*partialUpload{} })
+
+	stale, fresh := strings.Repeat("aa", 32), strings.Repeat("bb", 32)
+	for hash, lastWrite := range map[string]time.Time{stale: time.Now().Add(-2 * time.Hour), fresh: time.Now()} {
+		afero.WriteFile(fs, partialUploadPath(hash), []byte("partial"), 0644)
+		partialUploads[hash] = &partialUpload{length: 100, offset: 7, lastWrite: lastWrite}
+	}
+
+	if n := sweepPartialUploads(time.Hour); n != 1 {
+		t.Fatalf("expected one abandoned upload to be dropped, got %d", n)
+	}
+	if _, ok := partialUploads[stale]; ok {
+		t.Fatal("expected the stale upload to be forgotten")
+	}
+	if exists, _ := afero.Exists(fs, partialUploadPath(stale)); exists {
+		t.Fatal("expected the stale partial file to be removed")
+	}
+	if _, ok := partialUploads[fresh]; !ok {
+		t.Fatal("expected the fresh upload to be kept")
+	}
+}
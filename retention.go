@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// retentionKindPrefix starts the env vars that give a kind a maximum age, e.g.
+// RETENTION_KIND_7=720h; kinds without one are kept forever
+const retentionKindPrefix = "RETENTION_KIND_"
+
+// getEnvKindRetention collects every non-empty RETENTION_KIND_<kind> variable into a map from
+// kind to how long its events are kept
+func getEnvKindRetention() map[int]time.Duration {
+	retention := map[int]time.Duration{}
+	for kind, key := range getEnvKindVars(retentionKindPrefix) {
+		retention[kind] = getEnvDuration(key, 0)
+	}
+	return retention
+}
+
+// pruneEventsEvery runs pruneRetainedEvents on a fixed interval
+func pruneEventsEvery(interval time.Duration, retention map[int]time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruneRetainedEvents(context.Background(), retention)
+	}
+}
+
+// pruneRetainedEvents deletes every event older than its kind's retention and logs how many
+// went, kind by kind. It returns the total deleted.
+func pruneRetainedEvents(ctx context.Context, retention map[int]time.Duration) int {
+	kinds := make([]int, 0, len(retention))
+	for kind := range retention {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+
+	total := 0
+	var counts []string
+	for _, kind := range kinds {
+		cutoff := nostr.Timestamp(time.Now().Add(-retention[kind]).Unix())
+		deleted, err := deleteEventsBefore(ctx, kind, cutoff)
+		if err != nil {
+			log.Printf("Retention: query for kind %d failed: %v", kind, err)
+		}
+		if deleted > 0 {
+			counts = append(counts, fmt.Sprintf("kind %d: %d", kind, deleted))
+			total += deleted
+		}
+	}
+	if total > 0 {
+		log.Printf("Retention: pruned %d events (%s)", total, strings.Join(counts, ", "))
+	}
+	return total
+}
+
+// deleteEventsBefore deletes the events of kind created at or before cutoff, a page at a
+// time. Deleted events drop out of the next query, so it stops at the first page that
+// deletes nothing: an empty one, or one where every delete failed.
+func deleteEventsBefore(ctx context.Context, kind int, cutoff nostr.Timestamp) (int, error) {
+	deleted := 0
+	for {
+		ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{kind}, Until: &cutoff, Limit: expirationSweepPage})
+		if err != nil {
+			return deleted, err
+		}
+		pageDeleted := 0
+		for evt := range ch {
+			if err := db.DeleteEvent(ctx, evt); err != nil {
+				log.Printf("Failed to delete %s: %v", evt.ID, err)
+				continue
+			}
+			pageDeleted++
+		}
+		if pageDeleted == 0 {
+			return deleted, ctx.Err()
+		}
+		deleted += pageDeleted
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPruneRetainedEvents(t *testing.T) {
+	t.Setenv("RETENTION_KIND_7", "720h")
+	t.Setenv("RETENTION_KIND_1", "")
+	retention := getEnvKindRetention()
+	if len(retention) != 1 || retention[7] != 720*time.Hour {
+		t.Fatalf("expected a 30 day retention for kind 7 only, got %v", retention)
+	}
+
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	month := nostr.Timestamp(31 * 24 * 60 * 60)
+	stored := map[string]bool{}
+	for i, evt := range []struct {
+		kind int
+		age  nostr.Timestamp
+		kept bool
+	}{
+		{7, 0, true},
+		{7, month, false},
+		{7, 2 * month, false},
+		{1, 2 * month, true},
+		{6, month, true},
+	} {
+		e := &nostr.Event{Kind: evt.kind, CreatedAt: nostr.Now() - evt.age, Content: string(rune('a' + i)), Tags: nostr.Tags{}}
+		if err := e.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		stored[e.ID] = evt.kept
+	}
+
+	if pruned := pruneRetainedEvents(ctx, retention); pruned != 2 {
+		t.Fatalf("expected both old reactions to be pruned, got %d", pruned)
+	}
+	ch, err := db.QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := 0
+	for evt := range ch {
+		if !stored[evt.ID] {
+			t.Errorf("expected kind %d event from %s to be pruned", evt.Kind, evt.CreatedAt.Time())
+		}
+		left++
+	}
+	if left != 3 {
+		t.Fatalf("expected 3 events to be kept, got %d", left)
+	}
+	if pruned := pruneRetainedEvents(ctx, retention); pruned != 0 {
+		t.Fatalf("expected nothing left to prune, got %d", pruned)
+	}
+}
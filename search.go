@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// searchScanLimit is how many recent events the substring fallback looks through per query
+const searchScanLimit = 1000
+
+// searchable is implemented by backends that honor the NIP-50 "search" filter field
+type searchable interface {
+	SupportsSearch() bool
+}
+
+// postgresSearchBackend adds full-text search to the postgres backend through a generated
+// tsvector column, leaving every other query to the eventstore implementation.
+type postgresSearchBackend struct {
+	*postgresql.PostgresBackend
+}
+
+func (b postgresSearchBackend) SupportsSearch() bool { return true }
+
+func (b postgresSearchBackend) Init() error {
+	if err := b.PostgresBackend.Init(); err != nil {
+		return err
+	}
+	_, err := b.DB.Exec(`
+ALTER TABLE event ADD COLUMN IF NOT EXISTS content_tsv tsvector
+  GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED;
+CREATE INDEX IF NOT EXISTS contenttsvidx ON event USING gin (content_tsv);
+    `)
+	return err
+}
+
+// queryEvents runs full-text searches itself and hands every other filter to eventstore
+func (b postgresSearchBackend) queryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if filter.Search == "" {
+		return b.PostgresBackend.QueryEvents(ctx, filter)
+	}
+
+	conditions := []string{`content_tsv @@ websearch_to_tsquery('simple', ?)`}
+	params := []any{filter.Search}
+	in := func(column string, values []string) {
+		conditions = append(conditions, column+` IN (?`+strings.Repeat(`,?`, len(values)-1)+`)`)
+		for _, v := range values {
+			params = append(params, v)
+		}
+	}
+	if len(filter.IDs) > 0 {
+		in("id", filter.IDs)
+	}
+	if len(filter.Authors) > 0 {
+		in("pubkey", filter.Authors)
+	}
+	if len(filter.Kinds) > 0 {
+		conditions = append(conditions, `kind IN (?`+strings.Repeat(`,?`, len(filter.Kinds)-1)+`)`)
+		for _, k := range filter.Kinds {
+			params = append(params, k)
+		}
+	}
+	for _, values := range filter.Tags {
+		if len(values) == 0 {
+			return nil, postgresql.EmptyTagSet
+		}
+		conditions = append(conditions, `tagvalues && ARRAY[?`+strings.Repeat(`,?`, len(values)-1)+`]`)
+		for _, v := range values {
+			params = append(params, v)
+		}
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, `created_at >= ?`)
+		params = append(params, filter.Since)
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, `created_at <= ?`)
+		params = append(params, filter.Until)
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > b.QueryLimit {
+		limit = b.QueryLimit
+	}
+	params = append(params, limit)
+
+	query := sqlx.Rebind(sqlx.DOLLAR, `SELECT id, pubkey, created_at, kind, tags, content, sig
+        FROM event WHERE `+strings.Join(conditions, " AND ")+` ORDER BY created_at DESC, id LIMIT ?`)
+
+	rows, err := b.DB.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search events: %w", err)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var evt nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp, &evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+				return
+			}
+			evt.CreatedAt = nostr.Timestamp(timestamp)
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// scanSearchBackend gives key-value backends (lmdb, badger) a basic search by scanning the
+// most recent matching events for a case-insensitive substring of the content.
+type scanSearchBackend struct {
+	DBBackend
+}
+
+func (b scanSearchBackend) SupportsSearch() bool { return true }
+
+func (b scanSearchBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if filter.Search == "" {
+		return b.DBBackend.QueryEvents(ctx, filter)
+	}
+
+	needle := strings.ToLower(filter.Search)
+	limit := filter.Limit
+	scan := filter
+	scan.Search = ""
+	scan.Limit = searchScanLimit
+
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := b.DBBackend.QueryEvents(ctx, scan)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer cancel()
+		defer close(ch)
+		sent := 0
+		for evt := range events {
+			if !strings.Contains(strings.ToLower(evt.Content), needle) {
+				continue
+			}
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+			if sent++; limit > 0 && sent >= limit {
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// supportsSearch reports whether the active backend honors NIP-50 search filters
+func supportsSearch(backend DBBackend) bool {
+	s, ok := backend.(searchable)
+	return ok && s.SupportsSearch()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestScanSearchMatchesContent(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	for _, content := range []string{"Deploy finished", "lunch?", "rollback the deploy"} {
+		if err := db.SaveEvent(ctx, signedEvent(t, sk, nostr.KindTextNote, content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend := scanSearchBackend{db}
+
+	ch, err := backend.QueryEvents(ctx, nostr.Filter{Search: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for evt := range ch {
+		got = append(got, evt.Content)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 matches, got %q", got)
+	}
+
+	if !supportsSearch(backend) || supportsSearch(db) {
+		t.Fatal("expected only the wrapped backend to advertise search")
+	}
+}
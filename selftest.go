@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// selfTestTimeout bounds the whole startup self-test
+const selfTestTimeout = 30 * time.Second
+
+// runSelfTest checks on boot that the configured store can save an event and return it, and
+// with blossom on that a blob can be written and read back, so a misconfigured DB or blob path
+// fails at startup rather than on the first real request. Everything it writes is removed
+// again. swarm only knows the relay's public key, so the test event is signed by a throwaway
+// key and saved straight to the store, past the membership checks.
+func runSelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	evt := nostr.Event{
+		Kind:      nostr.KindTextNote,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"t", "swarm-selftest"}},
+		Content:   "swarm startup self-test",
+	}
+	if err := evt.Sign(nostr.GeneratePrivateKey()); err != nil {
+		return fmt.Errorf("signing test event: %w", err)
+	}
+	if err := db.SaveEvent(ctx, &evt); err != nil {
+		return fmt.Errorf("saving test event: %w", err)
+	}
+	found, err := hasEvent(ctx, evt.ID)
+	if err == nil && !found {
+		err = fmt.Errorf("saved test event %s not found", evt.ID)
+	}
+	if deleteErr := db.DeleteEvent(ctx, &evt); err == nil && deleteErr != nil {
+		err = fmt.Errorf("deleting test event: %w", deleteErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.BlossomEnabled {
+		if err := selfTestBlob(ctx); err != nil {
+			return err
+		}
+	}
+	log.Printf("Self-test passed")
+	return nil
+}
+
+// selfTestBlob stores a small blob, reads it back and removes it
+func selfTestBlob(ctx context.Context) error {
+	content := []byte(fmt.Sprintf("swarm startup self-test %d", time.Now().UnixNano()))
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	// it's our own text, there's nothing for the classifier to look at
+	ctx = context.WithValue(ctx, moderatedBlobKey{}, hash)
+	if _, err := verifyAndStore(ctx, hash, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("storing test blob: %w", err)
+	}
+	defer fs.Remove(blobPath(hash))
+
+	reader, err := loadBlob(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("loading test blob: %w", err)
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	stored, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("reading test blob: %w", err)
+	}
+	if !bytes.Equal(stored, content) {
+		return fmt.Errorf("test blob %s came back with different content", hash)
+	}
+	return nil
+}
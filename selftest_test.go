@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestSelfTestPassesAndCleansUp(t *testing.T) {
+	newTestBlossom(t)
+	ctx := context.Background()
+
+	if err := runSelfTest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.CountEvents(ctx, nostr.Filter{}); n != 0 {
+		t.Fatalf("expected the test event to be removed, %d events left", n)
+	}
+	blobs, _, err := blobUsage()
+	if err != nil || blobs != 0 {
+		t.Fatalf("expected the test blob to be removed, %d left (%v)", blobs, err)
+	}
+}
+
+func TestSelfTestFailsOnUnwritableBlobPath(t *testing.T) {
+	newTestBlossom(t)
+	fs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+	t.Cleanup(func() { blobStorageWritable.Store(true) })
+
+	if err := runSelfTest(context.Background()); err == nil {
+		t.Fatal("expected the self-test to fail when blobs can't be written")
+	}
+}
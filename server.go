@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func serve() {
+	// Configure HTTP server with timeouts suitable for large file uploads
+	server := &http.Server{
+		Addr:              config.ListenAddr,
+		Handler:           withRequestID(withRequestLog(withCORS(withCompression(withConnectionLimit(withEventRateLimit(withSubscriptionTracking(withLandingPage(relay)))))))),
+		ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
+		WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
+		IdleTimeout:       5 * time.Minute,  // Increased idle timeout; websockets are kept alive by WS_PING_INTERVAL instead
+		ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
+		MaxHeaderBytes:    1 << 20,          // 1MB max header size
+	}
+
+	if config.TLSAutocertDomain != nil {
+		// Let's Encrypt via the TLS-ALPN-01 challenge, so the listener must be reachable on :443
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*config.TLSAutocertDomain),
+			Cache:      autocert.DirCache(config.TLSAutocertCache),
+		}
+		server.TLSConfig = manager.TLSConfig()
+	}
+	if err := configureHTTP2(server); err != nil {
+		log.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+
+	var err error
+	switch {
+	case config.TLSAutocertDomain != nil:
+		fmt.Printf("running on %s with TLS (autocert for %s) and extended timeouts for large uploads\n", config.ListenAddr, *config.TLSAutocertDomain)
+		err = server.ListenAndServeTLS("", "")
+	case config.TLSCertFile != nil && config.TLSKeyFile != nil:
+		fmt.Printf("running on %s with TLS and extended timeouts for large uploads\n", config.ListenAddr)
+		err = server.ListenAndServeTLS(*config.TLSCertFile, *config.TLSKeyFile)
+	default:
+		fmt.Printf("running on %s with extended timeouts for large uploads\n", config.ListenAddr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server stopped: %v", err)
+	}
+}
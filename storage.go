@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	errBlobWrite              = errors.New("blob write failed")
+	errBlobStorageFull        = errors.New("insufficient storage for blob")
+	errBlobStorageUnavailable = errors.New("blob storage unavailable")
+)
+
+// blobStorageWritable tracks whether the last write to BlossomPath succeeded; /readyz reports
+// not-ready while it is false so load balancers drain traffic away from this node
+var blobStorageWritable atomic.Bool
+
+// blobStorageFailure logs a failed write under BlossomPath, marks the storage unwritable and
+// returns a clean error for the client instead of the raw filesystem one
+func blobStorageFailure(sha256 string, path string, err error) error {
+	log.Printf("StoreBlob: failed writing blob %s at %s: %v", sha256, path, err)
+	blobStorageWritable.Store(false)
+	if errors.Is(err, syscall.ENOSPC) {
+		return errBlobStorageFull
+	}
+	return errBlobStorageUnavailable
+}
+
+// checkBlobStorage reports whether BlossomPath is writable. Once it has been marked unwritable
+// every call probes it again with a small temp file, so the node recovers on its own when the
+// volume is remounted or space is freed.
+func checkBlobStorage() bool {
+	if blobStorageWritable.Load() {
+		return true
+	}
+
+	err := probeBlobStorage()
+	if err != nil {
+		log.Printf("Blob storage %s is not writable: %v", *config.BlossomPath, err)
+		return false
+	}
+	blobStorageWritable.Store(true)
+	return true
+}
+
+// initBlobStorage creates BlossomPath and proves it can be written to with a probe file, so
+// a permissions problem stops the relay at startup with the path in the message instead of
+// surfacing as a failed first upload
+func initBlobStorage() error {
+	if err := fs.MkdirAll(*config.BlossomPath, 0755); err != nil {
+		return fmt.Errorf("cannot create BLOSSOM_PATH %s: %w", *config.BlossomPath, err)
+	}
+	if err := probeBlobStorage(); err != nil {
+		return fmt.Errorf("BLOSSOM_PATH %s is not writable, check its owner and permissions: %w", *config.BlossomPath, err)
+	}
+	blobStorageWritable.Store(true)
+	return nil
+}
+
+// probeBlobStorage creates, writes and removes a temp file in BlossomPath; readiness runs the
+// same check as startup while the storage is marked unwritable
+func probeBlobStorage() error {
+	file, err := afero.TempFile(fs, *config.BlossomPath, ".probe-*"+tempBlobSuffix)
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(file.Name())
+
+	if _, err := file.Write([]byte{0}); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close probe file: %w", err)
+	}
+	return nil
+}
+
+// handleReady is the readiness probe. It only fails on conditions where sending traffic to
+// this node would make requests fail: an unwritable blob path, or with MEMBERSHIP_STALE_UNREADY
+// on, a member list older than MEMBERSHIP_MAX_STALENESS.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if config.BlossomEnabled && !checkBlobStorage() {
+		http.Error(w, "blob storage not writable", http.StatusServiceUnavailable)
+		return
+	}
+	if _, stale := membershipStale(); stale && config.MembershipStaleUnready {
+		http.Error(w, "team membership is stale", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestUnwritableBlobPathFailsCleanlyAndFlipsReadiness(t *testing.T) {
+	newTestBlossom(t)
+	writable := fs
+	fs = afero.NewReadOnlyFs(writable)
+	blobStorageWritable.Store(true)
+
+	_, err := verifyAndStore(context.Background(), strings.Repeat("00", 32), strings.NewReader("data"))
+	if !errors.Is(err, errBlobStorageUnavailable) {
+		t.Fatalf("expected errBlobStorageUnavailable, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness to fail, got %d", rec.Code)
+	}
+
+	// readiness recovers once the path is writable again
+	fs = writable
+	rec = httptest.NewRecorder()
+	handleReady(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected readiness to recover, got %d", rec.Code)
+	}
+}
+
+func TestInitBlobStorageFailsOnUnwritablePath(t *testing.T) {
+	newTestBlossom(t)
+	writable := fs
+	fs = afero.NewReadOnlyFs(writable)
+	blobStorageWritable.Store(false)
+
+	err := initBlobStorage()
+	if err == nil || !strings.Contains(err.Error(), "BLOSSOM_PATH blossom/") {
+		t.Fatalf("expected a clear error naming BLOSSOM_PATH, got %v", err)
+	}
+
+	fs = writable
+	if err := initBlobStorage(); err != nil {
+		t.Fatalf("expected a writable path to pass, got %v", err)
+	}
+	if !blobStorageWritable.Load() {
+		t.Fatal("expected the storage to be marked writable")
+	}
+}
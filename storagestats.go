@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// storageSizeBuckets are the upper bounds of the /stats/storage size histogram; blobs above
+// the last one land in a final unbounded bucket
+var storageSizeBuckets = []int64{
+	1 << 10,   // 1 KiB
+	64 << 10,  // 64 KiB
+	1 << 20,   // 1 MiB
+	16 << 20,  // 16 MiB
+	64 << 20,  // 64 MiB
+	256 << 20, // 256 MiB
+}
+
+type storedBlobSize struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// storageBucket counts the blobs no larger than MaxBytes and bigger than the previous bucket's
+// bound. MaxBytes is nil for the last bucket.
+type storageBucket struct {
+	MaxBytes *int64 `json:"max_bytes"`
+	Blobs    int    `json:"blobs"`
+}
+
+type storageStats struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Blobs       int              `json:"blobs"`
+	Bytes       int64            `json:"bytes"`
+	Largest     []storedBlobSize `json:"largest"`
+	Histogram   []storageBucket  `json:"histogram"`
+}
+
+// storageStatsCache holds the last walk of the blob store, which /stats/storage serves again
+// until STORAGE_STATS_CACHE has passed. The lock is held while walking, so concurrent requests
+// for stale stats wait for one walk rather than each starting their own.
+var storageStatsCache struct {
+	sync.Mutex
+	stats *storageStats
+}
+
+// collectStorageStats walks the blob store, keeping the top largest blobs
+func collectStorageStats(top int) (*storageStats, error) {
+	stats := &storageStats{GeneratedAt: time.Now().UTC(), Largest: []storedBlobSize{}}
+	counts := make([]int, len(storageSizeBuckets)+1)
+	err := walkBlobs(func(path string, info os.FileInfo) {
+		size := info.Size()
+		stats.Blobs++
+		stats.Bytes += size
+
+		bucket, _ := slices.BinarySearch(storageSizeBuckets, size)
+		counts[bucket]++
+
+		if top <= 0 || (len(stats.Largest) == top && size <= stats.Largest[top-1].Size) {
+			return
+		}
+		i, _ := slices.BinarySearchFunc(stats.Largest, size, func(b storedBlobSize, size int64) int {
+			return cmp.Compare(size, b.Size) // largest first
+		})
+		stats.Largest = slices.Insert(stats.Largest, i, storedBlobSize{SHA256: info.Name(), Size: size})
+		if len(stats.Largest) > top {
+			stats.Largest = stats.Largest[:top]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, count := range counts {
+		bucket := storageBucket{Blobs: count}
+		if i < len(storageSizeBuckets) {
+			bucket.MaxBytes = &storageSizeBuckets[i]
+		}
+		stats.Histogram = append(stats.Histogram, bucket)
+	}
+	return stats, nil
+}
+
+// handleStorageStats serves GET /stats/storage from the cache, walking the blob store again
+// once it is older than STORAGE_STATS_CACHE
+func handleStorageStats(w http.ResponseWriter, r *http.Request) {
+	storageStatsCache.Lock()
+	stats := storageStatsCache.stats
+	if stats == nil || time.Since(stats.GeneratedAt) >= config.StorageStatsCache {
+		var err error
+		stats, err = collectStorageStats(config.StorageStatsTop)
+		if err != nil {
+			storageStatsCache.Unlock()
+			log.Printf("Stats: Failed to walk %s: %v", *config.BlossomPath, err)
+			http.Error(w, "failed to walk blob storage", http.StatusInternalServerError)
+			return
+		}
+		storageStatsCache.stats = stats
+	}
+	storageStatsCache.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
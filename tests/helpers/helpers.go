@@ -0,0 +1,157 @@
+// Package helpers holds the connect, subscribe and publish checks shared by the live relay
+// test and the standalone programs in tests/. They only print what the relay does, so they
+// can be pointed at any deployment.
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// DefaultRelayURL is the relay checked when SWARM_RELAY_URL is not set
+const DefaultRelayURL = "wss://swarm.hivetalk.org"
+
+// ApprovedNpub is a team member of swarm.hivetalk.org
+const ApprovedNpub = "npub128jtgey22jdx90f7vecpy2unrn4usu3mcrlhaqpjlcy8kq8t8k7sldgax3"
+
+// RelayURL is the relay to check: SWARM_RELAY_URL or fallback, normalized so a bare host
+// like swarm.hivetalk.org resolves to wss://swarm.hivetalk.org
+func RelayURL(fallback string) string {
+	url := os.Getenv("SWARM_RELAY_URL")
+	if url == "" {
+		url = fallback
+	}
+	return nostr.NormalizeURL(url)
+}
+
+// ApprovedPubkey is ApprovedNpub as hex
+func ApprovedPubkey() string {
+	_, pubkey, err := nip19.Decode(ApprovedNpub)
+	if err != nil {
+		log.Fatalf("Failed to decode npub: %v", err)
+	}
+	return pubkey.(string)
+}
+
+// Run checks reading ApprovedNpub's notes from relayURL, then publishing as a random,
+// non-member key, for comparison
+func Run(relayURL string) {
+	approved := ApprovedPubkey()
+	fmt.Printf("Testing %s with approved pubkey: %s\n", relayURL, approved)
+	CheckRead(relayURL, approved)
+
+	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Println("Testing with random (non-approved) pubkey for comparison...")
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	fmt.Printf("Testing with random pubkey: %s\n", pubkey)
+	CheckWrite(relayURL, sk)
+}
+
+// Connect opens a connection to relayURL, logging the outcome
+func Connect(ctx context.Context, relayURL string) (*nostr.Relay, bool) {
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		log.Printf("❌ Failed to connect to %s: %v", relayURL, err)
+		return nil, false
+	}
+	fmt.Printf("✅ Successfully connected to %s\n", relayURL)
+	return relay, true
+}
+
+// Listen subscribes to the latest kind 1 notes of pubkey and prints those that arrive within
+// wait, returning how many did
+func Listen(ctx context.Context, relay *nostr.Relay, pubkey string, limit int, wait time.Duration) int {
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{Authors: []string{pubkey}, Kinds: []int{1}, Limit: limit}})
+	if err != nil {
+		log.Printf("❌ Failed to subscribe: %v", err)
+		return 0
+	}
+	defer sub.Unsub()
+
+	timeout := time.After(wait)
+	count := 0
+	for {
+		select {
+		case event := <-sub.Events:
+			count++
+			content := event.Content
+			if len(content) > 50 {
+				content = content[:50] + "..."
+			}
+			fmt.Printf("📨 Received event %d: %s\n", count, content)
+			if count == limit {
+				return count
+			}
+		case <-timeout:
+			return count
+		case <-ctx.Done():
+			return count
+		}
+	}
+}
+
+// Publish signs a kind 1 note with sk and publishes it to relay, printing whether it was accepted
+func Publish(ctx context.Context, relay *nostr.Relay, sk string) error {
+	pubkey, _ := nostr.GetPublicKey(sk)
+	event := nostr.Event{
+		Kind:      1,
+		Content:   fmt.Sprintf("Test message from %s at %s", pubkey[:8], time.Now().Format(time.RFC3339)),
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{},
+	}
+	if err := event.Sign(sk); err != nil {
+		log.Printf("❌ Failed to sign event: %v", err)
+		return err
+	}
+
+	fmt.Printf("Attempting to publish event with pubkey %s...\n", pubkey[:8])
+	err := relay.Publish(ctx, event)
+	if err != nil {
+		fmt.Printf("❌ Event rejected by %s: %v\n", relay.URL, err)
+	} else {
+		fmt.Printf("✅ Event accepted by %s\n", relay.URL)
+	}
+	return err
+}
+
+// CheckRead connects to relayURL and lists up to five of pubkey's notes
+func CheckRead(relayURL string, pubkey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	relay, ok := Connect(ctx, relayURL)
+	if !ok {
+		return
+	}
+	defer relay.Close()
+
+	fmt.Printf("Attempting to subscribe to events from pubkey %s...\n", pubkey[:8])
+	count := Listen(ctx, relay, pubkey, 5, 3*time.Second)
+	fmt.Printf("⏰ Subscription test completed. Received %d events\n", count)
+}
+
+// CheckWrite connects to relayURL, publishes a note signed with sk and looks for it again
+func CheckWrite(relayURL string, sk string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	relay, ok := Connect(ctx, relayURL)
+	if !ok {
+		return
+	}
+	defer relay.Close()
+
+	Publish(ctx, relay, sk)
+
+	fmt.Printf("Checking if event was stored...\n")
+	pubkey, _ := nostr.GetPublicKey(sk)
+	if Listen(ctx, relay, pubkey, 1, 2*time.Second) == 0 {
+		fmt.Printf("⏰ No stored events found for this pubkey\n")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans around storage, queries and blob transfers. Until setupTracing
+// installs an exporter it comes from otel's global no-op provider, so spans cost nothing.
+var tracer trace.Tracer = otel.Tracer("swarm")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set. The
+// exporter reads the endpoint and the other standard OTEL_EXPORTER_OTLP_* variables itself.
+// The returned function flushes pending spans.
+func setupTracing(ctx context.Context) func(context.Context) error {
+	if config.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatalf("Error setting up OTLP trace exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(config.RelayName))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("swarm")
+	log.Printf("Exporting traces to %s", redactURL(config.OTLPEndpoint))
+	return provider.Shutdown
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func eventAttributes(evt *nostr.Event) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("nostr.event.id", evt.ID),
+		attribute.Int("nostr.event.kind", evt.Kind),
+		attribute.String("nostr.event.pubkey", evt.PubKey),
+		attribute.Int("nostr.event.content_size", len(evt.Content)),
+	)
+}
+
+// traceStore wraps an event store hook in a span named name
+func traceStore(name string, store func(context.Context, *nostr.Event) error) func(context.Context, *nostr.Event) error {
+	return func(ctx context.Context, evt *nostr.Event) error {
+		ctx, span := tracer.Start(ctx, name, eventAttributes(evt))
+		err := store(ctx, evt)
+		endSpan(span, err)
+		return err
+	}
+}
+
+// traceQuery wraps the query hook in a span that lasts until the results have been read
+func traceQuery(query func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ctx, span := tracer.Start(ctx, "query", trace.WithAttributes(
+			attribute.IntSlice("nostr.filter.kinds", filter.Kinds),
+			attribute.StringSlice("nostr.filter.authors", filter.Authors),
+			attribute.Int("nostr.filter.limit", filter.Limit),
+		))
+		events, err := query(ctx, filter)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			count := 0
+			defer func() {
+				span.SetAttributes(attribute.Int("nostr.query.results", count))
+				span.End()
+			}()
+			for evt := range events {
+				select {
+				case ch <- evt:
+					count++
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+}
+
+// startBlobSpan starts a span for a blob operation on sha256
+func startBlobSpan(ctx context.Context, name string, sha256 string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("blob.sha256", sha256)))
+}
+
+// endBlobSpan records the blob's size on span and ends it
+func endBlobSpan(span trace.Span, size int64, err error) {
+	span.SetAttributes(attribute.Int64("blob.size", size))
+	endSpan(span, err)
+}
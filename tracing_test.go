@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("swarm")
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestVerifyAndStoreIsTraced(t *testing.T) {
+	newTestBlossom(t)
+	recorder := recordSpans(t)
+
+	content := []byte("traced blob")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	if _, err := verifyAndStore(context.Background(), hash, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "blob.store" {
+		t.Fatalf("expected one blob.store span, got %v", spans)
+	}
+	if got := spanAttribute(spans[0], "blob.sha256").AsString(); got != hash {
+		t.Errorf("blob.sha256 = %q, want %q", got, hash)
+	}
+	if got := spanAttribute(spans[0], "blob.size").AsInt64(); got != int64(len(content)) {
+		t.Errorf("blob.size = %d, want %d", got, len(content))
+	}
+}
+
+func TestStoreAndQueryAreTraced(t *testing.T) {
+	newTestDB(t)
+	recorder := recordSpans(t)
+	ctx := context.Background()
+
+	evt := signedEvent(t, nostr.GeneratePrivateKey(), 1, "hello")
+	if err := traceStore("event.store", db.SaveEvent)(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	events, err := traceQuery(db.QueryEvents)(ctx, nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected two spans, got %d", len(spans))
+	}
+	if got := spanAttribute(spans[0], "nostr.event.kind").AsInt64(); spans[0].Name() != "event.store" || got != 1 {
+		t.Errorf("store span %q has kind %d", spans[0].Name(), got)
+	}
+	if got := spanAttribute(spans[0], "nostr.event.pubkey").AsString(); got != evt.PubKey {
+		t.Errorf("nostr.event.pubkey = %q, want %q", got, evt.PubKey)
+	}
+	if got := spanAttribute(spans[1], "nostr.query.results").AsInt64(); spans[1].Name() != "query" || got != 1 {
+		t.Errorf("query span %q counted %d results", spans[1].Name(), got)
+	}
+}
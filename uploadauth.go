@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxSeenAuthEvents bounds a seenAuthEvents, so a flood of fresh authorizations can't grow it
+// without limit. Once full, new authorizations are refused until older ones expire.
+const maxSeenAuthEvents = 100000
+
+var (
+	errAuthTooOld    = errors.New("authorization event is too old or in the future")
+	errAuthExpired   = errors.New("authorization expired")
+	errAuthReplayed  = errors.New("authorization has already been used")
+	errAuthStoreFull = errors.New("too many recent authorizations, try again later")
+)
+
+// uploadAuths remembers the authorizations used for PUT /upload and /mirror
+var uploadAuths = newSeenAuthEvents(maxSeenAuthEvents)
+
+// seenAuthEvents is a time-expiring record of auth event ids that have been used, and how
+// many times, so a captured authorization can't be replayed while it would still be accepted
+type seenAuthEvents struct {
+	mu    sync.Mutex
+	limit int
+	seen  map[string]*authUse
+}
+
+type authUse struct {
+	uses    int
+	expires time.Time
+}
+
+func newSeenAuthEvents(limit int) *seenAuthEvents {
+	return &seenAuthEvents{limit: limit, seen: make(map[string]*authUse)}
+}
+
+// use records one use of the auth event id, remembered until expires, and fails once it has
+// already been used allowed times
+func (s *seenAuthEvents) use(id string, allowed int, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.seen[id]; ok && now.Before(entry.expires) {
+		if entry.uses >= allowed {
+			return errAuthReplayed
+		}
+		entry.uses++
+		return nil
+	}
+	if len(s.seen) >= s.limit {
+		for seenID, entry := range s.seen {
+			if !now.Before(entry.expires) {
+				delete(s.seen, seenID)
+			}
+		}
+		if len(s.seen) >= s.limit {
+			return errAuthStoreFull
+		}
+	}
+	s.seen[id] = &authUse{uses: 1, expires: expires}
+	return nil
+}
+
+// usedUp reports whether the auth event id has already been used allowed times, without
+// using it
+func (s *seenAuthEvents) usedUp(id string, allowed int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.seen[id]
+	return ok && time.Now().Before(entry.expires) && entry.uses >= allowed
+}
+
+// checkUploadAuth refuses an upload or mirror whose authorization was created more than
+// UPLOAD_AUTH_MAX_AGE ago (or as far in the future), whose expiration tag has passed, or that
+// has been used before. A Blossom authorization listing several blobs in x tags may be used
+// once per blob. Requests without an authorization are left for the usual checks to refuse.
+// Every use takes a slot in uploadAuths, so callers check the signer may upload first.
+func checkUploadAuth(r *http.Request) error {
+	evt, allowed, err := uploadAuthUses(r)
+	if evt == nil || err != nil {
+		return err
+	}
+	// past created+max age the event is refused as too old, so it needn't be remembered longer
+	return uploadAuths.use(evt.ID, allowed, evt.CreatedAt.Time().Add(config.UploadAuthMaxAge))
+}
+
+// probeUploadAuth makes the same checks as checkUploadAuth without using the authorization
+// up, for HEAD /upload
+func probeUploadAuth(r *http.Request) error {
+	evt, allowed, err := uploadAuthUses(r)
+	if evt == nil || err != nil {
+		return err
+	}
+	if uploadAuths.usedUp(evt.ID, allowed) {
+		return errAuthReplayed
+	}
+	return nil
+}
+
+// uploadAuthUses checks the age and expiration of r's authorization under
+// UPLOAD_AUTH_MAX_AGE and returns it with the number of uses it allows: one per x tag, and
+// at least one. The event is nil when there is nothing to check.
+func uploadAuthUses(r *http.Request) (*nostr.Event, int, error) {
+	if config.UploadAuthMaxAge <= 0 {
+		return nil, 0, nil
+	}
+	evt := authorizationEvent(r)
+	if evt == nil {
+		return nil, 0, nil
+	}
+
+	if age := time.Since(evt.CreatedAt.Time()); age > config.UploadAuthMaxAge || age < -config.UploadAuthMaxAge {
+		return nil, 0, errAuthTooOld
+	}
+	if tag := evt.Tags.GetFirst([]string{"expiration", ""}); tag != nil {
+		if expiration, err := strconv.ParseInt((*tag)[1], 10, 64); err == nil && nostr.Timestamp(expiration) < nostr.Now() {
+			return nil, 0, errAuthExpired
+		}
+	}
+
+	allowed := 0
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "x" {
+			allowed++
+		}
+	}
+	return evt, max(allowed, 1), nil
+}
+
+// writeAuthUseError answers a failed checkUploadAuth or admin authorization: 401, or 503
+// while the record of recent authorizations is full
+func writeAuthUseError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAuthStoreFull) {
+		w.Header().Set("Retry-After", "60")
+		w.Header().Set("X-Reason", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeAuthError(w, err.Error(), http.StatusUnauthorized)
+}
+
+// authorizationEvent decodes the event in a "Nostr" Authorization header, or returns nil when
+// there is none or it isn't a well-formed event. Its signature is left to the caller.
+func authorizationEvent(r *http.Request) *nostr.Event {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || !evt.CheckID() {
+		return nil
+	}
+	return &evt
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestUploadAuthIsFreshAndSingleUse(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.UploadAuthMaxAge = 10 * time.Minute
+	uploadAuths = newSeenAuthEvents(maxSeenAuthEvents)
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	setTeamData(NostrData{Names: map[string]string{"member": pk}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	khatru := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := withBlobRoutes(bl, khatru)
+	upload := func(auth string, body ...string) int {
+		content := "blob"
+		if len(body) > 0 {
+			content = body[0]
+		}
+		req := httptest.NewRequest("PUT", "/upload", strings.NewReader(content))
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	auth := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", nil), sk, "upload").Header.Get("Authorization")
+	if code := upload(auth); code != http.StatusOK {
+		t.Fatalf("expected a fresh authorization to be accepted, got %d", code)
+	}
+	if code := upload(auth); code != http.StatusUnauthorized {
+		t.Fatalf("expected a replayed authorization to get 401, got %d", code)
+	}
+
+	hashOf := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// one authorization may cover as many uploads as it lists blobs
+	batch := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", nil), sk, "upload",
+		nostr.Tag{"x", hashOf("blob one")}, nostr.Tag{"x", hashOf("blob two")}).Header.Get("Authorization")
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusUnauthorized} {
+		if code := upload(batch, []string{"blob one", "blob two", "blob one"}[i]); code != want {
+			t.Fatalf("upload %d with a two-blob authorization: expected %d, got %d", i+1, want, code)
+		}
+	}
+
+	// an authorization for one blob can't be used to upload another
+	other := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", nil), sk, "upload",
+		nostr.Tag{"x", hashOf("blob one")}).Header.Get("Authorization")
+	if code := upload(other, "something else"); code != http.StatusForbidden {
+		t.Fatalf("expected a body the x tag doesn't name to get 403, got %d", code)
+	}
+	if code := upload(other, "blob one"); code != http.StatusOK {
+		t.Fatalf("expected the refused upload not to use the authorization up, got %d", code)
+	}
+
+	stale := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Timestamp(time.Now().Add(-time.Hour).Unix()),
+		Tags:      nostr.Tags{{"t", "upload"}, {"expiration", "9999999999"}},
+	}
+	stale.Sign(sk)
+	raw, _ := json.Marshal(stale)
+	if code := upload("Nostr " + base64.StdEncoding.EncodeToString(raw)); code != http.StatusUnauthorized {
+		t.Fatalf("expected an hour-old authorization to get 401, got %d", code)
+	}
+}
+
+func TestSeenAuthEventsIsBounded(t *testing.T) {
+	seen := newSeenAuthEvents(2)
+	soon := time.Now().Add(time.Minute)
+	if seen.use("a", 1, time.Now().Add(-time.Second)) != nil || seen.use("b", 1, soon) != nil {
+		t.Fatal("expected the first two ids to be recorded")
+	}
+	if err := seen.use("c", 1, soon); err != nil {
+		t.Fatalf("expected the expired id to make room, got %v", err)
+	}
+	if err := seen.use("d", 1, soon); err != errAuthStoreFull {
+		t.Fatalf("expected a full store to refuse new ids, got %v", err)
+	}
+}
+
+func TestUnauthorizedUploadsDontFillAuthRecord(t *testing.T) {
+	bl := newTestBlossom(t)
+	config.UploadAuthMaxAge = 10 * time.Minute
+	uploadAuths = newSeenAuthEvents(1)
+	t.Cleanup(func() { uploadAuths = newSeenAuthEvents(maxSeenAuthEvents) })
+	handler := withBlobRoutes(bl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	member, outsider := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	upload := func(auth string) int {
+		req := httptest.NewRequest("PUT", "/upload", strings.NewReader("blob"))
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	unsigned := nostr.Event{Kind: 24242, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"t", "upload"}, {"expiration", "9999999999"}}}
+	unsigned.PubKey = memberPub
+	unsigned.ID = unsigned.GetID()
+	raw, _ := json.Marshal(unsigned)
+	if code := upload("Nostr " + base64.StdEncoding.EncodeToString(raw)); code != http.StatusUnauthorized {
+		t.Fatalf("expected an unsigned authorization to get 401, got %d", code)
+	}
+	nonMember := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", nil), outsider, "upload").Header.Get("Authorization")
+	if code := upload(nonMember); code != http.StatusForbidden {
+		t.Fatalf("expected a non-member's authorization to get 403, got %d", code)
+	}
+
+	auth := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", nil), member, "upload").Header.Get("Authorization")
+	if code := upload(auth); code != http.StatusOK {
+		t.Fatalf("expected the member's upload to find room in the record, got %d", code)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// handleUploadCheck implements BUD-06 HEAD /upload: it tells a client whether PUT /upload
+// would take the blob described by X-SHA-256, X-Content-Length and X-Content-Type before any
+// of it is sent. The checks are the ones the upload itself goes through, the authorization
+// (without using it up), the storage probe and every RejectUpload hook from membership to
+// MAX_BLOB_COUNT, plus the size of a blob already stored under that hash, which the upload
+// would have to match. The answer is 200 or the upload's error status, with the reason in
+// X-Reason and no body.
+func handleUploadCheck(bl *blossom.BlossomServer, w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(r.Header.Get("X-SHA-256"))
+	if hash != "" && !isValidSha256(hash) {
+		writeBlobError(w, "X-SHA-256 is not a sha256 hash", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.Header.Get("X-Content-Length"))
+	if err != nil || size <= 0 {
+		writeBlobError(w, "missing or invalid X-Content-Length", http.StatusLengthRequired)
+		return
+	}
+
+	// khatru only takes Blossom authorizations for PUT /upload
+	if authorizationKind(r) == 27235 {
+		writeAuthError(w, "uploads need a Blossom authorization", http.StatusUnauthorized)
+		return
+	}
+	if _, code, err := requestAuthor(r, "upload", hash); err != nil {
+		writeAuthError(w, err.Error(), code)
+		return
+	}
+	if err := probeUploadAuth(r); err != nil {
+		writeAuthUseError(w, err)
+		return
+	}
+	if !checkBlobStorage() {
+		writeBlobError(w, errBlobStorageUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if hash != "" {
+		if info, err := fs.Stat(blobPath(hash)); err == nil && info.Size() != int64(size) {
+			writeBlobError(w, fmt.Sprintf("blob %s is already stored with %d bytes", hash, info.Size()), http.StatusBadRequest)
+			return
+		}
+	}
+
+	auth := authorizationEvent(r)
+	ext := blobExtension(r.Header.Get("X-Content-Type"))
+	for _, reject := range bl.RejectUpload {
+		if rejected, reason, code := reject(r.Context(), auth, size, ext); rejected {
+			writeBlobError(w, reason, code)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestUploadCheck(t *testing.T) {
+	bl := newTestBlossom(t)
+	bl.RejectUpload = append(bl.RejectUpload, rejectUploadNonMember, rejectUploadExtension, rejectUploadBlobCount)
+	config.BlossomBlockedExts = []string{"gif"}
+	config.UploadAuthMaxAge = 10 * time.Minute
+	member, outsider := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	memberPub, _ := nostr.GetPublicKey(member)
+	setTeamData(NostrData{Names: map[string]string{"member": memberPub}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	handler := withBlobRoutes(bl, http.NotFoundHandler())
+
+	stored := strings.Repeat("ab", 32)
+	if err := afero.WriteFile(fs, blobPath(stored), []byte("stored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fresh := strings.Repeat("cd", 32)
+
+	check := func(sk string, hash string, size int, contentType string, tags ...nostr.Tag) *http.Request {
+		req := httptest.NewRequest("HEAD", "/upload", nil)
+		if hash != "" {
+			req.Header.Set("X-SHA-256", hash)
+		}
+		if size != 0 {
+			req.Header.Set("X-Content-Length", strconv.Itoa(size))
+		}
+		req.Header.Set("X-Content-Type", contentType)
+		if sk != "" {
+			req = withBlossomAuth(t, req, sk, "upload", tags...)
+		}
+		return req
+	}
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"member", check(member, fresh, 1024, "image/png"), http.StatusOK},
+		{"without a hash", check(member, "", 1024, "image/png"), http.StatusOK},
+		{"same size as the stored blob", check(member, stored, 6, "text/plain"), http.StatusOK},
+		{"no auth", check("", fresh, 1024, "image/png"), http.StatusUnauthorized},
+		{"outsider", check(outsider, fresh, 1024, "image/png"), http.StatusForbidden},
+		{"auth for another blob", check(member, fresh, 1024, "image/png", nostr.Tag{"x", stored}), http.StatusForbidden},
+		{"bad hash", check(member, "nope", 1024, "image/png"), http.StatusBadRequest},
+		{"no length", check(member, fresh, 0, "image/png"), http.StatusLengthRequired},
+		{"too large", check(member, fresh, maxBlobSize+1, "image/png"), http.StatusRequestEntityTooLarge},
+		{"blocked type", check(member, fresh, 1024, "image/gif"), http.StatusUnsupportedMediaType},
+		{"size differs from the stored blob", check(member, stored, 1024, "text/plain"), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tc.req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d (%s)", tc.name, tc.code, rec.Code, rec.Header().Get("X-Reason"))
+		}
+		if tc.code != http.StatusOK && rec.Header().Get("X-Reason") == "" {
+			t.Errorf("%s: expected a reason in X-Reason", tc.name)
+		}
+	}
+
+	// probing doesn't use the authorization up, but a used one is reported
+	req := check(member, fresh, 1024, "image/png")
+	for range 2 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected repeated probes to pass, got %d (%s)", rec.Code, rec.Header().Get("X-Reason"))
+		}
+	}
+	if err := checkUploadAuth(req); err != nil {
+		t.Fatalf("expected the probed authorization to still be usable, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("X-Reason"), "already been used") {
+		t.Fatalf("expected a used authorization to be reported, got %d (%s)", rec.Code, rec.Header().Get("X-Reason"))
+	}
+}
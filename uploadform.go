@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// isMultipartUpload reports whether an upload was sent as multipart/form-data, as HTML forms
+// and some web upload components do, instead of as the raw blob
+func isMultipartUpload(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// unwrapMultipartUpload replaces a multipart PUT /upload body with its file part, so khatru
+// hashes and stores the file exactly as if it had been sent raw, through verifyAndStore. The
+// file is the first part with a filename, or else the part named "file"; its Content-Type
+// becomes the request's. It returns the rewritten request, or nil when the response has been
+// written.
+func unwrapMultipartUpload(w http.ResponseWriter, r *http.Request) *http.Request {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeBlobError(w, "invalid multipart upload: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			writeBlobError(w, "multipart upload has no file part", http.StatusBadRequest)
+			return nil
+		}
+		if err != nil {
+			writeBlobError(w, "invalid multipart upload: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if part.FileName() == "" && part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		body, err := io.ReadAll(io.LimitReader(part, maxBlobSize+1))
+		part.Close()
+		if err != nil {
+			writeBlobError(w, "failed to read upload body", http.StatusBadRequest)
+			return nil
+		}
+		if len(body) > maxBlobSize {
+			writeBlobError(w, errBlobTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		if len(body) == 0 {
+			writeBlobError(w, "multipart upload has an empty file part", http.StatusBadRequest)
+			return nil
+		}
+
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if contentType := part.Header.Get("Content-Type"); contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		} else {
+			r.Header.Del("Content-Type")
+		}
+		return r
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/spf13/afero"
+)
+
+func TestMultipartUploadStoresTheFilePart(t *testing.T) {
+	newTestBlossom(t)
+	config.BlossomUploadAuth = blobAuthPublic
+	rl := khatru.NewRelay()
+	bl := blossom.New(rl, *config.BlossomURL)
+	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
+	bl.StoreBlob = append(bl.StoreBlob, storeBlob)
+	handler := withBlobRoutes(bl, rl)
+	sk := nostr.GeneratePrivateKey()
+	image, hash := blobWithHash(append(pngHeader, "from a web form"...))
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("caption", "not the file")
+	part, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="upload"; filename="cat.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	part.Write(image)
+	writer.Close()
+
+	req := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", &form), sk, "upload")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the multipart upload to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var descriptor blossom.BlobDescriptor
+	if err := json.Unmarshal(rec.Body.Bytes(), &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.SHA256 != hash || descriptor.Size != len(image) {
+		t.Fatalf("expected a descriptor for the file part (%s, %d bytes), got %+v", hash, len(image), descriptor)
+	}
+	if stored, err := afero.ReadFile(fs, blobPath(hash)); err != nil || !bytes.Equal(stored, image) {
+		t.Fatalf("expected the file part to be stored under its hash, got %q (%v)", stored, err)
+	}
+
+	// a raw body is still stored as is
+	raw, rawHash := blobWithHash([]byte("raw blossom upload"))
+	req = withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", bytes.NewReader(raw)), sk, "upload")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Length", strconv.Itoa(len(raw)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), rawHash) {
+		t.Fatalf("expected the raw upload to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var empty bytes.Buffer
+	writer = multipart.NewWriter(&empty)
+	writer.WriteField("caption", "no file here")
+	writer.Close()
+	req = withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", &empty), sk, "upload")
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a form without a file to get 400, got %d", rec.Code)
+	}
+}
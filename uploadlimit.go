@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+)
+
+// uploadSlots bounds how many uploads and mirrors run at once; nil means unlimited
+var uploadSlots chan struct{}
+
+func newUploadSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// acquireUploadSlot reserves a slot for an upload without waiting. When the node is already
+// at MAX_CONCURRENT_UPLOADS it answers 503 with Retry-After and returns ok=false; otherwise
+// the caller must call release once the blob has been stored. Callers authenticate the
+// upload first, so only those allowed to upload can hold a slot.
+func acquireUploadSlot(w http.ResponseWriter) (release func(), ok bool) {
+	if uploadSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case uploadSlots <- struct{}{}:
+		return func() { <-uploadSlots }, true
+	default:
+		w.Header().Set("Retry-After", "10")
+		w.Header().Set("X-Reason", "too many concurrent uploads, try again later")
+		http.Error(w, "too many concurrent uploads, try again later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+}
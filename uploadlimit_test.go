@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAcquireUploadSlotRejectsWhenFull(t *testing.T) {
+	uploadSlots = newUploadSlots(1)
+	t.Cleanup(func() { uploadSlots = nil })
+
+	release, ok := acquireUploadSlot(httptest.NewRecorder())
+	if !ok {
+		t.Fatal("expected first upload to get a slot")
+	}
+
+	rec := httptest.NewRecorder()
+	if _, ok := acquireUploadSlot(rec); ok {
+		t.Fatal("expected second upload to be rejected")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	release()
+	if _, ok := acquireUploadSlot(httptest.NewRecorder()); !ok {
+		t.Fatal("expected a slot to be free after release")
+	}
+}
+
+func TestUploadSlotIsTakenAfterAuth(t *testing.T) {
+	bl := newTestBlossom(t)
+	uploadSlots = newUploadSlots(1)
+	t.Cleanup(func() { uploadSlots = nil })
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	setTeamData(NostrData{Names: map[string]string{"member": pk}})
+	t.Cleanup(func() { setTeamData(NostrData{}) })
+	held := -1
+	handler := withBlobRoutes(bl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		held = len(uploadSlots)
+	}))
+
+	release, _ := acquireUploadSlot(httptest.NewRecorder())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/upload", strings.NewReader("blob")))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unauthenticated upload to be refused before waiting on a slot, got %d", rec.Code)
+	}
+	release()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/upload", strings.NewReader("blob")))
+	if held != -1 || len(uploadSlots) != 0 {
+		t.Fatal("expected an unauthenticated upload not to take a slot")
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", strings.NewReader("blob")), sk, "upload"))
+	if rec.Code != http.StatusOK || held != 1 || len(uploadSlots) != 0 {
+		t.Fatalf("expected the member's upload to hold the slot while stored, got %d with %d held", rec.Code, held)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// setBlobHeaders repeats the stored blob's hash and size from its descriptor as X-Blob-Sha256
+// and X-Blob-Size, so clients can check the round trip without parsing the body or sending a
+// HEAD. Content-Length is left to describe the response body itself.
+func setBlobHeaders(w http.ResponseWriter, descriptor blossom.BlobDescriptor) {
+	w.Header().Set("X-Blob-Sha256", descriptor.SHA256)
+	w.Header().Set("X-Blob-Size", strconv.Itoa(descriptor.Size))
+}
+
+// writeBlobDescriptor answers an upload or mirror with the descriptor of the stored blob
+func writeBlobDescriptor(w http.ResponseWriter, descriptor blossom.BlobDescriptor) {
+	setBlobHeaders(w, descriptor)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descriptor)
+}
+
+// uploadResponseWriter buffers khatru's PUT /upload response so the blob headers can be added
+// from its descriptor, and, with BLOSSOM_PUBLIC_URL set, so the descriptor's url, which links
+// to khatru's ServiceURL (BLOSSOM_URL), can point at the public URL instead
+type uploadResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (uw *uploadResponseWriter) WriteHeader(status int) { uw.status = status }
+
+func (uw *uploadResponseWriter) Write(b []byte) (int, error) { return uw.body.Write(b) }
+
+// flush writes the buffered response, adding the blob headers and rewriting the descriptor's url
+func (uw *uploadResponseWriter) flush() {
+	body := uw.body.Bytes()
+	if uw.status == 0 || uw.status == http.StatusOK {
+		var descriptor blossom.BlobDescriptor
+		if err := json.Unmarshal(body, &descriptor); err == nil && descriptor.SHA256 != "" {
+			setBlobHeaders(uw, descriptor)
+		}
+		if config.BlossomPublicURL != "" {
+			body = bytes.Replace(body, []byte(`"url":"`+*config.BlossomURL+`/`), []byte(`"url":"`+config.BlossomPublicURL+`/`), 1)
+		}
+	}
+	uw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if uw.status != 0 {
+		uw.ResponseWriter.WriteHeader(uw.status)
+	}
+	uw.ResponseWriter.Write(body)
+}
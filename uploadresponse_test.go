@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestUploadResponseCarriesBlobHeaders(t *testing.T) {
+	newTestBlossom(t)
+	config.BlossomPublicURL = "https://cdn.example.com"
+	config.BlossomUploadAuth = blobAuthPublic
+	rl := khatru.NewRelay()
+	bl := blossom.New(rl, *config.BlossomURL)
+	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
+	bl.StoreBlob = append(bl.StoreBlob, storeBlob)
+	handler := withBlobRoutes(bl, rl)
+	content, hash := blobWithHash([]byte("check my round trip"))
+
+	req := withBlossomAuth(t, httptest.NewRequest("PUT", "/upload", bytes.NewReader(content)), nostr.GeneratePrivateKey(), "upload")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the upload to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Blob-Sha256"); got != hash {
+		t.Errorf("expected X-Blob-Sha256 %s, got %q", hash, got)
+	}
+	if got := rec.Header().Get("X-Blob-Size"); got != strconv.Itoa(len(content)) {
+		t.Errorf("expected X-Blob-Size %d, got %q", len(content), got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("expected Content-Length to match the body (%d), got %q", rec.Body.Len(), got)
+	}
+
+	var descriptor blossom.BlobDescriptor
+	if err := json.Unmarshal(rec.Body.Bytes(), &descriptor); err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.SHA256 != hash || descriptor.Size != len(content) || !strings.HasPrefix(descriptor.URL, "https://cdn.example.com/"+hash) {
+		t.Fatalf("expected the descriptor to match the headers and use the public URL, got %+v", descriptor)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// wotQueryBatch is how many authors' contact lists are asked for per query, well under the
+// stores' default query cap
+const wotQueryBatch = 100
+
+// wotPubkeys holds the pubkeys WOT_ENABLED let in on top of nostr.json, swapped whole on every
+// refresh like nostrData, and never modified once stored
+var wotPubkeys atomic.Pointer[map[string]bool]
+
+// isWebOfTrust reports whether pubkey is in the web of trust last expanded from the members
+func isWebOfTrust(pubkey string) bool {
+	if m := wotPubkeys.Load(); m != nil {
+		return (*m)[pubkey]
+	}
+	return false
+}
+
+// wotSize is how many pubkeys the web of trust adds to the members, for /admin/status
+func wotSize() int {
+	if m := wotPubkeys.Load(); m != nil {
+		return len(*m)
+	}
+	return 0
+}
+
+// refreshWebOfTrust re-expands the web of trust from the members in use, after every
+// nostr.json fetch or cache load. It only reads contact lists already stored here, so it
+// follows whatever members (and, past WOT_DEPTH 1, the pubkeys they brought in) have
+// published to the relay.
+func refreshWebOfTrust(ctx context.Context) {
+	if !config.WOTEnabled {
+		return
+	}
+	trusted, truncated := expandWebOfTrust(ctx, slices.Collect(maps.Values(teamData().Names)), config.WOTDepth, config.WOTMaxPubkeys)
+	wotPubkeys.Store(&trusted)
+	if truncated {
+		log.Printf("WARNING: web of trust stopped at WOT_MAX_PUBKEYS (%d) pubkeys", config.WOTMaxPubkeys)
+	}
+	log.Printf("Web of trust: %d pubkeys followed by members up to depth %d", len(trusted), config.WOTDepth)
+}
+
+// expandWebOfTrust walks the kind-3 contact lists breadth first from members: depth 1 is who
+// the members follow, depth 2 who those follow, and so on. Members themselves aren't in the
+// result. It stops early once max pubkeys have been collected, and says so.
+func expandWebOfTrust(ctx context.Context, members []string, depth, max int) (map[string]bool, bool) {
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		seen[member] = true
+	}
+	trusted := map[string]bool{}
+	frontier := members
+	for level := 0; level < depth && len(frontier) > 0; level++ {
+		var next []string
+		for batch := range slices.Chunk(frontier, wotQueryBatch) {
+			for _, followed := range followsOf(ctx, batch) {
+				if seen[followed] {
+					continue
+				}
+				if len(trusted) >= max {
+					return trusted, true
+				}
+				seen[followed] = true
+				trusted[followed] = true
+				next = append(next, followed)
+			}
+		}
+		frontier = next
+	}
+	return trusted, false
+}
+
+// followsOf returns the pubkeys p-tagged in authors' latest contact lists
+func followsOf(ctx context.Context, authors []string) []string {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{nostr.KindFollowList}, Authors: authors, Limit: len(authors)})
+	if err != nil {
+		log.Printf("Web of trust: querying contact lists failed: %v", err)
+		return nil
+	}
+	var follows []string
+	latest := map[string]bool{}
+	for evt := range ch {
+		// newest first, so any older copies a store kept are skipped
+		if latest[evt.PubKey] {
+			continue
+		}
+		latest[evt.PubKey] = true
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+				follows = append(follows, tag[1])
+			}
+		}
+	}
+	return follows
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWebOfTrust(t *testing.T) {
+	newTestDB(t)
+	ctx := context.Background()
+	keys := map[string]string{}
+	for _, name := range []string{"member", "friend", "friendOfFriend", "stranger"} {
+		sk := nostr.GeneratePrivateKey()
+		pk, _ := nostr.GetPublicKey(sk)
+		keys[name], keys[name+"Pub"] = sk, pk
+	}
+	follow := func(who string, follows ...string) {
+		evt := &nostr.Event{Kind: nostr.KindFollowList, CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+		for _, name := range follows {
+			evt.Tags = append(evt.Tags, nostr.Tag{"p", keys[name+"Pub"]})
+		}
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", "not a pubkey"})
+		if err := evt.Sign(keys[who]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	follow("member", "friend", "member")
+	follow("friend", "friendOfFriend", "member")
+
+	setTeamData(NostrData{Names: map[string]string{"member": keys["memberPub"]}})
+	t.Cleanup(func() {
+		setTeamData(NostrData{})
+		wotPubkeys.Store(nil)
+	})
+
+	config = Config{WOTEnabled: true, WOTDepth: 1, WOTMaxPubkeys: 10}
+	refreshWebOfTrust(ctx)
+	if !isTeamMember(keys["friendPub"]) || isTeamMember(keys["friendOfFriendPub"]) || isTeamMember(keys["strangerPub"]) {
+		t.Fatal("expected depth 1 to let in only who the member follows")
+	}
+	if wotSize() != 1 {
+		t.Fatalf("expected the member not to be counted in the web of trust, got %d pubkeys", wotSize())
+	}
+
+	config.WOTDepth = 2
+	refreshWebOfTrust(ctx)
+	if !isTeamMember(keys["friendOfFriendPub"]) || isTeamMember(keys["strangerPub"]) {
+		t.Fatal("expected depth 2 to let in follows of follows only")
+	}
+
+	trusted, truncated := expandWebOfTrust(ctx, []string{keys["memberPub"]}, 2, 1)
+	if !truncated || len(trusted) != 1 || !trusted[keys["friendPub"]] {
+		t.Fatalf("expected expansion to stop at the first pubkey, got %v (truncated %v)", trusted, truncated)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// eventFloodsClosed counts connections closed for exceeding WS_EVENT_RATE, reported by /admin/status
+var eventFloodsClosed atomic.Int64
+
+var errEventRateExceeded = errors.New("EVENT message rate exceeded")
+
+// withEventRateLimit caps how many EVENT messages each websocket connection may send. khatru
+// checks an event's id and signature before any of our hooks see it, so a client flooding
+// garbage would cost CPU without ever reaching a RejectEvent policy. Instead the limit is
+// applied to the raw frames as they are read off the connection, and a connection going over
+// it is closed before khatru parses another message.
+func withEventRateLimit(next http.Handler) http.Handler {
+	if config.WSEventRate <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&eventLimitedWriter{ResponseWriter: w, ip: khatru.GetIPFromRequest(r)}, r)
+	})
+}
+
+// eventLimitedWriter hands the websocket upgrade an eventLimitedConn instead of the raw one
+type eventLimitedWriter struct {
+	http.ResponseWriter
+	ip string
+}
+
+func (ew *eventLimitedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(ew.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	limited := &eventLimitedConn{
+		Conn:    conn,
+		reader:  brw.Reader, // may already hold bytes read past the request
+		ip:      ew.ip,
+		limiter: newTokenBucket(float64(config.WSEventRate), float64(max(config.WSEventBurst, 1))),
+	}
+	return limited, bufio.NewReadWriter(bufio.NewReader(limited), brw.Writer), nil
+}
+
+// eventLimitedConn follows the websocket frames read from a client and fails the read once
+// it has sent EVENT messages faster than its token bucket allows
+type eventLimitedConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	ip      string
+	limiter *tokenBucket
+	frames  wsFrameScanner
+}
+
+func (c *eventLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	for range c.frames.scan(p[:n]) {
+		if !c.limiter.allow() {
+			eventFloodsClosed.Add(1)
+			log.Printf("Closing websocket from %s: more than %d EVENT messages per second", c.ip, config.WSEventRate)
+			return 0, errEventRateExceeded
+		}
+	}
+	return n, err
+}
+
+// isEventMessage reports whether the start of a nostr message is ["EVENT"
+func isEventMessage(start []byte) bool {
+	start = bytes.TrimLeft(start, " \t\r\n")
+	if len(start) == 0 || start[0] != '[' {
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimLeft(start[1:], " \t\r\n"), []byte(`"EVENT"`))
+}
+
+// wsMessagePrefix is how much of each message wsFrameScanner keeps by default, enough for
+// isEventMessage with some whitespace around the bracket
+const wsMessagePrefix = 16
+
+// wsFrameScanner follows the client-to-server websocket frames (RFC 6455 section 5.2) as
+// they stream past, unmasking only the first keep bytes of each text message
+type wsFrameScanner struct {
+	keep int // wsMessagePrefix when 0
+
+	header    []byte
+	inFrame   bool
+	remaining uint64
+	offset    uint64
+	mask      [4]byte
+	fin       bool
+	control   bool
+
+	text     bool
+	prefix   []byte
+	reported bool
+}
+
+// scan consumes the next bytes read from the client and returns how many EVENT messages
+// began in them, counting each once enough of it has been read to tell
+func (s *wsFrameScanner) scan(b []byte) (events int) {
+	s.messages(b, func(start []byte) {
+		if isEventMessage(start) {
+			events++
+		}
+	})
+	return events
+}
+
+// messages consumes the next bytes read from the client and calls found with the start of
+// each text message in them: its first keep bytes, or all of a shorter one, once read
+func (s *wsFrameScanner) messages(b []byte, found func(start []byte)) {
+	keep := s.keep
+	if keep <= 0 {
+		keep = wsMessagePrefix
+	}
+	for {
+		if !s.inFrame && !s.readHeader(&b) {
+			return
+		}
+		n := min(uint64(len(b)), s.remaining)
+		if s.text && !s.control {
+			for i := uint64(0); i < n && len(s.prefix) < keep; i++ {
+				s.prefix = append(s.prefix, b[i]^s.mask[(s.offset+i)%4])
+			}
+		}
+		b = b[n:]
+		s.offset += n
+		s.remaining -= n
+
+		ended := s.remaining == 0 && s.fin && !s.control
+		if s.text && !s.reported && (len(s.prefix) == keep || ended) {
+			found(s.prefix)
+			s.reported = true
+		}
+		if s.remaining > 0 {
+			return // wait for the rest of the payload
+		}
+		s.inFrame = false
+	}
+}
+
+// readHeader accumulates a frame header from b and returns true once it is complete
+func (s *wsFrameScanner) readHeader(b *[]byte) bool {
+	for len(*b) > 0 {
+		s.header = append(s.header, (*b)[0])
+		*b = (*b)[1:]
+		if len(s.header) < 2 {
+			continue
+		}
+
+		length, masked := uint64(s.header[1]&0x7f), s.header[1]&0x80 != 0
+		size := 2
+		switch length {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if masked {
+			size += 4
+		}
+		if len(s.header) < size {
+			continue
+		}
+
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(s.header[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(s.header[2:10])
+		}
+		s.mask = [4]byte{}
+		if masked {
+			copy(s.mask[:], s.header[size-4:size])
+		}
+
+		opcode := s.header[0] & 0x0f
+		s.fin = s.header[0]&0x80 != 0
+		s.control = opcode >= 8
+		switch opcode {
+		case 1: // text, the start of a message
+			s.text, s.prefix, s.reported = true, s.prefix[:0], false
+		case 2: // binary messages aren't nostr messages
+			s.text = false
+		}
+		s.header = s.header[:0]
+		s.inFrame, s.remaining, s.offset = true, length, 0
+		return true
+	}
+	return false
+}
+
+// tokenBucket allows rate events per second on average, in bursts of up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (tb *tokenBucket) allow() bool {
+	now := time.Now()
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
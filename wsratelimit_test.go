@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// clientFrame builds a masked client-to-server frame
+func clientFrame(opcode byte, fin bool, payload string) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+func TestFrameScannerCountsEventMessages(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(clientFrame(1, true, `["EVENT",{"id":"x"}]`))
+	stream.Write(clientFrame(1, true, `["REQ","sub",{}]`))
+	stream.Write(clientFrame(1, false, ` [ "EV`))
+	stream.Write(clientFrame(9, true, "ping")) // control frames may interleave a fragmented message
+	stream.Write(clientFrame(0, true, `ENT",`+strings.Repeat(" ", 300)+`{}]`))
+	stream.Write(clientFrame(2, true, `["EVENT"]`)) // binary, not a nostr message
+	stream.Write(clientFrame(1, true, `["EVENT",{"content":"`+strings.Repeat("a", 1000)+`"}]`))
+
+	var whole wsFrameScanner
+	if got := whole.scan(stream.Bytes()); got != 3 {
+		t.Fatalf("expected 3 EVENT messages, got %d", got)
+	}
+	var bytewise wsFrameScanner
+	count := 0
+	for _, b := range stream.Bytes() {
+		count += bytewise.scan([]byte{b})
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 EVENT messages fed a byte at a time, got %d", count)
+	}
+}
+
+func TestEventFloodClosesConnection(t *testing.T) {
+	rl, _ := startTestRelay(t)
+	config.WSEventRate, config.WSEventBurst = 1, 3
+	server := httptest.NewServer(withEventRateLimit(rl))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	reqs, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reqs.Close()
+	for range 20 {
+		if err := reqs.WriteMessage(websocket.TextMessage, []byte(`["REQ","x",{"kinds":[1]}]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flood, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flood.Close()
+	before := eventFloodsClosed.Load()
+	for range 20 {
+		// garbage that khatru would refuse for its id before any policy runs
+		if err := flood.WriteMessage(websocket.TextMessage, []byte(`["EVENT",{"id":"nope"}]`)); err != nil {
+			break
+		}
+	}
+	flood.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := flood.ReadMessage(); err != nil {
+			if strings.Contains(err.Error(), "timeout") {
+				t.Fatalf("expected the flooding connection to be dropped, got %v", err)
+			}
+			break
+		}
+	}
+	if eventFloodsClosed.Load() != before+1 {
+		t.Fatalf("expected one closed flood to be counted, got %d", eventFloodsClosed.Load()-before)
+	}
+
+	// the connection that only subscribed is still served
+	reqs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := reqs.ReadMessage(); err != nil {
+		t.Fatalf("expected the REQ connection to stay open, got %v", err)
+	}
+}